@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+/* Per-channel anti-abuse settings, every field has a default. */
+type AntiSpamConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	RepeatLines   int      `yaml:"repeat_lines,omitempty"`   /* The same line this many times within Window scores. Default 3. */
+	FloodLines    int      `yaml:"flood_lines,omitempty"`    /* This many lines within Window scores. Default 6. */
+	Window        int      `yaml:"window,omitempty"`         /* Seconds, default 15. */
+	MassHighlight int      `yaml:"mass_highlight,omitempty"` /* Nicks of members in one line. Default 5. */
+	JoinParts     int      `yaml:"join_parts,omitempty"`     /* Joins and parts of one host within JoinWindow. Default 4. */
+	JoinWindow    int      `yaml:"join_window,omitempty"`    /* Seconds, default 120. */
+	Patterns      []string `yaml:"patterns,omitempty"`       /* Extra spam regexes, on top of the built-in ones. */
+	WarnScore     int      `yaml:"warn_score,omitempty"`     /* Default 3. */
+	QuietScore    int      `yaml:"quiet_score,omitempty"`    /* Default 6. */
+	KickbanScore  int      `yaml:"kickban_score,omitempty"`  /* Default 10. */
+	QuietDuration string   `yaml:"quiet_duration,omitempty"` /* Default 10m. */
+	BanDuration   string   `yaml:"ban_duration,omitempty"`   /* Default 1d, "0" for a permanent ban. */
+	Decay         int      `yaml:"decay,omitempty"`          /* Seconds for one point of score to wear off. Default 20. */
+	Exempt        []string `yaml:"exempt,omitempty"`         /* Masks never acted on, besides relay bots and trusted users. */
+}
+
+/* Spam seen in Libera spam waves. */
+var defaultSpamPatterns = []string{
+	`(?i)irc\.supernets\.org`,
+	`(?i)with our irc ad service`,
+	`(?i)this channel has (moved|been moved) to`,
+	`(?i)/!\\.*/!\\`,
+	`(?i)(join|visit) #\S+ (now|for free)`,
+}
+
+/* Points a line scores for each kind of abuse. */
+const (
+	scoreRepeat    = 2
+	scoreFlood     = 2
+	scoreHighlight = 5
+	scorePattern   = 5
+	scoreConfusing = 2
+	scoreJoinPart  = 3
+)
+
+/* Escalation levels. */
+const (
+	abuseNone = iota
+	abuseWarned
+	abuseQuieted
+	abuseBanned
+)
+
+type abuseRecord struct {
+	score   float64
+	updated time.Time
+	level   int
+	lines   []timedLine
+	joins   []time.Time
+}
+
+type timedLine struct {
+	text string
+	at   time.Time
+}
+
+var abuseRecords = make(map[string]*abuseRecord)
+var abuseRecordsMutex = sync.Mutex{}
+var abusePruned time.Time
+
+var spamPatternCache = make(map[string]*regexp.Regexp)
+
+func (c AntiSpamConfig) withDefaults() AntiSpamConfig {
+	defaultInt := func(v *int, d int) {
+		if *v <= 0 {
+			*v = d
+		}
+	}
+	defaultInt(&c.RepeatLines, 3)
+	defaultInt(&c.FloodLines, 6)
+	defaultInt(&c.Window, 15)
+	defaultInt(&c.MassHighlight, 5)
+	defaultInt(&c.JoinParts, 4)
+	defaultInt(&c.JoinWindow, 120)
+	defaultInt(&c.WarnScore, 3)
+	defaultInt(&c.QuietScore, 6)
+	defaultInt(&c.KickbanScore, 10)
+	defaultInt(&c.Decay, 20)
+	if c.QuietDuration == "" {
+		c.QuietDuration = "10m"
+	}
+	if c.BanDuration == "" {
+		c.BanDuration = "1d"
+	}
+	return c
+}
+
+/* The anti-spam settings of a channel, or false if it isn't enabled there. */
+func antiSpamConfig(settings *ServerConfig, channel string) (AntiSpamConfig, bool) {
+	ch := settings.FindChannel(channel)
+	if ch == nil || ch.AntiSpam == nil || !ch.AntiSpam.Enabled {
+		return AntiSpamConfig{}, false
+	}
+	return ch.AntiSpam.withDefaults(), true
+}
+
+/* Relay bots, ourselves, trusted users and configured masks are left alone. */
+func antiSpamExempt(settings *ServerConfig, cfg AntiSpamConfig, channel string, msg *IRCMessage) bool {
+	nick := msg.Nick()
+	if strings.EqualFold(nick, settings.Nick) {
+		return true
+	}
+	for _, bot := range settings.RelayBots {
+		if strings.EqualFold(bot, nick) || strings.EqualFold(bot, msg.Account()) {
+			return true
+		}
+	}
+	for _, mask := range cfg.Exempt {
+		if grantMatches(mask, nick+"!"+msg.Hostmask(), msg.Account()) {
+			return true
+		}
+	}
+	return UserRole(settings, channel, nick, msg.Account()) >= RoleTrusted
+}
+
+/* Abuse is tracked by host, so nick changes and reconnects don't reset it. */
+func abuseKey(server, channel string, msg *IRCMessage) string {
+	_, host, ok := strings.Cut(msg.Hostmask(), "@")
+	if !ok || host == "" {
+		host = msg.Nick()
+	}
+	return strings.ToLower(server + "/" + channel + "/" + host)
+}
+
+/* Called with abuseRecordsMutex held. */
+func abuseRecordFor(key string, decay int) *abuseRecord {
+	now := time.Now()
+	if now.Sub(abusePruned) > time.Minute {
+		abusePruned = now
+		for k, r := range abuseRecords {
+			if now.Sub(r.updated) > 30*time.Minute {
+				delete(abuseRecords, k)
+			}
+		}
+	}
+	record, ok := abuseRecords[key]
+	if !ok {
+		record = &abuseRecord{updated: now}
+		abuseRecords[key] = record
+	}
+	record.score -= now.Sub(record.updated).Seconds() / float64(decay)
+	if record.score <= 0 {
+		record.score = 0
+		record.level = abuseNone
+	}
+	record.updated = now
+	return record
+}
+
+/*
+ * Score a channel message for abuse and escalate if needed.
+ * Returns true if the sender's score reached warn_score and the message should be ignored.
+ */
+func CheckSpam(settings *ServerConfig, channel string, msg *IRCMessage) bool {
+	cfg, ok := antiSpamConfig(settings, channel)
+	if !ok || antiSpamExempt(settings, cfg, channel, msg) {
+		return false
+	}
+	text := msg.Trailing()
+	now := time.Now()
+	window := time.Duration(cfg.Window) * time.Second
+
+	var reasons []string
+	points := 0
+
+	abuseRecordsMutex.Lock()
+	record := abuseRecordFor(abuseKey(settings.Name, channel, msg), cfg.Decay)
+	recent := record.lines[:0]
+	for _, l := range record.lines {
+		if now.Sub(l.at) < window {
+			recent = append(recent, l)
+		}
+	}
+	record.lines = append(recent, timedLine{text, now})
+	repeats := 0
+	for _, l := range record.lines {
+		if strings.EqualFold(l.text, text) {
+			repeats++
+		}
+	}
+	if repeats >= cfg.RepeatLines {
+		points += scoreRepeat
+		reasons = append(reasons, "repeating")
+	}
+	if len(record.lines) >= cfg.FloodLines {
+		points += scoreFlood
+		reasons = append(reasons, "flooding")
+	}
+	abuseRecordsMutex.Unlock()
+
+	if n := highlights(settings.Name, channel, text); n >= cfg.MassHighlight {
+		points += scoreHighlight
+		reasons = append(reasons, "mass highlighting")
+	}
+	if spamPattern(cfg, text) {
+		points += scorePattern
+		reasons = append(reasons, "spam")
+	}
+	if confusable(text) {
+		points += scoreConfusing
+		reasons = append(reasons, "look-alike characters")
+	}
+	if points == 0 {
+		return false
+	}
+	return escalate(settings, cfg, channel, msg, float64(points), reasons) >= float64(cfg.WarnScore)
+}
+
+/* Track joins and parts of a host, cycling in and out scores. */
+func CheckJoinPart(settings *ServerConfig, msg *IRCMessage) {
+	channel := msg.Param(0)
+	cfg, ok := antiSpamConfig(settings, channel)
+	if !ok || antiSpamExempt(settings, cfg, channel, msg) {
+		return
+	}
+	now := time.Now()
+	window := time.Duration(cfg.JoinWindow) * time.Second
+
+	abuseRecordsMutex.Lock()
+	record := abuseRecordFor(abuseKey(settings.Name, channel, msg), cfg.Decay)
+	recent := record.joins[:0]
+	for _, t := range record.joins {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	record.joins = append(recent, now)
+	cycling := len(record.joins) >= cfg.JoinParts
+	if cycling {
+		record.joins = nil
+	}
+	abuseRecordsMutex.Unlock()
+
+	if cycling {
+		escalate(settings, cfg, channel, msg, scoreJoinPart, []string{"join/part flooding"})
+	}
+}
+
+/* Add points to the sender's score and act on the thresholds it crosses, returns the new score. */
+func escalate(settings *ServerConfig, cfg AntiSpamConfig, channel string, msg *IRCMessage, points float64, reasons []string) float64 {
+	abuseRecordsMutex.Lock()
+	record := abuseRecordFor(abuseKey(settings.Name, channel, msg), cfg.Decay)
+	record.score += points
+	score := record.score
+	level := abuseNone
+	switch {
+	case score >= float64(cfg.KickbanScore):
+		level = abuseBanned
+	case score >= float64(cfg.QuietScore):
+		level = abuseQuieted
+	case score >= float64(cfg.WarnScore):
+		level = abuseWarned
+	}
+	if level <= record.level {
+		abuseRecordsMutex.Unlock()
+		return score
+	}
+	record.level = level
+	abuseRecordsMutex.Unlock()
+
+	nick := msg.Nick()
+	reason := "Automatic: " + strings.Join(reasons, ", ")
+	log.Printf("[AntiSpam] %s in %s/%s scored %.1f (%s)\n", nick, settings.Name, channel, score, strings.Join(reasons, ", "))
+	switch level {
+	case abuseWarned:
+		send_irc(settings.Name, channel, fmt.Sprintf("%s: please stop %s.", nick, strings.Join(reasons, ", ")))
+		LogModeration(settings.Name, channel, settings.Nick, "warn", nick, nick+"!"+msg.Hostmask(), reason, 0)
+	case abuseQuieted:
+		duration, _ := ParseModDuration(cfg.QuietDuration)
+		Moderate(settings, channel, settings.Nick, ModQuiet, nick, duration, reason)
+	case abuseBanned:
+		duration, _ := ParseModDuration(cfg.BanDuration)
+		Moderate(settings, channel, settings.Nick, ModBan, nick, duration, reason)
+		Moderate(settings, channel, settings.Nick, ModKick, nick, 0, reason)
+	}
+	return score
+}
+
+/* How many different channel members are named in text. */
+func highlights(server, channel, text string) int {
+	members := make(map[string]bool)
+	for _, m := range ChannelMembers(server, channel) {
+		members[strings.ToLower(m.Nick)] = true
+	}
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == ':'
+	}) {
+		word = strings.ToLower(word)
+		if members[word] {
+			seen[word] = true
+		}
+	}
+	return len(seen)
+}
+
+func spamPattern(cfg AntiSpamConfig, text string) bool {
+	abuseRecordsMutex.Lock()
+	defer abuseRecordsMutex.Unlock()
+	for _, pattern := range append(defaultSpamPatterns, cfg.Patterns...) {
+		r, ok := spamPatternCache[pattern]
+		if !ok {
+			var err error
+			r, err = regexp.Compile(pattern)
+			if err != nil {
+				log.Printf("[AntiSpam] Bad spam pattern %s: %v\n", pattern, err)
+			}
+			spamPatternCache[pattern] = r
+		}
+		if r != nil && r.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Whether text uses look-alike characters to dodge filters: words mixing Latin
+ * with Cyrillic or Greek letters, or ASCII letters with fullwidth or
+ * mathematical Latin letters. Fullwidth punctuation and digits are normal in
+ * CJK text and don't count.
+ */
+func confusable(text string) bool {
+	for _, word := range strings.Fields(text) {
+		ascii, latin, other, styled := false, false, false, false
+		for _, r := range word {
+			switch {
+			case r >= 0xff21 && r <= 0xff3a, r >= 0xff41 && r <= 0xff5a, r >= 0x1d400 && r <= 0x1d6a3:
+				styled = true
+			case unicode.Is(unicode.Latin, r):
+				latin = true
+				ascii = ascii || r < unicode.MaxASCII
+			case unicode.Is(unicode.Cyrillic, r), unicode.Is(unicode.Greek, r):
+				other = true
+			}
+		}
+		if (latin && other) || (ascii && styled) {
+			return true
+		}
+	}
+	return false
+}
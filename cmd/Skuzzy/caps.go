@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/* IRCv3 capabilities requested when the server offers them. */
+var WantedCaps = []string{
+	"sasl",
+	"message-tags",
+	"server-time",
+	"account-tag",
+	"extended-join",
+	"away-notify",
+	"echo-message",
+	"batch",
+	"labeled-response",
+	"multi-prefix",
+	"userhost-in-names",
+	"account-notify",
+	"chghost",
+}
+
+func wantedCap(name string) bool {
+	for _, c := range WantedCaps {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Whether a capability was acknowledged on the server's current connection. */
+func HasCap(server, name string) bool {
+	ConnectionsMutex.RLock()
+	defer ConnectionsMutex.RUnlock()
+	_, ok := Connections[server].Caps[strings.ToLower(name)]
+	return ok
+}
+
+func setCap(server, name, value string, enabled bool) {
+	ConnectionsMutex.Lock()
+	defer ConnectionsMutex.Unlock()
+	conn, ok := Connections[server]
+	if !ok {
+		return
+	}
+	if conn.Caps == nil {
+		conn.Caps = make(map[string]string)
+	}
+	if enabled {
+		conn.Caps[strings.ToLower(name)] = value
+	} else {
+		delete(conn.Caps, strings.ToLower(name))
+	}
+	Connections[server] = conn
+}
+
+/* CAP negotiation state for one connection attempt. */
+type capNegotiation struct {
+	available map[string]string /* From CAP LS, name -> value (e.g. sasl -> PLAIN,EXTERNAL). */
+	pending   int               /* Outstanding CAP REQs. */
+	done      bool              /* CAP END has been sent. */
+}
+
+/*
+ * Handle a CAP reply. LS lists are collected until the last line, then every
+ * wanted capability the server offers is requested. Once all requests are
+ * answered, SASL is started if it was acknowledged, otherwise registration ends.
+ */
+func handleCap(settings *ServerConfig, state *ircSession, msg *IRCMessage) {
+	if state.caps.available == nil {
+		state.caps.available = make(map[string]string)
+	}
+	/* :server CAP <nick> <subcommand> [*] :<caps> */
+	subcommand := strings.ToUpper(msg.Param(1))
+	more := len(msg.Params) > 3 && msg.Param(2) == "*"
+	caps := strings.Fields(msg.Trailing())
+
+	switch subcommand {
+	case "LS":
+		for _, c := range caps {
+			name, value, _ := strings.Cut(c, "=")
+			state.caps.available[strings.ToLower(name)] = value
+		}
+		if more {
+			return
+		}
+		requestCaps(settings, state, capsToRequest(state.caps.available))
+	case "NEW":
+		var offered = make(map[string]string)
+		for _, c := range caps {
+			name, value, _ := strings.Cut(c, "=")
+			offered[strings.ToLower(name)] = value
+			state.caps.available[strings.ToLower(name)] = value
+		}
+		requestCaps(settings, state, capsToRequest(offered))
+	case "DEL":
+		for _, c := range caps {
+			setCap(settings.Name, c, "", false)
+			delete(state.caps.available, strings.ToLower(c))
+		}
+	case "ACK":
+		for _, c := range caps {
+			/* A leading '-' means the capability was disabled. */
+			name := strings.TrimPrefix(c, "-")
+			setCap(settings.Name, name, state.caps.available[strings.ToLower(name)], !strings.HasPrefix(c, "-"))
+			log.Printf("[handleCap] %s capability %s\n", settings.Name, c)
+		}
+		capReplied(settings, state)
+	case "NAK":
+		log.Printf("[handleCap] %s refused capabilities: %v\n", settings.Name, caps)
+		/* A NAK rejects the whole request; retry the capabilities one at a time. */
+		if len(caps) > 1 {
+			for _, c := range caps {
+				requestCaps(settings, state, []string{c})
+			}
+		}
+		capReplied(settings, state)
+	}
+}
+
+func capsToRequest(offered map[string]string) []string {
+	var request []string
+	for name := range offered {
+		if wantedCap(name) {
+			request = append(request, name)
+		}
+	}
+	return request
+}
+
+func requestCaps(settings *ServerConfig, state *ircSession, caps []string) {
+	if len(caps) < 1 {
+		if state.caps.pending < 1 {
+			endCapNegotiation(settings, state)
+		}
+		return
+	}
+	state.caps.pending++
+	send_irc_raw(Connections[settings.Name], fmt.Sprintf("CAP REQ :%s\r\n", strings.Join(caps, " ")))
+}
+
+func capReplied(settings *ServerConfig, state *ircSession) {
+	state.caps.pending--
+	if state.caps.pending > 0 {
+		return
+	}
+	state.caps.pending = 0
+	endCapNegotiation(settings, state)
+}
+
+/* Start SASL if it's available and configured, otherwise finish registration. */
+func endCapNegotiation(settings *ServerConfig, state *ircSession) {
+	if state.caps.done {
+		return
+	}
+	if HasCap(settings.Name, "sasl") && settings.SaslUser != "" && !state.auth_sent {
+		send_irc_raw(Connections[settings.Name], "AUTHENTICATE PLAIN\r\n")
+		return
+	}
+	finishRegistration(settings, state)
+}
+
+/* CAP END, then register and identify. */
+func finishRegistration(settings *ServerConfig, state *ircSession) {
+	if state.caps.done {
+		return
+	}
+	state.caps.done = true
+	send_irc_raw(Connections[settings.Name], "CAP END\r\n")
+
+	send_irc_raw(Connections[settings.Name], fmt.Sprintf("NICK %s\r\n", settings.Nick))
+	send_irc_raw_secret(Connections[settings.Name], fmt.Sprintf("PRIVMSG NICKSERV :IDENTIFY %s %s\r\n", settings.Nick, settings.NickservPassword))
+	send_irc_raw(Connections[settings.Name], fmt.Sprintf("USER %s 0 * :%s\r\n", settings.NickservUsername, settings.NickservUsername))
+}
+
+/* The sender's services account from account-tag, or "" if not logged in or not available. */
+func (msg *IRCMessage) Account() string {
+	account, ok := msg.Tag("account")
+	if !ok || account == "*" {
+		return ""
+	}
+	return account
+}
+
+/* When the server says the message was sent (server-time), falling back to now. */
+func (msg *IRCMessage) Time() time.Time {
+	if value, ok := msg.Tag("time"); ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+/* The label of a labeled-response reply, if any. */
+func (msg *IRCMessage) Label() string {
+	label, _ := msg.Tag("label")
+	return label
+}
+
+/* The batch reference a message belongs to, if any. */
+func (msg *IRCMessage) Batch() string {
+	batch, _ := msg.Tag("batch")
+	return batch
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* What we know about a user sharing a channel with us. */
+type TrackedUser struct {
+	Nick    string
+	User    string
+	Host    string
+	Account string /* Services account, "" if unknown or not logged in. */
+	Away    bool
+}
+
+func (u TrackedUser) Hostmask() string {
+	if u.User == "" && u.Host == "" {
+		return u.Nick
+	}
+	return u.Nick + "!" + u.User + "@" + u.Host
+}
+
+type ChannelState struct {
+	Name    string
+	Members map[string]string /* Lower-cased nick -> status prefixes, e.g. "@+". */
+	Synced  bool              /* End of NAMES received. */
+}
+
+/* Channel membership and user details for one server connection. */
+type ServerState struct {
+	mutex    sync.RWMutex
+	channels map[string]*ChannelState
+	users    map[string]*TrackedUser
+	/* From ISUPPORT: prefix mode letters to symbols, highest rank first, and the CHANMODES groups. */
+	prefixModes   string
+	prefixSymbols string
+	chanModes     [4]string
+	whox          bool
+}
+
+var ServerStates = make(map[string]*ServerState)
+var ServerStatesMutex = sync.RWMutex{}
+
+func newServerState() *ServerState {
+	return &ServerState{
+		channels:      make(map[string]*ChannelState),
+		users:         make(map[string]*TrackedUser),
+		prefixModes:   "ov",
+		prefixSymbols: "@+",
+		chanModes:     [4]string{"beIq", "k", "fjl", ""},
+	}
+}
+
+/* The state for a server, created on first use. */
+func GetServerState(server string) *ServerState {
+	ServerStatesMutex.Lock()
+	defer ServerStatesMutex.Unlock()
+	state, ok := ServerStates[server]
+	if !ok {
+		state = newServerState()
+		ServerStates[server] = state
+	}
+	return state
+}
+
+/* Forget everything about a server, e.g. after disconnecting. */
+func ResetServerState(server string) {
+	ServerStatesMutex.Lock()
+	defer ServerStatesMutex.Unlock()
+	delete(ServerStates, server)
+}
+
+/* Update channel and user state from a server message. */
+func TrackState(settings *ServerConfig, msg *IRCMessage) {
+	state := GetServerState(settings.Name)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	me := strings.EqualFold(msg.Nick(), settings.Nick)
+	if msg.Command == "JOIN" {
+		state.user(msg.Nick())
+	}
+	/* Any message from a user we track refreshes their hostmask and, with account-tag, their account. */
+	if user, ok := state.users[strings.ToLower(msg.Nick())]; ok && strings.Contains(msg.Prefix, "!") {
+		user.User, user.Host, _ = strings.Cut(msg.Hostmask(), "@")
+		if _, ok := msg.Tag("account"); ok {
+			user.Account = msg.Account()
+		}
+	}
+
+	switch msg.Command {
+	case "005":
+		if len(msg.Params) > 1 {
+			state.isupport(msg.Params[1:])
+		}
+	case "JOIN":
+		channel := state.channel(msg.Param(0))
+		if me {
+			channel.Members = make(map[string]string)
+			channel.Synced = false
+		}
+		channel.Members[strings.ToLower(msg.Nick())] = ""
+		/* extended-join: JOIN #channel account :realname */
+		if len(msg.Params) >= 3 {
+			account := msg.Param(1)
+			if account == "*" {
+				account = ""
+			}
+			state.user(msg.Nick()).Account = account
+		}
+		if me {
+			if state.whox {
+				/* Token 42 marks our own WHOX request in the 354 replies. */
+				send_irc(settings.Name, "", fmt.Sprintf("WHO %s %%tcuhnfa,42", msg.Param(0)))
+			} else {
+				send_irc(settings.Name, "", "WHO "+msg.Param(0))
+			}
+		}
+	case "PART":
+		if me {
+			delete(state.channels, strings.ToLower(msg.Param(0)))
+		} else {
+			state.removeMember(msg.Param(0), msg.Nick())
+		}
+	case "KICK":
+		if strings.EqualFold(msg.Param(1), settings.Nick) {
+			delete(state.channels, strings.ToLower(msg.Param(0)))
+		} else {
+			state.removeMember(msg.Param(0), msg.Param(1))
+		}
+	case "QUIT":
+		for _, channel := range state.channels {
+			delete(channel.Members, strings.ToLower(msg.Nick()))
+		}
+		delete(state.users, strings.ToLower(msg.Nick()))
+	case "NICK":
+		old, nick := strings.ToLower(msg.Nick()), msg.Param(0)
+		if user, ok := state.users[old]; ok {
+			delete(state.users, old)
+			user.Nick = nick
+			state.users[strings.ToLower(nick)] = user
+		}
+		for _, channel := range state.channels {
+			if prefixes, ok := channel.Members[old]; ok {
+				delete(channel.Members, old)
+				channel.Members[strings.ToLower(nick)] = prefixes
+			}
+		}
+	case "MODE":
+		if channel, ok := state.channels[strings.ToLower(msg.Param(0))]; ok && len(msg.Params) >= 2 {
+			state.applyModes(channel, msg.Param(1), msg.Params[2:])
+		}
+	case "353":
+		/* RPL_NAMREPLY: <me> <symbol> <channel> :[prefixes]nick[!user@host] ... */
+		channel := state.channel(msg.Param(2))
+		for _, name := range strings.Fields(msg.Trailing()) {
+			prefixes := ""
+			for len(name) > 0 && strings.ContainsRune(state.prefixSymbols, rune(name[0])) {
+				prefixes += name[:1]
+				name = name[1:]
+			}
+			nick, mask, _ := strings.Cut(name, "!")
+			if mask != "" {
+				user := state.user(nick)
+				user.User, user.Host, _ = strings.Cut(mask, "@")
+			} else {
+				state.user(nick)
+			}
+			channel.Members[strings.ToLower(nick)] = prefixes
+		}
+	case "366":
+		state.channel(msg.Param(1)).Synced = true
+	case "352":
+		/* RPL_WHOREPLY: <me> <channel> <user> <host> <server> <nick> <flags> :<hops> <realname> */
+		state.whoReply(msg.Param(1), msg.Param(2), msg.Param(3), msg.Param(5), msg.Param(6), "")
+	case "354":
+		/* WHOX for our "%tcuhnfa,42": <me> 42 <channel> <user> <host> <nick> <flags> <account> */
+		if msg.Param(1) == "42" {
+			account := msg.Param(7)
+			if account == "0" {
+				account = ""
+			}
+			state.whoReply(msg.Param(2), msg.Param(3), msg.Param(4), msg.Param(5), msg.Param(6), account)
+		}
+	case "AWAY":
+		/* away-notify: a parameter means away, none means back. */
+		state.user(msg.Nick()).Away = len(msg.Params) > 0
+	case "ACCOUNT":
+		account := msg.Param(0)
+		if account == "*" {
+			account = ""
+		}
+		state.user(msg.Nick()).Account = account
+	case "CHGHOST":
+		user := state.user(msg.Nick())
+		user.User, user.Host = msg.Param(0), msg.Param(1)
+	}
+}
+
+func (state *ServerState) user(nick string) *TrackedUser {
+	user, ok := state.users[strings.ToLower(nick)]
+	if !ok {
+		user = &TrackedUser{Nick: nick}
+		state.users[strings.ToLower(nick)] = user
+	}
+	return user
+}
+
+func (state *ServerState) channel(name string) *ChannelState {
+	channel, ok := state.channels[strings.ToLower(name)]
+	if !ok {
+		channel = &ChannelState{Name: name, Members: make(map[string]string)}
+		state.channels[strings.ToLower(name)] = channel
+	}
+	return channel
+}
+
+func (state *ServerState) removeMember(channel, nick string) {
+	if ch, ok := state.channels[strings.ToLower(channel)]; ok {
+		delete(ch.Members, strings.ToLower(nick))
+	}
+	state.forgetIfGone(nick)
+}
+
+/* Drop users we no longer share any channel with. */
+func (state *ServerState) forgetIfGone(nick string) {
+	for _, channel := range state.channels {
+		if _, ok := channel.Members[strings.ToLower(nick)]; ok {
+			return
+		}
+	}
+	delete(state.users, strings.ToLower(nick))
+}
+
+func (state *ServerState) whoReply(channel, username, host, nick, flags, account string) {
+	user := state.user(nick)
+	user.User, user.Host = username, host
+	user.Away = strings.HasPrefix(flags, "G")
+	if account != "" {
+		user.Account = account
+	}
+	if ch, ok := state.channels[strings.ToLower(channel)]; ok {
+		prefixes := ""
+		for _, c := range flags {
+			if strings.ContainsRune(state.prefixSymbols, c) {
+				prefixes += string(c)
+			}
+		}
+		ch.Members[strings.ToLower(nick)] = prefixes
+	}
+}
+
+/* Parse the ISUPPORT tokens we care about. */
+func (state *ServerState) isupport(tokens []string) {
+	for _, token := range tokens {
+		key, value, _ := strings.Cut(token, "=")
+		switch key {
+		case "PREFIX":
+			/* PREFIX=(ov)@+ */
+			if modes, symbols, ok := strings.Cut(strings.TrimPrefix(value, "("), ")"); ok && len(modes) == len(symbols) {
+				state.prefixModes, state.prefixSymbols = modes, symbols
+			}
+		case "CHANMODES":
+			groups := strings.Split(value, ",")
+			for i := 0; i < len(groups) && i < 4; i++ {
+				state.chanModes[i] = groups[i]
+			}
+		case "WHOX":
+			state.whox = true
+		}
+	}
+}
+
+/* Apply a channel MODE change, tracking the status prefixes of members. */
+func (state *ServerState) applyModes(channel *ChannelState, modes string, args []string) {
+	adding := true
+	for _, mode := range modes {
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.ContainsRune(state.prefixModes, mode):
+			if len(args) < 1 {
+				return
+			}
+			nick := strings.ToLower(args[0])
+			args = args[1:]
+			symbol := state.prefixSymbols[strings.IndexRune(state.prefixModes, mode)]
+			prefixes, ok := channel.Members[nick]
+			if !ok {
+				continue
+			}
+			prefixes = strings.ReplaceAll(prefixes, string(symbol), "")
+			if adding {
+				prefixes += string(symbol)
+			}
+			channel.Members[nick] = state.sortPrefixes(prefixes)
+		case strings.ContainsRune(state.chanModes[0], mode), strings.ContainsRune(state.chanModes[1], mode),
+			adding && strings.ContainsRune(state.chanModes[2], mode):
+			/* Modes with a parameter we don't track. */
+			if len(args) > 0 {
+				args = args[1:]
+			}
+		}
+	}
+}
+
+/* Order prefixes highest rank first, as the server lists them. */
+func (state *ServerState) sortPrefixes(prefixes string) string {
+	sorted := []byte(prefixes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.IndexByte(state.prefixSymbols, sorted[i]) < strings.IndexByte(state.prefixSymbols, sorted[j])
+	})
+	return string(sorted)
+}
+
+/* A member of a channel: their details plus status prefixes. */
+type ChannelMember struct {
+	TrackedUser
+	Prefixes string
+}
+
+func (m ChannelMember) IsOp() bool {
+	/* Anything ranked at or above @ (e.g. ~ and & on some networks). */
+	return strings.ContainsAny(m.Prefixes, "~&@")
+}
+
+func (m ChannelMember) IsVoiced() bool {
+	return strings.Contains(m.Prefixes, "+") || m.IsOp()
+}
+
+/* Everyone we know to be in channel, sorted by nick. */
+func ChannelMembers(server, channel string) []ChannelMember {
+	state := GetServerState(server)
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	var members []ChannelMember
+	ch, ok := state.channels[strings.ToLower(channel)]
+	if !ok {
+		return members
+	}
+	for nick, prefixes := range ch.Members {
+		user := TrackedUser{Nick: nick}
+		if u, ok := state.users[nick]; ok {
+			user = *u
+		}
+		members = append(members, ChannelMember{user, prefixes})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return strings.ToLower(members[i].Nick) < strings.ToLower(members[j].Nick)
+	})
+	return members
+}
+
+/* A single member of channel, if they're in it. */
+func FindChannelMember(server, channel, nick string) (ChannelMember, bool) {
+	state := GetServerState(server)
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	ch, ok := state.channels[strings.ToLower(channel)]
+	if !ok {
+		return ChannelMember{}, false
+	}
+	prefixes, ok := ch.Members[strings.ToLower(nick)]
+	if !ok {
+		return ChannelMember{}, false
+	}
+	user := TrackedUser{Nick: nick}
+	if u, ok := state.users[strings.ToLower(nick)]; ok {
+		user = *u
+	}
+	return ChannelMember{user, prefixes}, true
+}
+
+/* What we know about nick from any shared channel. */
+func LookupUser(server, nick string) (TrackedUser, bool) {
+	state := GetServerState(server)
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	user, ok := state.users[strings.ToLower(nick)]
+	if !ok {
+		return TrackedUser{}, false
+	}
+	return *user, true
+}
+
+func IsChannelOp(server, channel, nick string) bool {
+	member, ok := FindChannelMember(server, channel, nick)
+	return ok && member.IsOp()
+}
+
+/* Channels we're in, sorted. */
+func TrackedChannels(server string) []string {
+	state := GetServerState(server)
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	var channels []string
+	for _, channel := range state.channels {
+		channels = append(channels, channel.Name)
+	}
+	sort.Strings(channels)
+	return channels
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Per-channel LLM moderation settings. */
+type ClassifierConfig struct {
+	Mode            string  `yaml:"mode"`                       /* "advisory" (ops review first) or "enforce". */
+	ClassifyAll     bool    `yaml:"classify_all,omitempty"`     /* Classify every message, not only ones with links or look-alike characters. */
+	RatePerMinute   int     `yaml:"rate_per_minute,omitempty"`  /* Classifications per minute in the channel, default 6. */
+	WarnConfidence  float64 `yaml:"warn_confidence,omitempty"`  /* Default 0.7. */
+	QuietConfidence float64 `yaml:"quiet_confidence,omitempty"` /* Default 0.9. */
+	QuietDuration   string  `yaml:"quiet_duration,omitempty"`   /* Default 30m. */
+	ReviewChannel   string  `yaml:"review_channel,omitempty"`   /* Where advisory results go, default the channel's ops by PM. */
+}
+
+/* What the moderation_classify prompt answers with. */
+type ClassifierResult struct {
+	Category   string  `json:"category"` /* ok, spam, scam or harassment. */
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason"`
+}
+
+var rLink = regexp.MustCompile(`(?i)(https?://|www\.|\b[a-z0-9-]+\.(com|net|org|io|xyz|ru|gg|ly|me|co|top)\b)`)
+
+/* Results are cached by message text, so a spam wave costs one query. */
+var classifierCacheTTL = time.Hour
+
+type cachedClassification struct {
+	result ClassifierResult
+	at     time.Time
+}
+
+var classifierCache = make(map[string]cachedClassification)
+var classifierRate = make(map[string][]time.Time)
+var classifierMutex = sync.Mutex{}
+
+func (c ClassifierConfig) withDefaults() ClassifierConfig {
+	if c.RatePerMinute <= 0 {
+		c.RatePerMinute = 6
+	}
+	if c.WarnConfidence <= 0 {
+		c.WarnConfidence = 0.7
+	}
+	if c.QuietConfidence <= 0 {
+		c.QuietConfidence = 0.9
+	}
+	if c.QuietDuration == "" {
+		c.QuietDuration = "30m"
+	}
+	return c
+}
+
+func classifierConfig(settings *ServerConfig, channel string) (ClassifierConfig, bool) {
+	ch := settings.FindChannel(channel)
+	if ch == nil || ch.Classifier == nil {
+		return ClassifierConfig{}, false
+	}
+	mode := strings.ToLower(ch.Classifier.Mode)
+	if mode != "advisory" && mode != "enforce" {
+		return ClassifierConfig{}, false
+	}
+	cfg := ch.Classifier.withDefaults()
+	cfg.Mode = mode
+	return cfg, true
+}
+
+func classifierKey(text string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Join(strings.Fields(text), " "))))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Queue a suspicious channel message for classification by the LLM, or act on
+ * a cached result for the same text. Exempt users are skipped like in CheckSpam.
+ */
+func ClassifyMessage(settings *ServerConfig, channel string, msg *IRCMessage) {
+	cfg, ok := classifierConfig(settings, channel)
+	if !ok || settings.SysPrompts["moderation_classify"] == "" {
+		return
+	}
+	text := msg.Trailing()
+	if !cfg.ClassifyAll && !rLink.MatchString(text) && !confusable(text) {
+		return
+	}
+	spamCfg, _ := antiSpamConfig(settings, channel)
+	if antiSpamExempt(settings, spamCfg, channel, msg) {
+		return
+	}
+	key := classifierKey(text)
+	nick := msg.Nick()
+
+	classifierMutex.Lock()
+	if cached, ok := classifierCache[key]; ok && time.Since(cached.at) < classifierCacheTTL {
+		classifierMutex.Unlock()
+		log.Printf("[ClassifyMessage] Cached result for %s in %s: %v\n", nick, channel, cached.result)
+		actOnClassification(settings, cfg, channel, nick, text, cached.result)
+		return
+	}
+	rateKey := strings.ToLower(settings.Name + "/" + channel)
+	var recent []time.Time
+	for _, t := range classifierRate[rateKey] {
+		if time.Since(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= cfg.RatePerMinute {
+		classifierRate[rateKey] = recent
+		classifierMutex.Unlock()
+		log.Printf("[ClassifyMessage] Rate limit reached in %s/%s, not classifying\n", settings.Name, channel)
+		return
+	}
+	classifierRate[rateKey] = append(recent, time.Now())
+	classifierMutex.Unlock()
+
+	req := DeepseekRequest{
+		Server:        settings.Name,
+		Channel:       channel,
+		request:       fmt.Sprintf("<%s> %s", nick, text),
+		PromptName:    "moderation_classify",
+		OriginalQuery: text,
+		User:          nick,
+	}
+	/* Don't hold up the IRC loop while the worker is busy. */
+	go func() { DeepseekQueue(req.Server) <- req }()
+}
+
+/* Called by the LLM worker with the answer to a moderation_classify request. */
+func HandleClassification(settings *ServerConfig, req DeepseekRequest, response string) {
+	cfg, ok := classifierConfig(settings, req.Channel)
+	if !ok {
+		return
+	}
+	/* Models like to wrap JSON in code fences or prose. */
+	start, end := strings.Index(response, "{"), strings.LastIndex(response, "}")
+	if start < 0 || end < start {
+		log.Printf("[HandleClassification] No JSON in the classifier response: %s\n", response)
+		return
+	}
+	var result ClassifierResult
+	if err := json.Unmarshal([]byte(response[start:end+1]), &result); err != nil {
+		log.Printf("[HandleClassification] Error parsing classifier JSON: %v\nData:%s\n", err, response)
+		return
+	}
+	result.Category = strings.ToLower(result.Category)
+	classifierMutex.Lock()
+	classifierCache[classifierKey(req.OriginalQuery)] = cachedClassification{result, time.Now()}
+	for k, cached := range classifierCache {
+		if time.Since(cached.at) > classifierCacheTTL {
+			delete(classifierCache, k)
+		}
+	}
+	classifierMutex.Unlock()
+	log.Printf("[HandleClassification] %s in %s/%s: %v\n", req.User, req.Server, req.Channel, result)
+	actOnClassification(settings, cfg, req.Channel, req.User, req.OriginalQuery, result)
+}
+
+/* The action a classification calls for: "quiet", "warn" or "" for none. */
+func classificationAction(cfg ClassifierConfig, result ClassifierResult) string {
+	if result.Category == "" || result.Category == "ok" {
+		return ""
+	}
+	if result.Confidence >= cfg.QuietConfidence && result.Category != "harassment" {
+		return ModQuiet
+	}
+	if result.Confidence >= cfg.WarnConfidence {
+		return "warn"
+	}
+	return ""
+}
+
+func actOnClassification(settings *ServerConfig, cfg ClassifierConfig, channel, nick, text string, result ClassifierResult) {
+	action := classificationAction(cfg, result)
+	if action == "" {
+		return
+	}
+	if cfg.Mode == "advisory" {
+		/* Reposts of the same spam go to the review already waiting. */
+		if id, ok := PendingReviewFor(settings.Name, channel, text); ok {
+			log.Printf("[actOnClassification] %s in %s repeated the message of review %d\n", nick, channel, id)
+			return
+		}
+		id, err := AddModerationReview(settings.Name, channel, nick, BanMask(settings.Name, nick), text, result, action)
+		if err != nil {
+			log.Printf("[actOnClassification] %v\n", err)
+			return
+		}
+		notifyReviewers(settings, cfg, channel, fmt.Sprintf("[review %d] %s in %s looks like %s (%.0f%%: %s), suggested %s. "+
+			"Use !approve %d or !dismiss %d in %s.", id, nick, channel, result.Category, result.Confidence*100,
+			result.Reason, action, id, id, channel))
+		return
+	}
+	applyClassification(settings, channel, nick, BanMask(settings.Name, nick), action, result, settings.Nick)
+}
+
+/* Warn nick or quiet mask for a classified message. */
+func applyClassification(settings *ServerConfig, channel, nick, mask, action string, result ClassifierResult, actor string) {
+	reason := fmt.Sprintf("Automatic: %s (%s)", result.Category, result.Reason)
+	if action == ModQuiet {
+		cfg, _ := classifierConfig(settings, channel)
+		duration, _ := ParseModDuration(cfg.QuietDuration)
+		Moderate(settings, channel, actor, ModQuiet, mask, duration, reason)
+		return
+	}
+	send_irc(settings.Name, channel, fmt.Sprintf("%s: that looks like %s, please don't.", nick, result.Category))
+	LogModeration(settings.Name, channel, actor, "warn", nick, mask, reason, 0)
+}
+
+/* Send advisory results to the review channel, or to the channel's ops in private. */
+func notifyReviewers(settings *ServerConfig, cfg ClassifierConfig, channel, text string) {
+	if cfg.ReviewChannel != "" {
+		send_irc(settings.Name, cfg.ReviewChannel, text)
+		return
+	}
+	for _, member := range ChannelMembers(settings.Name, channel) {
+		if member.IsOp() && !strings.EqualFold(member.Nick, settings.Nick) {
+			send_irc(settings.Name, member.Nick, text)
+		}
+	}
+}
+
+func AddModerationReview(server, channel, nick, mask, text string, result ClassifierResult, action string) (int, error) {
+	res, err := DB.Exec("INSERT INTO moderation_reviews (server, channel, nick, mask, message, category, confidence, reason, "+
+		"action, status, reviewed_by, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'pending', '', ?)",
+		strings.ToLower(server), strings.ToLower(channel), nick, mask, text, result.Category, result.Confidence,
+		result.Reason, action, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to store moderation review: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+/* The pending review in channel of a message with the same text, if any. */
+func PendingReviewFor(server, channel, text string) (int, bool) {
+	rows, err := DB.Query("SELECT id, message FROM moderation_reviews WHERE server = ? AND channel = ? AND status = 'pending'",
+		strings.ToLower(server), strings.ToLower(channel))
+	if err != nil {
+		log.Printf("[PendingReviewFor] Error: %v\n", err)
+		return 0, false
+	}
+	defer rows.Close()
+	key := classifierKey(text)
+	for rows.Next() {
+		var id int
+		var message string
+		if rows.Scan(&id, &message) == nil && classifierKey(message) == key {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+/* Close a pending review, returning what it was about. */
+func ReviewModeration(server, channel string, id int, status, reviewer string) (nick, mask, action string, result ClassifierResult, err error) {
+	err = DB.QueryRow("SELECT nick, mask, action, category, confidence, reason FROM moderation_reviews "+
+		"WHERE id = ? AND server = ? AND channel = ? AND status = 'pending'", id, strings.ToLower(server),
+		strings.ToLower(channel)).Scan(&nick, &mask, &action, &result.Category, &result.Confidence, &result.Reason)
+	if err != nil {
+		return "", "", "", result, fmt.Errorf("no pending review %d in %s", id, channel)
+	}
+	_, err = DB.Exec("UPDATE moderation_reviews SET status = ?, reviewed_by = ? WHERE id = ?", status, reviewer, id)
+	return nick, mask, action, result, err
+}
+
+func PendingReviews(server, channel string) []string {
+	rows, err := DB.Query("SELECT id, nick, category, confidence, action, message FROM moderation_reviews "+
+		"WHERE server = ? AND channel = ? AND status = 'pending' ORDER BY id", strings.ToLower(server), strings.ToLower(channel))
+	if err != nil {
+		log.Printf("[PendingReviews] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var reviews []string
+	for rows.Next() {
+		var id int
+		var nick, category, action, message string
+		var confidence float64
+		if err := rows.Scan(&id, &nick, &category, &confidence, &action, &message); err != nil {
+			continue
+		}
+		reviews = append(reviews, fmt.Sprintf("[%d] %s: %s %.0f%%, suggested %s: %s", id, nick, category, confidence*100, action, message))
+	}
+	return reviews
+}
+
+func reviewCommand(approve bool) func(ctx *CommandContext) {
+	return func(ctx *CommandContext) {
+		id, err := strconv.Atoi(ctx.Args[0])
+		if err != nil {
+			ctx.Reply("Usage: " + ctx.Command.Usage())
+			return
+		}
+		status := "dismissed"
+		if approve {
+			status = "approved"
+		}
+		nick, mask, action, result, err := ReviewModeration(ctx.Settings.Name, ctx.Channel, id, status, ctx.User)
+		if err != nil {
+			ctx.Reply(err.Error())
+			return
+		}
+		if approve {
+			applyClassification(ctx.Settings, ctx.Channel, nick, mask, action, result, ctx.User)
+		}
+		ctx.Reply(fmt.Sprintf("Review %d %s.", id, status))
+	}
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "reviews",
+		Description: "List LLM moderation results waiting for review (sent privately)",
+		Category:    "Moderation",
+		Channel:     true,
+		Role:        RoleOp,
+		Handler: func(ctx *CommandContext) {
+			reviews := PendingReviews(ctx.Settings.Name, ctx.Channel)
+			if len(reviews) == 0 {
+				reviews = []string{"Nothing to review in " + ctx.Channel + "."}
+			}
+			for _, review := range reviews {
+				send_irc_priority(ctx.Settings.Name, ctx.User, review, PriorityLow)
+			}
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "approve",
+		Syntax:      "<id>",
+		Description: "Carry out the action suggested by an LLM moderation review",
+		Category:    "Moderation",
+		Channel:     true,
+		Role:        RoleOp,
+		MinArgs:     1,
+		Handler:     reviewCommand(true),
+	})
+	RegisterCommand(&Command{
+		Name:        "dismiss",
+		Syntax:      "<id>",
+		Description: "Dismiss an LLM moderation review",
+		Category:    "Moderation",
+		Channel:     true,
+		Role:        RoleOp,
+		MinArgs:     1,
+		Handler:     reviewCommand(false),
+	})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Everything a command handler needs to know about the message that invoked it. */
+type CommandContext struct {
+	Settings *ServerConfig
+	Msg      *IRCMessage
+	Channel  string /* "" for private messages. */
+	User     string
+	Account  string /* Services account of the user, "" if unknown or relayed. */
+	Relayed  bool   /* User is a nick given by a relay bot, anyone on the other side can claim it. */
+	Command  *Command
+	Args     []string
+}
+
+/* Where replies go: the channel, or the user in private. */
+func (ctx *CommandContext) Target() string {
+	if ctx.Channel != "" {
+		return ctx.Channel
+	}
+	return ctx.User
+}
+
+/* The role of the user, relayed users are never trusted with more than RoleUser. */
+func (ctx *CommandContext) Role() Role {
+	if ctx.Relayed {
+		return RoleUser
+	}
+	return UserRole(ctx.Settings, ctx.Channel, ctx.User, ctx.Account)
+}
+
+func (ctx *CommandContext) Reply(text string) {
+	send_irc(ctx.Settings.Name, ctx.Target(), text)
+}
+
+/* The arguments from i on, joined back together. */
+func (ctx *CommandContext) Rest(i int) string {
+	if i >= len(ctx.Args) {
+		return ""
+	}
+	return strings.Join(ctx.Args[i:], " ")
+}
+
+type Command struct {
+	Name        string
+	Aliases     []string /* May contain spaces, e.g. "regex scores". */
+	Syntax      string   /* Arguments as shown in help, e.g. "<nick>". */
+	Description string
+	Category    string
+	Channel     bool          /* Usable in channels. */
+	Private     bool          /* Usable in private messages. */
+	Role        Role          /* Lowest role allowed to use it, see permissions.go. */
+	MinArgs     int           /* Fewer arguments and the usage is shown. */
+	Cooldown    time.Duration /* Per channel (or private conversation). */
+	PerUser     bool          /* The cooldown applies to each user separately. */
+	Handler     func(ctx *CommandContext)
+}
+
+func (cmd *Command) Usage() string {
+	if cmd.Syntax == "" {
+		return "!" + cmd.Name
+	}
+	return "!" + cmd.Name + " " + cmd.Syntax
+}
+
+/* Help categories in the order they are shown. */
+var CommandCategories = []string{"General", "CTF Challenge", "Regex Challenge", "Moderation", "Permissions"}
+
+/* Help lines for things that are not commands, shown under their category. */
+var CommandNotes = map[string][]string{
+	"CTF Challenge": {
+		"!<hintname> - Display CTF hints (will be sent to your private messages)",
+		"!<challenge> - Send the description of a CTF challenge to your private messages",
+	},
+	"Regex Challenge": {
+		`"solution" - A message in a regex challenge enabled channel beginning and ending with a double quote will be evaluated as a possible solution.`,
+	},
+}
+
+var Commands []*Command
+var commandIndex = make(map[string]*Command)
+
+var commandCooldowns = make(map[string]time.Time)
+var commandCooldownsMutex = sync.Mutex{}
+
+func RegisterCommand(cmd *Command) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		name = strings.ToLower(name)
+		if _, exists := commandIndex[name]; exists {
+			log.Printf("[RegisterCommand] %s is already registered, ignoring it for %s\n", name, cmd.Name)
+			continue
+		}
+		commandIndex[name] = cmd
+	}
+	Commands = append(Commands, cmd)
+}
+
+/*
+ * Look up the command text starts with (the leading '!' is optional) and
+ * return it with its arguments. Two word aliases win over one word names.
+ */
+func FindCommand(text string) (*Command, []string) {
+	words := strings.Fields(strings.TrimPrefix(strings.TrimSpace(text), "!"))
+	if len(words) < 1 {
+		return nil, nil
+	}
+	if len(words) >= 2 {
+		if cmd, ok := commandIndex[strings.ToLower(words[0]+" "+words[1])]; ok {
+			return cmd, words[2:]
+		}
+	}
+	if cmd, ok := commandIndex[strings.ToLower(words[0])]; ok {
+		return cmd, words[1:]
+	}
+	return nil, nil
+}
+
+/* Whether a command may be used in a channel according to its configuration. */
+func CommandEnabled(settings *ServerConfig, channel string, cmd *Command) bool {
+	ch := settings.FindChannel(channel)
+	if ch == nil {
+		return true
+	}
+	for _, name := range ch.DisabledCommands {
+		if strings.EqualFold(name, cmd.Name) {
+			return false
+		}
+	}
+	if len(ch.Commands) == 0 {
+		return true
+	}
+	for _, name := range ch.Commands {
+		if strings.EqualFold(name, cmd.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Check the user's role against the command's, auditing every privileged use. */
+func commandAllowed(ctx *CommandContext, cmd *Command) bool {
+	if cmd.Role <= RoleUser {
+		return true
+	}
+	allowed := ctx.Role() >= cmd.Role
+	AuditCommand(ctx, allowed)
+	return allowed
+}
+
+/* Start the cooldown, or return false if the command is still cooling down. */
+func commandCooldown(ctx *CommandContext, cmd *Command) bool {
+	if cmd.Cooldown <= 0 {
+		return true
+	}
+	key := strings.ToLower(ctx.Settings.Name + "/" + ctx.Target() + "/" + cmd.Name)
+	if cmd.PerUser {
+		key += "/" + strings.ToLower(ctx.User)
+	}
+	commandCooldownsMutex.Lock()
+	defer commandCooldownsMutex.Unlock()
+	if time.Since(commandCooldowns[key]) < cmd.Cooldown {
+		return false
+	}
+	commandCooldowns[key] = time.Now()
+	return true
+}
+
+/*
+ * Run the command in text if there is one and it is usable here.
+ * Returns true if the message was handled as a command.
+ */
+func DispatchCommand(ctx *CommandContext, text string) bool {
+	cmd, args := FindCommand(text)
+	if cmd == nil {
+		return ctfCommand(ctx, text)
+	}
+	if (ctx.Channel != "" && !cmd.Channel) || (ctx.Channel == "" && !cmd.Private) {
+		return false
+	}
+	if ctx.Channel != "" && !CommandEnabled(ctx.Settings, ctx.Channel, cmd) {
+		log.Printf("[DispatchCommand] !%s is disabled in %s/%s\n", cmd.Name, ctx.Settings.Name, ctx.Channel)
+		return false
+	}
+	ctx.Command = cmd
+	ctx.Args = args
+	if !commandAllowed(ctx, cmd) {
+		log.Printf("[DispatchCommand] %s is not allowed to use !%s in %s/%s\n", ctx.User, cmd.Name, ctx.Settings.Name, ctx.Channel)
+		send_irc(ctx.Settings.Name, ctx.User, fmt.Sprintf("!%s needs the %s role.", cmd.Name, cmd.Role))
+		return true
+	}
+	if len(args) < cmd.MinArgs {
+		ctx.Reply("Usage: " + cmd.Usage())
+		return true
+	}
+	if !commandCooldown(ctx, cmd) {
+		log.Printf("[DispatchCommand] !%s is cooling down in %s/%s\n", cmd.Name, ctx.Settings.Name, ctx.Target())
+		return true
+	}
+	log.Printf("[DispatchCommand] %s used !%s %v in %s/%s\n", ctx.User, cmd.Name, args, ctx.Settings.Name, ctx.Target())
+	cmd.Handler(ctx)
+	return true
+}
+
+/* CTF hints and challenge descriptions are commands named by the CTF configuration. */
+func ctfCommand(ctx *CommandContext, text string) bool {
+	ctfconfig := ServerCTF(ctx.Settings.Name)
+	if ctfconfig == nil {
+		return false
+	}
+	name := strings.TrimPrefix(strings.TrimSpace(text), "!")
+	handled := false
+	if ctfname, candidates := hintOwner(ctx, ctfconfig, name); ctfname != "" {
+		sendHint(ctx, ctfconfig, ctfname, name)
+		handled = true
+	} else if len(candidates) > 0 {
+		/* Several challenges have a hint by that name, don't charge for all of them. */
+		send_irc(ctx.Settings.Name, ctx.User, fmt.Sprintf("%s of which challenge? %s have one, use !hint <challenge> %s",
+			name, strings.Join(candidates, ", "), name))
+		handled = true
+	}
+	for k, ctf := range ctfconfig.CTFFlags {
+		if ctf.Disabled || (ctx.Channel != "" && !strings.EqualFold(ctx.Channel, ctf.Channel)) {
+			continue
+		}
+		if strings.EqualFold(k, name) && len(ctf.Description) > 0 {
+			if ctx.Channel != "" {
+				ctx.Reply("Check your private messages " + ctx.User + ", I just sent you the description for " + k + ".")
+			}
+			send_irc(ctx.Settings.Name, ctx.User, ctf.Description)
+			handled = true
+		}
+	}
+	return handled
+}
+
+/* Usage instructions generated from the registered commands usable in channel ("" for all). */
+func HelpText(settings *ServerConfig, channel string) string {
+	var help strings.Builder
+	help.WriteString("Help about the commands I support is organized in the format of 'Command - Description'\n")
+	categories := append([]string{}, CommandCategories...)
+	for _, cmd := range Commands {
+		if !slices.Contains(categories, cmd.Category) {
+			categories = append(categories, cmd.Category)
+		}
+	}
+	for _, category := range categories {
+		var lines []string
+		for _, cmd := range Commands {
+			if cmd.Category != category || (channel != "" && !CommandEnabled(settings, channel, cmd)) {
+				continue
+			}
+			names := []string{cmd.Usage()}
+			for _, alias := range cmd.Aliases {
+				names = append(names, "!"+alias)
+			}
+			where := ""
+			if !cmd.Channel {
+				where = " (private message only)"
+			} else if !cmd.Private {
+				where = " (channel only)"
+			}
+			if cmd.Role > RoleUser {
+				where += fmt.Sprintf(" [%s]", cmd.Role)
+			}
+			lines = append(lines, fmt.Sprintf("%s - %s%s", strings.Join(names, ", "), cmd.Description, where))
+		}
+		lines = append(lines, CommandNotes[category]...)
+		if len(lines) == 0 {
+			continue
+		}
+		help.WriteString(category + ":\n")
+		help.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	help.WriteString(LLMHelp)
+	return help.String()
+}
+
+/* Names of all registered commands, for the interact socket. */
+func CommandNames() []string {
+	var names []string
+	for _, cmd := range Commands {
+		names = append(names, cmd.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "help",
+		Description: "Send this help message",
+		Category:    "General",
+		Channel:     true,
+		Private:     true,
+		Cooldown:    30 * time.Second,
+		PerUser:     true,
+		Handler: func(ctx *CommandContext) {
+			sendHelp(ctx.Settings, ctx.Target(), ctx.User)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "topic",
+		Aliases:     []string{"topic_challenge"},
+		Description: "Send help message about solving the topic",
+		Category:    "General",
+		Channel:     true,
+		Private:     true,
+		Cooldown:    30 * time.Second,
+		PerUser:     true,
+		Handler: func(ctx *CommandContext) {
+			sendTopicHelp(ctx.Settings, ctx.Target(), ctx.User)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "ctf_scores",
+		Syntax:      "[live]",
+		Description: "Display the CTF score stats for the channel, admins get the live standings of a frozen scoreboard in private",
+		Category:    "CTF Challenge",
+		Channel:     true,
+		Cooldown:    10 * time.Second,
+		Handler: func(ctx *CommandContext) {
+			if len(ctx.Args) > 0 && strings.EqualFold(ctx.Args[0], "live") &&
+				ctx.Role() >= RoleAdmin {
+				SendLiveCTFScores(ctx.Settings.Name, ctx.Channel, ctx.User)
+				return
+			}
+			SendCTFScores(ctx.Settings.Name, ctx.Channel)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "regex_scores",
+		Aliases:     []string{"regex scores"},
+		Description: "Display regex challenge score stats",
+		Category:    "Regex Challenge",
+		Channel:     true,
+		Cooldown:    10 * time.Second,
+		Handler: func(ctx *CommandContext) {
+			go SendRegexScores(ctx.Settings.Name, ctx.Channel)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "next_regex",
+		Aliases:     []string{"next regex"},
+		Description: "Take a -50 point hint and generate a new challenge",
+		Category:    "Regex Challenge",
+		Channel:     true,
+		Cooldown:    10 * time.Second,
+		Handler: func(ctx *CommandContext) {
+			go NextRegexChallenge(ctx.Settings.Name, ctx.Channel, ctx.User)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "last_regex",
+		Aliases:     []string{"last regex"},
+		Description: "Show the current regex challenge again",
+		Category:    "Regex Challenge",
+		Channel:     true,
+		Cooldown:    10 * time.Second,
+		Handler: func(ctx *CommandContext) {
+			go LastRegexChallenge(ctx.Settings.Name, ctx.Channel, ctx.User)
+		},
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * Flags are checked against, in order, a salted hash (flag_hash), a regex
+ * (flag_regex) and the legacy plaintext flag. With a flag format such as
+ * hackers{...} only what's inside the wrapper is compared.
+ */
+
+const flagHashScheme = "pbkdf2-sha256"
+const flagHashIterations = 100000
+
+/* Placeholder for the flag content in a flag format. */
+const flagFormatPlaceholder = "..."
+
+/*
+ * Hash a flag for flag_hash as pbkdf2-sha256$iterations$salt$hash. Case-insensitive
+ * flags are lowercased first, so the same must be done when checking them.
+ */
+func HashFlag(value string, caseSensitive bool) (string, error) {
+	if !caseSensitive {
+		value = strings.ToLower(value)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, value, salt, flagHashIterations, 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash flag: %w", err)
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", flagHashScheme, flagHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+/* Whether value matches a hash made by HashFlag. */
+func CheckFlagHash(hash, value string, caseSensitive bool) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != flagHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	if !caseSensitive {
+		value = strings.ToLower(value)
+	}
+	got, err := pbkdf2.Key(sha256.New, value, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+/*
+ * The content of submission inside format (e.g. hackers{...}), and whether it
+ * has that shape. Without a format the whole submission is the content.
+ */
+func FlagContent(format, submission string) (string, bool) {
+	submission = strings.TrimSpace(submission)
+	if format == "" {
+		return submission, true
+	}
+	prefix, suffix, ok := strings.Cut(format, flagFormatPlaceholder)
+	if !ok {
+		return submission, true
+	}
+	if len(submission) < len(prefix)+len(suffix)+1 ||
+		!strings.EqualFold(submission[:len(prefix)], prefix) ||
+		!strings.EqualFold(submission[len(submission)-len(suffix):], suffix) {
+		return "", false
+	}
+	return submission[len(prefix) : len(submission)-len(suffix)], true
+}
+
+/* Whether submission starts like a flag in format but isn't one, so the user can be told. */
+func MalformedFlag(format, submission string) bool {
+	prefix, _, ok := strings.Cut(format, flagFormatPlaceholder)
+	if format == "" || !ok || len(prefix) < 2 {
+		return false
+	}
+	submission = strings.TrimSpace(submission)
+	if len(submission) < len(prefix) || !strings.EqualFold(submission[:len(prefix)], prefix) {
+		return false
+	}
+	_, valid := FlagContent(format, submission)
+	return !valid
+}
+
+var flagRegexCache = make(map[string]*regexp.Regexp)
+var flagRegexMutex = sync.Mutex{}
+
+func flagRegex(pattern string, caseSensitive bool) *regexp.Regexp {
+	if !caseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	flagRegexMutex.Lock()
+	defer flagRegexMutex.Unlock()
+	r, ok := flagRegexCache[pattern]
+	if !ok {
+		/* Always match the whole answer. */
+		r, _ = regexp.Compile(`^(?:` + pattern + `)$`)
+		flagRegexCache[pattern] = r
+	}
+	return r
+}
+
+/* The flag format that applies to a challenge: its own, or the config's. */
+func (config *CTFConfig) FlagFormatFor(ctf CTF) string {
+	if ctf.FlagFormat != "" {
+		return ctf.FlagFormat
+	}
+	return config.FlagFormat
+}
+
+/* Whether submission is the flag of ctf. */
+func (config *CTFConfig) FlagMatches(ctf CTF, submission string) bool {
+	content, ok := FlagContent(config.FlagFormatFor(ctf), submission)
+	if !ok || content == "" {
+		return false
+	}
+	if ctf.FlagHash != "" && CheckFlagHash(ctf.FlagHash, content, ctf.CaseSensitive) {
+		return true
+	}
+	if ctf.FlagRegex != "" {
+		if r := flagRegex(ctf.FlagRegex, ctf.CaseSensitive); r != nil && r.MatchString(content) {
+			return true
+		}
+	}
+	if ctf.Flag != "" {
+		if ctf.CaseSensitive {
+			return subtle.ConstantTimeCompare([]byte(content), []byte(ctf.Flag)) == 1
+		}
+		return strings.EqualFold(content, ctf.Flag)
+	}
+	return false
+}
+
+/* Check a challenge's flag settings, so mistakes show up when the config is loaded. */
+func (ctf CTF) Validate() error {
+	if ctf.Flag == "" && ctf.FlagHash == "" && ctf.FlagRegex == "" {
+		return fmt.Errorf("no flag, flag_hash or flag_regex")
+	}
+	if ctf.FlagHash != "" && !strings.HasPrefix(ctf.FlagHash, flagHashScheme+"$") {
+		return fmt.Errorf("flag_hash is not a %s hash, generate one with 'Skuzzy hashflag'", flagHashScheme)
+	}
+	if ctf.FlagRegex != "" {
+		if _, err := regexp.Compile(ctf.FlagRegex); err != nil {
+			return fmt.Errorf("bad flag_regex: %w", err)
+		}
+	}
+	if ctf.FlagFormat != "" && !strings.Contains(ctf.FlagFormat, flagFormatPlaceholder) {
+		return fmt.Errorf("flag_format must contain %s", flagFormatPlaceholder)
+	}
+	if err := ctf.Hints.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* `Skuzzy hashflag [-case-sensitive] <flag>`: print a flag_hash value for ctf.yaml. */
+func hashFlagCommand(args []string) int {
+	flags := flag.NewFlagSet("hashflag", flag.ContinueOnError)
+	caseSensitive := flags.Bool("case-sensitive", false, "hash the flag for a case_sensitive challenge")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: Skuzzy hashflag [-case-sensitive] <flag>\n"+
+			"With a flag_format like hackers{...}, hash only the part inside the braces.\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	hash, err := HashFlag(flags.Arg(0), *caseSensitive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Running the CTF from IRC or the interact socket. Challenge changes are
+ * written back to ctf.yaml, the file is replaced in one rename and loaded
+ * again, so players never see half an edit. Solves live in the database.
+ */
+
+const ctfAdminUsage = "Usage: ctf <reload|show|add|edit|disable|enable|flag|hint|award|revoke|reset|announce> ..."
+
+var rValidChallengeName = regexp.MustCompile(`^[\w\-\.]{1,32}$`)
+
+/* One edit of ctf.yaml at a time. */
+var ctfEditMutex = sync.Mutex{}
+
+/* Fields `ctf edit` can change, with what they take. */
+var ctfEditFields = map[string]string{
+	"description":    "text",
+	"category":       "text",
+	"channel":        "channel",
+	"flag_format":    "e.g. hackers{...}",
+	"flag_regex":     "pattern",
+	"case_sensitive": "true|false",
+	"level":          "number",
+	"points":         "number",
+	"min_points":     "number",
+	"decay":          "number",
+	"first_blood":    "number",
+	"requires":       "challenge,...",
+}
+
+/*
+ * Apply edit to ctf.yaml as it is on disk, disabled challenges included,
+ * save it atomically and reload it. The previous file is kept as .bak since
+ * writing it back drops its comments.
+ */
+func EditCTFConfig(settings *ServerConfig, edit func(config *CTFConfig) error) error {
+	path := settings.CtfConfigPath
+	if path == "" {
+		return fmt.Errorf("there is no ctf_config_path for %s", settings.Name)
+	}
+	ctfEditMutex.Lock()
+	defer ctfEditMutex.Unlock()
+
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config CTFConfig
+	if err := yaml.Unmarshal(old, &config); err != nil {
+		return err
+	}
+	if config.CTFFlags == nil {
+		config.CTFFlags = make(map[string]CTF)
+	}
+	if err := edit(&config); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&config); err != nil {
+		return err
+	}
+	encoder.Close()
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.WriteFile(path+".bak", old, mode); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ctf-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return reloadCTFConfig(settings)
+}
+
+/* The name of a challenge in config, whatever its case. */
+func findChallenge(config *CTFConfig, name string) (string, bool) {
+	for k := range config.CTFFlags {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+/* Hash a flag for ctf, from the whole flag or only what's inside its format. */
+func hashChallengeFlag(config *CTFConfig, ctf CTF, flag string) (string, error) {
+	if content, ok := FlagContent(config.FlagFormatFor(ctf), flag); ok && content != "" {
+		flag = content
+	}
+	return HashFlag(flag, ctf.CaseSensitive)
+}
+
+/* Set one field of a challenge from its text value, empty to clear it. */
+func setChallengeField(config *CTFConfig, name, field, value string) error {
+	ctf := config.CTFFlags[name]
+	number := 0
+	if ctfEditFields[field] == "number" && value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s takes a number", field)
+		}
+		number = n
+	}
+	switch field {
+	case "description":
+		ctf.Description = value
+	case "category":
+		ctf.Category = value
+	case "channel":
+		if !strings.HasPrefix(value, "#") {
+			return fmt.Errorf("channel takes a channel")
+		}
+		ctf.Channel = value
+	case "flag_format":
+		ctf.FlagFormat = value
+	case "flag_regex":
+		ctf.FlagRegex = value
+	case "case_sensitive":
+		caseSensitive, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("case_sensitive takes true or false")
+		}
+		ctf.CaseSensitive = caseSensitive
+	case "level":
+		ctf.Level = number
+	case "points":
+		ctf.Points = number
+	case "min_points":
+		ctf.MinPoints = number
+	case "decay":
+		ctf.Decay = number
+	case "first_blood":
+		ctf.FirstBlood = number
+	case "requires":
+		ctf.Requires = nil
+		for _, required := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			k, ok := findChallenge(config, required)
+			if !ok {
+				return fmt.Errorf("there's no challenge %s", required)
+			}
+			ctf.Requires = append(ctf.Requires, k)
+		}
+	default:
+		return fmt.Errorf("unknown field %s", field)
+	}
+	if err := ctf.Validate(); err != nil {
+		return err
+	}
+	edited := &CTFConfig{CTFFlags: make(map[string]CTF)}
+	for k, other := range config.CTFFlags {
+		edited.CTFFlags[k] = other
+	}
+	edited.CTFFlags[name] = ctf
+	if edited.requiresItself(name, name, map[string]bool{}) {
+		return fmt.Errorf("%s would end up requiring itself", name)
+	}
+	config.CTFFlags[name] = ctf
+	return nil
+}
+
+/* One line about a challenge for admins, flags left out. */
+func describeChallenge(name string, ctf CTF, config *CTFConfig) string {
+	var flags []string
+	if ctf.Flag != "" {
+		flags = append(flags, "flag")
+	}
+	if ctf.FlagHash != "" {
+		flags = append(flags, "flag_hash")
+	}
+	if ctf.FlagRegex != "" {
+		flags = append(flags, "flag_regex "+ctf.FlagRegex)
+	}
+	var hints []string
+	for _, hint := range ctf.Hints {
+		hints = append(hints, fmt.Sprintf("%s (%d)", hint.Name, hint.Points()))
+	}
+	status := ""
+	if ctf.Disabled {
+		status = " [disabled]"
+	}
+	return fmt.Sprintf("%s%s %s: level %d, %d points, category %q, requires %s, checked by %s, hints: %s",
+		name, status, ctf.Channel, ctf.Level, ctf.Value(0), ctf.Category,
+		cmp.Or(strings.Join(config.Prerequisites(name), ", "), "nothing"), cmp.Or(strings.Join(flags, ", "), "nothing"),
+		cmp.Or(strings.Join(hints, ", "), "none"))
+}
+
+/*
+ * Give user a solve of ctfname, without prerequisites or first blood, for
+ * flags that were right but not accepted.
+ */
+func AwardSolve(server string, config *CTFConfig, ctfname, user string) error {
+	server = strings.ToLower(server)
+	user = strings.ToLower(user)
+	ctf, ok := config.CTFFlags[ctfname]
+	if !ok {
+		return fmt.Errorf("there's no challenge %s", ctfname)
+	}
+	if !CleanUser.MatchString(user) {
+		return fmt.Errorf("bad characters in the nick %s", user)
+	}
+	team, _ := CTFUserTeam(server, user)
+	if CTFUserSolves(server, user)[ctfname] || CTFTeamSolves(server, team)[ctfname] {
+		return ErrAlreadySolved
+	}
+	channel := strings.ToLower(ctf.Channel)
+	_, err := DB.Exec("INSERT INTO ctf_solves (server, channel, challenge, user, account, team_id, first_blood, solved) VALUES (?, ?, ?, ?, '', ?, 0, ?)",
+		server, channel, ctfname, user, team.ID, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	syncCTFLevel(server, channel, user, config)
+	return nil
+}
+
+/* Take a solve of ctfname away from user. */
+func RevokeSolve(server string, config *CTFConfig, ctfname, user string) error {
+	server = strings.ToLower(server)
+	user = strings.ToLower(user)
+	var channel string
+	err := DB.QueryRow("SELECT channel FROM ctf_solves WHERE server = ? AND challenge = ? AND user = ?",
+		server, ctfname, user).Scan(&channel)
+	if err != nil {
+		return fmt.Errorf("%s hasn't solved %s", user, ctfname)
+	}
+	if _, err := DB.Exec("DELETE FROM ctf_solves WHERE server = ? AND challenge = ? AND user = ?", server, ctfname, user); err != nil {
+		return err
+	}
+	syncCTFLevel(server, channel, user, config)
+	return nil
+}
+
+/*
+ * Set the level kept in ctf_scores to that of the solves user has left, so
+ * MigrateCTFLevels doesn't give revoked solves back.
+ */
+func syncCTFLevel(server, channel, user string, config *CTFConfig) {
+	level := 0
+	for name := range CTFUserSolves(server, user) {
+		if ctf, ok := config.CTFFlags[name]; ok && strings.EqualFold(ctf.Channel, channel) {
+			level = max(level, ctf.Level)
+		}
+	}
+	_, err := DB.Exec("INSERT INTO ctf_scores (id, user, level, last_attempt) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT(id) DO UPDATE SET level = excluded.level",
+		server+"/"+channel+"/"+user, user, level, time.Now().Unix())
+	if err != nil {
+		log.Printf("[syncCTFLevel] Error, unable to update %s's level:%v\n", user, err)
+	}
+}
+
+/* Forget everything user did in the CTF: solves, hints and levels. Their team and submissions stay. */
+func ResetCTFUser(server, user string) error {
+	server = strings.ToLower(server)
+	user = strings.ToLower(user)
+	for _, query := range []string{
+		"DELETE FROM ctf_solves WHERE server = ? AND user = ?",
+		"DELETE FROM ctf_hint_unlocks WHERE server = ? AND user = ?",
+		"DELETE FROM ctf_scores WHERE id LIKE ? || '/%' AND user = ?",
+	} {
+		if _, err := DB.Exec(query, server, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Run a ctf admin subcommand for actor, the lines to answer with. */
+func CTFAdmin(settings *ServerConfig, actor string, args []string) []string {
+	if len(args) < 1 {
+		return []string{ctfAdminUsage}
+	}
+	server := settings.Name
+	subcommand := strings.ToLower(args[0])
+	args = args[1:]
+	ctfconfig := ServerCTF(server)
+	usage := func(syntax string) []string {
+		return []string{"Usage: ctf " + subcommand + " " + syntax}
+	}
+	done := func(err error, message string) []string {
+		if err != nil {
+			return []string{"Unable to " + subcommand + ": " + err.Error()}
+		}
+		log.Printf("[CTFAdmin] %s on %s: %s\n", actor, server, message)
+		return []string{message}
+	}
+	/* Edits of one existing challenge, by name whatever its case. */
+	editChallenge := func(name string, edit func(config *CTFConfig, k string) error) (string, error) {
+		found := ""
+		err := EditCTFConfig(settings, func(config *CTFConfig) error {
+			k, ok := findChallenge(config, name)
+			if !ok {
+				return fmt.Errorf("there's no challenge %s", name)
+			}
+			found = k
+			return edit(config, k)
+		})
+		return found, err
+	}
+
+	switch subcommand {
+	case "reload":
+		if settings.CtfConfigPath == "" {
+			return []string{"There is no ctf_config_path for " + server}
+		}
+		return done(reloadCTFConfig(settings), "Reloaded "+settings.CtfConfigPath)
+	case "show":
+		if len(args) < 1 {
+			return usage("<challenge>")
+		}
+		var config CTFConfig
+		contents, err := os.ReadFile(settings.CtfConfigPath)
+		if err == nil {
+			err = yaml.Unmarshal(contents, &config)
+		}
+		if err != nil {
+			return done(err, "")
+		}
+		k, ok := findChallenge(&config, args[0])
+		if !ok {
+			return []string{"There's no challenge " + args[0]}
+		}
+		return []string{describeChallenge(k, config.CTFFlags[k], &config)}
+	case "add":
+		if len(args) < 3 {
+			return usage("<challenge> <channel> <flag>")
+		}
+		name, channel, flag := args[0], args[1], strings.Join(args[2:], " ")
+		if !rValidChallengeName.MatchString(name) {
+			return []string{"Challenge names are 1 to 32 letters, digits, '-', '_' or '.'"}
+		}
+		if !strings.HasPrefix(channel, "#") {
+			return usage("<challenge> <channel> <flag>")
+		}
+		err := EditCTFConfig(settings, func(config *CTFConfig) error {
+			if k, ok := findChallenge(config, name); ok {
+				return fmt.Errorf("there's already a challenge %s", k)
+			}
+			ctf := CTF{Channel: channel}
+			hash, err := hashChallengeFlag(config, ctf, flag)
+			if err != nil {
+				return err
+			}
+			ctf.FlagHash = hash
+			config.CTFFlags[name] = ctf
+			return nil
+		})
+		return done(err, fmt.Sprintf("Added %s in %s, worth %d points. Change it with: ctf edit %s <field> <value>",
+			name, channel, defaultCTFPoints, name))
+	case "edit":
+		if len(args) < 2 {
+			var fields []string
+			for field, takes := range ctfEditFields {
+				fields = append(fields, field+" <"+takes+">")
+			}
+			slices.Sort(fields)
+			return usage("<challenge> <field> [value], fields: " + strings.Join(fields, ", "))
+		}
+		field := strings.ToLower(args[1])
+		value := strings.Join(args[2:], " ")
+		k, err := editChallenge(args[0], func(config *CTFConfig, k string) error {
+			return setChallengeField(config, k, field, value)
+		})
+		message := fmt.Sprintf("Set %s of %s to %q", field, k, value)
+		if field == "case_sensitive" {
+			message += ", set its flag again if it has a flag_hash"
+		}
+		return done(err, message)
+	case "disable", "enable":
+		if len(args) < 1 {
+			return usage("<challenge>")
+		}
+		k, err := editChallenge(args[0], func(config *CTFConfig, k string) error {
+			ctf := config.CTFFlags[k]
+			ctf.Disabled = subcommand == "disable"
+			config.CTFFlags[k] = ctf
+			return nil
+		})
+		return done(err, fmt.Sprintf("%s is %sd, its solves are kept", k, subcommand))
+	case "flag":
+		if len(args) < 2 {
+			return usage("<challenge> <flag>")
+		}
+		k, err := editChallenge(args[0], func(config *CTFConfig, k string) error {
+			ctf := config.CTFFlags[k]
+			hash, err := hashChallengeFlag(config, ctf, strings.Join(args[1:], " "))
+			if err != nil {
+				return err
+			}
+			ctf.Flag, ctf.FlagHash, ctf.FlagRegex = "", hash, ""
+			config.CTFFlags[k] = ctf
+			return nil
+		})
+		return done(err, "Set the flag of "+k+", only its hash is stored")
+	case "hint":
+		if len(args) < 3 {
+			return usage("<challenge> <hint> [cost] <text>")
+		}
+		hint := Hint{Name: args[1], Text: strings.Join(args[2:], " ")}
+		if cost, err := strconv.Atoi(args[2]); err == nil && len(args) > 3 && cost >= 0 {
+			hint.Cost = &cost
+			hint.Text = strings.Join(args[3:], " ")
+		}
+		k, err := editChallenge(args[0], func(config *CTFConfig, k string) error {
+			ctf := config.CTFFlags[k]
+			if ctf.Hints.Find(hint.Name) >= 0 {
+				return fmt.Errorf("%s already has a hint %s", k, hint.Name)
+			}
+			ctf.Hints = append(ctf.Hints, hint)
+			if err := ctf.Validate(); err != nil {
+				return err
+			}
+			config.CTFFlags[k] = ctf
+			return nil
+		})
+		return done(err, fmt.Sprintf("Added hint %s to %s for %d points", hint.Name, k, hint.Points()))
+	case "award", "revoke":
+		if len(args) < 2 {
+			return usage("<nick> <challenge>")
+		}
+		if ctfconfig == nil {
+			return []string{"There is no CTF running on " + server}
+		}
+		user, name := args[0], args[1]
+		if k, ok := findChallenge(ctfconfig, name); ok {
+			name = k
+		}
+		if subcommand == "award" {
+			return done(AwardSolve(server, ctfconfig, name, user), fmt.Sprintf("Awarded %s to %s", name, user))
+		}
+		return done(RevokeSolve(server, ctfconfig, name, user), fmt.Sprintf("Revoked %s's solve of %s", user, name))
+	case "reset":
+		if len(args) < 1 {
+			return usage("<nick>")
+		}
+		return done(ResetCTFUser(server, args[0]), "Reset the CTF progress of "+args[0])
+	case "announce":
+		if len(args) < 1 {
+			return usage("<message>")
+		}
+		if ctfconfig == nil {
+			return []string{"There is no CTF running on " + server}
+		}
+		channels := ctfconfig.eventChannels()
+		for _, channel := range channels {
+			send_irc_priority(server, channel, "📢 "+strings.Join(args, " "), PriorityHigh)
+		}
+		return done(nil, "Announced in "+cmp.Or(strings.Join(channels, ", "), "no channel"))
+	}
+	return []string{ctfAdminUsage}
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "ctf",
+		Syntax:      "<reload|show|add|edit|disable|enable|flag|hint|award|revoke|reset|announce> ...",
+		Description: "Change the CTF challenges, award, revoke or reset solves and make announcements",
+		Category:    "CTF Challenge",
+		Private:     true,
+		Role:        RoleAdmin,
+		Handler: func(ctx *CommandContext) {
+			for _, line := range CTFAdmin(ctx.Settings, ctx.User, ctx.Args) {
+				send_irc_priority(ctx.Settings.Name, ctx.User, line, PriorityLow)
+			}
+		},
+	})
+}
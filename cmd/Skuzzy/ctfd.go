@@ -0,0 +1,504 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Import of CTFd challenge exports into ctf.yaml, and export of the
+ * scoreboard in the JSON CTFd's scoreboard API returns.
+ */
+
+/* The tables of a CTFd export, db/<table>.json in the zip. */
+type ctfdTable[T any] struct {
+	Results []T `json:"results"`
+}
+
+type ctfdChallenge struct {
+	ID           int             `json:"id"`
+	Name         string          `json:"name"`
+	Description  string          `json:"description"`
+	Category     string          `json:"category"`
+	Value        int             `json:"value"`
+	Type         string          `json:"type"`
+	State        string          `json:"state"`
+	Requirements json.RawMessage `json:"requirements"`
+	Initial      int             `json:"initial"`
+	Minimum      int             `json:"minimum"`
+	Decay        int             `json:"decay"`
+}
+
+/* Older CTFd versions keep dynamic values in their own table. */
+type ctfdDynamic struct {
+	ID      int `json:"id"`
+	Initial int `json:"initial"`
+	Minimum int `json:"minimum"`
+	Decay   int `json:"decay"`
+}
+
+type ctfdFlag struct {
+	ChallengeID int    `json:"challenge_id"`
+	Type        string `json:"type"`
+	Content     string `json:"content"`
+	Data        string `json:"data"`
+}
+
+type ctfdHint struct {
+	ID           int             `json:"id"`
+	ChallengeID  int             `json:"challenge_id"`
+	Content      string          `json:"content"`
+	Cost         int             `json:"cost"`
+	Requirements json.RawMessage `json:"requirements"` /* Other hints to unlock first, like challenges'. */
+}
+
+/* Reads the tables of a CTFd export from a zip, or the directory a challenges.json is in. */
+type ctfdExport struct {
+	read func(table string) ([]byte, error)
+}
+
+func openCTFdExport(path string) (*ctfdExport, func(), error) {
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ctfdExport{read: func(table string) ([]byte, error) {
+			for _, f := range archive.File {
+				if f.Name == "db/"+table+".json" || f.Name == table+".json" {
+					r, err := f.Open()
+					if err != nil {
+						return nil, err
+					}
+					defer r.Close()
+					return io.ReadAll(r)
+				}
+			}
+			return nil, os.ErrNotExist
+		}}, func() { archive.Close() }, nil
+	}
+	dir := filepath.Dir(path)
+	return &ctfdExport{read: func(table string) ([]byte, error) {
+		if table == "challenges" {
+			return os.ReadFile(path)
+		}
+		return os.ReadFile(filepath.Join(dir, table+".json"))
+	}}, func() {}, nil
+}
+
+/* Decode a table, either {"results": [...]} or a plain list. Missing optional tables are empty. */
+func readCTFdTable[T any](export *ctfdExport, table string, required bool) ([]T, error) {
+	data, err := export.read(table)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read %s: %w", table, err)
+	}
+	var rows ctfdTable[T]
+	if err := json.Unmarshal(data, &rows); err == nil && rows.Results != nil {
+		return rows.Results, nil
+	}
+	var list []T
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", table, err)
+	}
+	return list, nil
+}
+
+/* CTFd stores requirements as an object, or a JSON string of one. */
+func ctfdPrerequisites(raw json.RawMessage) []int {
+	var requirements struct {
+		Prerequisites []int `json:"prerequisites"`
+	}
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil {
+		raw = json.RawMessage(encoded)
+	}
+	json.Unmarshal(raw, &requirements)
+	return requirements.Prerequisites
+}
+
+var rChallengeName = regexp.MustCompile(`[^a-z0-9_\-]+`)
+
+/* Challenge names are commands and the first word of targeted submissions, so no spaces. */
+func challengeKey(name string, id int) string {
+	key := strings.Trim(rChallengeName.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if key == "" {
+		key = fmt.Sprintf("challenge%d", id)
+	}
+	return key
+}
+
+type CTFdImportOptions struct {
+	Channel string
+	Hash    bool /* Store flag_hash instead of the plaintext flag where possible. */
+	Hidden  bool /* Import hidden challenges too. */
+}
+
+/* Turn a CTFd export into challenges for ctf.yaml. */
+func ImportCTFd(path string, options CTFdImportOptions) (*CTFConfig, error) {
+	export, closeExport, err := openCTFdExport(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeExport()
+	challenges, err := readCTFdTable[ctfdChallenge](export, "challenges", true)
+	if err != nil {
+		return nil, err
+	}
+	dynamics, err := readCTFdTable[ctfdDynamic](export, "dynamic_challenge", false)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := readCTFdTable[ctfdFlag](export, "flags", false)
+	if err != nil {
+		return nil, err
+	}
+	hints, err := readCTFdTable[ctfdHint](export, "hints", false)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &CTFConfig{CTFFlags: make(map[string]CTF)}
+	keys := make(map[int]string)
+	for _, c := range challenges {
+		if c.State == "hidden" && !options.Hidden {
+			log.Printf("[ImportCTFd] Skipping hidden challenge %s\n", c.Name)
+			continue
+		}
+		key := challengeKey(c.Name, c.ID)
+		if _, taken := config.CTFFlags[key]; taken {
+			key = fmt.Sprintf("%s_%d", key, c.ID)
+		}
+		keys[c.ID] = key
+		ctf := CTF{
+			Channel:     options.Channel,
+			Description: c.Description,
+			Category:    c.Category,
+			Points:      c.Value,
+		}
+		if c.Type == "dynamic" {
+			for _, d := range dynamics {
+				if d.ID == c.ID {
+					c.Initial, c.Minimum, c.Decay = d.Initial, d.Minimum, d.Decay
+				}
+			}
+			ctf.Points, ctf.MinPoints, ctf.Decay = c.Initial, c.Minimum, c.Decay
+		}
+		config.CTFFlags[key] = ctf
+	}
+
+	for _, c := range challenges {
+		key, ok := keys[c.ID]
+		if !ok {
+			continue
+		}
+		ctf := config.CTFFlags[key]
+		for _, id := range ctfdPrerequisites(c.Requirements) {
+			if required, ok := keys[id]; ok {
+				ctf.Requires = append(ctf.Requires, required)
+			}
+		}
+		if err := importCTFdFlags(&ctf, c.ID, flags, options.Hash); err != nil {
+			log.Printf("[ImportCTFd] Skipping %s: %v\n", c.Name, err)
+			delete(config.CTFFlags, key)
+			continue
+		}
+		/* CTFd hints are unlocked on their own unless they have requirements, never just in order. */
+		hintNames := make(map[int]string)
+		for _, h := range hints {
+			if h.ChallengeID != c.ID {
+				continue
+			}
+			cost := h.Cost
+			hint := Hint{Name: fmt.Sprintf("%s_hint%d", key, len(ctf.Hints)+1), Text: h.Content, Cost: &cost, Requires: []string{}}
+			for _, id := range ctfdPrerequisites(h.Requirements) {
+				if name, ok := hintNames[id]; ok {
+					hint.Requires = append(hint.Requires, name)
+				} else {
+					log.Printf("[ImportCTFd] Warning, dropping a requirement of %s on hint %d, which doesn't come before it\n", hint.Name, id)
+				}
+			}
+			hintNames[h.ID] = hint.Name
+			ctf.Hints = append(ctf.Hints, hint)
+		}
+		config.CTFFlags[key] = ctf
+	}
+	log.Printf("[ImportCTFd] Imported %d challenges from %s\n", len(config.CTFFlags), path)
+	return config, nil
+}
+
+/*
+ * CTFd challenges can have several flags, each static or regex and case-sensitive
+ * or not. The first static flag becomes flag (or flag_hash), the rest flag_regex.
+ * When hashing, other static flags are dropped rather than kept in the clear.
+ */
+func importCTFdFlags(ctf *CTF, id int, flags []ctfdFlag, hash bool) error {
+	var alternatives []string
+	insensitive := false
+	for _, f := range flags {
+		if f.ChallengeID != id {
+			continue
+		}
+		insensitive = insensitive || f.Data == "case_insensitive"
+		switch f.Type {
+		case "static", "":
+			if ctf.Flag == "" {
+				ctf.Flag = f.Content
+			} else if hash {
+				log.Printf("[ImportCTFd] Warning, dropping an extra static flag of challenge %d, only the first is hashed\n", id)
+			} else {
+				alternatives = append(alternatives, regexp.QuoteMeta(f.Content))
+			}
+		case "regex":
+			if _, err := regexp.Compile(f.Content); err != nil {
+				log.Printf("[ImportCTFd] Skipping a regex flag of challenge %d: %v\n", id, err)
+				continue
+			}
+			alternatives = append(alternatives, f.Content)
+		default:
+			log.Printf("[ImportCTFd] Skipping a %s flag of challenge %d\n", f.Type, id)
+		}
+	}
+	/* CTFd flags are case-sensitive unless marked otherwise, we only have one setting per challenge. */
+	ctf.CaseSensitive = !insensitive
+	if len(alternatives) > 0 {
+		ctf.FlagRegex = "(?:" + strings.Join(alternatives, ")|(?:") + ")"
+	}
+	if hash && ctf.Flag != "" {
+		h, err := HashFlag(ctf.Flag, ctf.CaseSensitive)
+		if err != nil {
+			return err
+		}
+		ctf.Flag, ctf.FlagHash = "", h
+	}
+	return ctf.Validate()
+}
+
+/* `Skuzzy importctfd -channel '#c' [-hash] [-hidden] [-o ctf.yaml] <export.zip|challenges.json>` */
+func importCTFdCommand(args []string) int {
+	flags := flag.NewFlagSet("importctfd", flag.ContinueOnError)
+	channel := flags.String("channel", "", "channel the challenges are played in")
+	hash := flags.Bool("hash", false, "store salted hashes of static flags instead of the flags")
+	hidden := flags.Bool("hidden", false, "import hidden challenges too")
+	output := flags.String("o", "", "write to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: Skuzzy importctfd -channel <channel> [-hash] [-hidden] [-o ctf.yaml] <export.zip|challenges.json>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *channel == "" {
+		flags.Usage()
+		return 2
+	}
+	config, err := ImportCTFd(flags.Arg(0), CTFdImportOptions{Channel: *channel, Hash: *hash, Hidden: *hidden})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output == "" {
+		os.Stdout.Write(out.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*output, out.Bytes(), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+/* The /api/v1/scoreboard response of CTFd. */
+type ctfdScoreboard struct {
+	Success bool                `json:"success"`
+	Data    []ctfdScoreboardRow `json:"data"`
+}
+
+type ctfdScoreboardRow struct {
+	Pos         int          `json:"pos"`
+	AccountID   int          `json:"account_id"`
+	AccountURL  string       `json:"account_url"`
+	AccountType string       `json:"account_type"`
+	OauthID     *int         `json:"oauth_id"`
+	Name        string       `json:"name"`
+	Score       int          `json:"score"`
+	BracketID   *int         `json:"bracket_id"`
+	BracketName *string      `json:"bracket_name"`
+	Members     []ctfdMember `json:"members"`
+	Solves      []ctfdSolve  `json:"solves,omitempty"`
+}
+
+type ctfdMember struct {
+	ID      int    `json:"id"`
+	OauthID *int   `json:"oauth_id"`
+	Name    string `json:"name"`
+	Score   int    `json:"score"`
+}
+
+/* A solve, as in /api/v1/scoreboard/top/<count>. */
+type ctfdSolve struct {
+	ChallengeID int    `json:"challenge_id"`
+	AccountID   int    `json:"account_id"`
+	TeamID      *int   `json:"team_id"`
+	UserID      int    `json:"user_id"`
+	Value       int    `json:"value"`
+	Date        string `json:"date"`
+}
+
+/*
+ * A channel's scoreboard as CTFd JSON, of players or of teams. IRC users have
+ * no ids, so players and challenges are numbered by name.
+ */
+func ExportCTFdScoreboard(server, channel string, config *CTFConfig, teams bool, withSolves bool) ([]byte, error) {
+	var standings []CTFStanding
+	accountType := "user"
+	if teams {
+		standings = CTFTeamScores(server, channel, config, 0)
+		accountType = "team"
+	} else {
+		standings = CTFScores(server, channel, config, 0)
+	}
+
+	var challengeNames []string
+	for name := range config.CTFFlags {
+		challengeNames = append(challengeNames, name)
+	}
+	slices.Sort(challengeNames)
+	var userNames []string
+	userPoints := make(map[string]int)
+	for _, s := range CTFScores(server, channel, config, 0) {
+		userNames = append(userNames, s.User)
+		userPoints[s.User] = s.Points
+	}
+	slices.Sort(userNames)
+	userID := func(user string) int { return slices.Index(userNames, user) + 1 }
+
+	solves := ctfSolvesOf(server, channel)
+	counts := CTFSolveCounts(server)
+	scoreboard := ctfdScoreboard{Success: true}
+	for i, s := range standings {
+		row := ctfdScoreboardRow{Pos: i + 1, AccountType: accountType, Name: s.User, Score: s.Points, Members: []ctfdMember{}}
+		var team CTFTeam
+		if teams {
+			team = teamByName(server, s.User)
+			row.AccountID = int(team.ID)
+			row.AccountURL = fmt.Sprintf("/teams/%d", team.ID)
+			for _, member := range TeamMembers(server, team) {
+				row.Members = append(row.Members, ctfdMember{ID: userID(member), Name: member, Score: userPoints[member]})
+			}
+		} else {
+			row.AccountID = userID(s.User)
+			row.AccountURL = fmt.Sprintf("/users/%d", row.AccountID)
+		}
+		if withSolves {
+			row.Solves = []ctfdSolve{}
+			for _, solve := range solves {
+				ctf, ok := config.CTFFlags[solve.challenge]
+				if !ok || (teams && solve.team != team.ID) || (!teams && solve.user != s.User) {
+					continue
+				}
+				exported := ctfdSolve{
+					ChallengeID: slices.Index(challengeNames, solve.challenge) + 1,
+					AccountID:   row.AccountID,
+					UserID:      userID(solve.user),
+					Value:       ctf.Value(counts[solve.challenge]-1) + solve.firstBlood,
+					Date:        time.Unix(solve.solved, 0).UTC().Format(time.RFC3339),
+				}
+				if teams {
+					id := int(team.ID)
+					exported.TeamID = &id
+				}
+				row.Solves = append(row.Solves, exported)
+			}
+		}
+		scoreboard.Data = append(scoreboard.Data, row)
+	}
+	if scoreboard.Data == nil {
+		scoreboard.Data = []ctfdScoreboardRow{}
+	}
+	return json.MarshalIndent(scoreboard, "", "  ")
+}
+
+type ctfSolveRow struct {
+	challenge, user string
+	team            int64
+	firstBlood      int
+	solved          int64
+}
+
+func ctfSolvesOf(server, channel string) []ctfSolveRow {
+	rows, err := DB.Query("SELECT challenge, user, team_id, first_blood, solved FROM ctf_solves WHERE server = ? AND channel = ? ORDER BY solved",
+		strings.ToLower(server), strings.ToLower(channel))
+	if err != nil {
+		log.Printf("[ctfSolvesOf] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var solves []ctfSolveRow
+	for rows.Next() {
+		var s ctfSolveRow
+		if rows.Scan(&s.challenge, &s.user, &s.team, &s.firstBlood, &s.solved) == nil {
+			solves = append(solves, s)
+		}
+	}
+	return solves
+}
+
+func teamByName(server, name string) CTFTeam {
+	var team CTFTeam
+	DB.QueryRow("SELECT id, name, invite_code FROM ctf_teams WHERE server = ? AND name = ?",
+		strings.ToLower(server), name).Scan(&team.ID, &team.Name, &team.InviteCode)
+	return team
+}
+
+/* `Skuzzy exportctfd [-db skuzzy.db] [-teams] [-solves] <ctf.yaml> <server> <channel>` */
+func exportCTFdCommand(args []string) int {
+	flags := flag.NewFlagSet("exportctfd", flag.ContinueOnError)
+	dbPath := flags.String("db", "skuzzy.db", "the bot's database")
+	teams := flags.Bool("teams", false, "export the team scoreboard")
+	withSolves := flags.Bool("solves", false, "include every solve, like /api/v1/scoreboard/top")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: Skuzzy exportctfd [-db skuzzy.db] [-teams] [-solves] <ctf.yaml> <server> <channel>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		flags.Usage()
+		return 2
+	}
+	log.SetOutput(io.Discard)
+	config, err := LoadCTFConfig(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := InitDB(*dbPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out, err := ExportCTFdScoreboard(flags.Arg(1), flags.Arg(2), config, *teams, *withSolves)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"math"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -34,6 +36,27 @@ func InitDB(filepath string) error {
 		return fmt.Errorf("failed to create regex_challenge_scores table: %w", err)
 	}
 
+	/* Every regex challenge posted, with how it went, for adaptive difficulty. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS regex_challenge_rounds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		regex TEXT NOT NULL,
+		tier TEXT NOT NULL,
+		difficulty INTEGER NOT NULL,
+		posted INTEGER NOT NULL,
+		solved INTEGER NOT NULL DEFAULT 0,
+		solver TEXT NOT NULL DEFAULT '',
+		misses INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS regex_challenge_rounds_channel ON regex_challenge_rounds (server, channel);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create regex_challenge_rounds table: %w", err)
+	}
+
 	/* CTF */
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS ctf_scores (
@@ -49,6 +72,67 @@ func InitDB(filepath string) error {
 		return fmt.Errorf("failed to create ctf_scores table: %w", err)
 	}
 
+	/* One row per challenge a user solved. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ctf_solves (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		challenge TEXT NOT NULL,
+		user TEXT NOT NULL,
+		account TEXT NOT NULL,
+		team_id INTEGER NOT NULL DEFAULT 0,
+		first_blood INTEGER NOT NULL DEFAULT 0,
+		solved INTEGER NOT NULL,
+		UNIQUE (server, challenge, user)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ctf_solves table: %w", err)
+	}
+
+	/* CTF teams and who's in them, a user is in one team at most. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ctf_teams (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		name TEXT NOT NULL COLLATE NOCASE,
+		invite_code TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		UNIQUE (server, name)
+		);
+		CREATE TABLE IF NOT EXISTS ctf_team_members (
+		server TEXT NOT NULL,
+		user TEXT NOT NULL,
+		team_id INTEGER NOT NULL,
+		joined INTEGER NOT NULL,
+		PRIMARY KEY (server, user)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ctf team tables: %w", err)
+	}
+
+	/* Hints taken, charged once per user and once per team. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ctf_hint_unlocks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		challenge TEXT NOT NULL,
+		hint TEXT NOT NULL,
+		user TEXT NOT NULL,
+		team_id INTEGER NOT NULL DEFAULT 0,
+		cost INTEGER NOT NULL,
+		taken INTEGER NOT NULL,
+		UNIQUE (server, challenge, hint, user)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ctf_hint_unlocks table: %w", err)
+	}
+
 	/* Reminders. */
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS reminders (
@@ -78,6 +162,175 @@ func InitDB(filepath string) error {
 		return fmt.Errorf("Failed to create prefs table: %w", err)
 	}
 
+	/* LLM conversation history. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		user TEXT NOT NULL,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create conversations table: %w", err)
+	}
+
+	/* Roles granted to accounts and hostmasks. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS permissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		mask TEXT NOT NULL,
+		role INTEGER NOT NULL,
+		added_by TEXT NOT NULL,
+		created INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create permissions table: %w", err)
+	}
+
+	/* Uses of privileged commands. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS command_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		user TEXT NOT NULL,
+		account TEXT NOT NULL,
+		command TEXT NOT NULL,
+		args TEXT NOT NULL,
+		allowed INTEGER NOT NULL,
+		created INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create command_audit table: %w", err)
+	}
+
+	/* Moderation actions. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS moderation_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		mask TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		duration INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create moderation_log table: %w", err)
+	}
+
+	/* Timed bans and quiets waiting to be lifted. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS mod_expiries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		mask TEXT NOT NULL,
+		action TEXT NOT NULL,
+		end_time INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create mod_expiries table: %w", err)
+	}
+
+	/* LLM moderation results waiting for, or given, an op's review. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS moderation_reviews (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		nick TEXT NOT NULL,
+		mask TEXT NOT NULL,
+		message TEXT NOT NULL,
+		category TEXT NOT NULL,
+		confidence REAL NOT NULL,
+		reason TEXT NOT NULL,
+		action TEXT NOT NULL,
+		status TEXT NOT NULL,
+		reviewed_by TEXT NOT NULL,
+		created INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create moderation_reviews table: %w", err)
+	}
+
+	/* Every flag submitted, right or wrong, for auditing and throttling. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ctf_submissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		user TEXT NOT NULL,
+		account TEXT NOT NULL,
+		challenge TEXT NOT NULL,
+		guess_hash TEXT NOT NULL,
+		result TEXT NOT NULL,
+		submitted INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS ctf_submissions_actor ON ctf_submissions (server, actor, submitted);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ctf_submissions table: %w", err)
+	}
+	/* Correct answers used to be plain SHA-256 prefixes of the flag, drop them. */
+	_, err = db.Exec("UPDATE ctf_submissions SET guess_hash = '' WHERE result = 'correct' AND length(guess_hash) = 16")
+	if err != nil {
+		return fmt.Errorf("failed to clear old ctf_submissions hashes: %w", err)
+	}
+
+	/* Submitters locked out after too many attempts, challenge '*' for all of them. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ctf_lockouts (
+		server TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		challenge TEXT NOT NULL,
+		until INTEGER NOT NULL,
+		PRIMARY KEY (server, actor, challenge)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ctf_lockouts table: %w", err)
+	}
+
+	/* Players queued for review after the topic challenge, with when each step happened. */
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS onboarding (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		server TEXT NOT NULL,
+		user TEXT NOT NULL,
+		account TEXT NOT NULL DEFAULT '',
+		challenge TEXT NOT NULL,
+		status TEXT NOT NULL,
+		reviewer TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		queued INTEGER NOT NULL,
+		notified INTEGER NOT NULL DEFAULT 0,
+		reviewed INTEGER NOT NULL DEFAULT 0,
+		voiced INTEGER NOT NULL DEFAULT 0,
+		access_added INTEGER NOT NULL DEFAULT 0,
+		cloak_requested INTEGER NOT NULL DEFAULT 0,
+		role_granted INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (server, user)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create onboarding table: %w", err)
+	}
+
 	DB = db
 	log.Println("Database init success.")
 	return nil
@@ -222,132 +475,137 @@ func GetPreference(server, channel, user, preference string) string {
 	return result
 }
 
-func CTFSolved(settings *ServerConfig, ctfname string, ctf CTF, user string) {
+/*
+ * Record that user solved a challenge. Fails if they already did or haven't
+ * solved its prerequisites yet.
+ */
+func CTFSolved(settings *ServerConfig, config *CTFConfig, ctfname string, ctf CTF, user, account string) (CTFSolve, error) {
 	channel := strings.ToLower(ctf.Channel)
 	server := strings.ToLower(settings.Name)
 	user = strings.ToLower(user)
 
-	_id := server + "/" + channel + "/" + user
 	if !CleanUser.MatchString(user) {
-		log.Printf("[CTFSolved] Warning, unable to update CTF level for user %s, bad characters in the user name\n", user)
+		log.Printf("[CTFSolved] Warning, unable to update CTF solves for user %s, bad characters in the user name\n", user)
+		return CTFSolve{}, fmt.Errorf("bad characters in your nick")
 	}
-	var level int
-	var hints int
-	err := DB.QueryRow("SELECT level,hints FROM ctf_scores WHERE id = ?", _id).Scan(&level, &hints)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("[CTFSolved] No user found with ID %s\n", user)
-		} else {
-			log.Printf("[CTFSolved] Warning, unexpected error when searching for user in db:%v\n", err)
-			return
+	solved := CTFUserSolves(server, user)
+	team, err := CTFUserTeam(server, user)
+	if err == nil {
+		/* Teammates' solves count as the user's own. */
+		for name := range CTFTeamSolves(server, team) {
+			solved[name] = true
 		}
+	} else if err != ErrNoTeam {
+		log.Printf("[CTFSolved] Warning, unable to look up %s's team:%v\n", user, err)
 	}
-	log.Printf("Level to update:%d/%d\n", ctf.Level, level)
-	if level != (ctf.Level - 1) {
-		log.Printf("[CTFSolved] %s is at level %v which is not the level right before the currently solved level:%v\n", user, level, ctf.Level)
-		return
-	}
-
-	statement, err := DB.Prepare("INSERT OR REPLACE INTO ctf_scores (id,user, level,hints, last_attempt) VALUES (?,?, ?, ?, ?)")
-	if err != nil {
-		log.Printf("[CTFSolved] Error, unable to prepare statement for updating %s's level:%v\n", user, err)
-		return
-	}
-	defer statement.Close()
-
-	_, err = statement.Exec(_id, user, ctf.Level, hints, int(time.Now().Unix()))
-	if err != nil {
-		log.Printf("[CTFSolved] Error, unable to Execute statement for updating %s's level:%v\n", user, err)
-		return
+	if solved[ctfname] {
+		return CTFSolve{}, ErrAlreadySolved
 	}
-	log.Printf("[CTFSolved] Updated %s's level with %d\n", user, ctf.Level)
-}
-
-func CTFHintTaken(settings *ServerConfig, ctf CTF, user string) {
-	channel := strings.ToLower(ctf.Channel)
-	server := strings.ToLower(settings.Name)
-	user = strings.ToLower(user)
-
-	_id := server + "/" + channel + "/" + user
-	if !CleanUser.MatchString(user) {
-		log.Printf("[CTFHintTaken] Warning, unable to update CTF level for user %s, bad characters in the user name\n", user)
-	}
-	var hints int
-	var level int
-	err := DB.QueryRow("SELECT hints,level FROM ctf_scores WHERE id = ?", _id).Scan(&hints, &level)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("[CTFHintTaken] No user found with ID %s\n", user)
-		} else {
-			log.Printf("[CTFHintTaken] Warning, unexpected error when searching for user in db:%v\n", err)
-			return
+	var missing []string
+	for _, name := range config.Prerequisites(ctfname) {
+		if !solved[name] {
+			missing = append(missing, name)
 		}
 	}
-	log.Printf("hints to update:%d\n", hints)
-	if level/hints > level*3 {
-		log.Printf("[CTFHintTaken] Max hints for user level reached already, not penalizing.")
-		return
+	if len(missing) > 0 {
+		log.Printf("[CTFSolved] %s hasn't solved %v, needed for %s\n", user, missing, ctfname)
+		return CTFSolve{}, fmt.Errorf("solve %s first", strings.Join(missing, ", "))
 	}
-	hints += 1
 
-	statement, err := DB.Prepare("INSERT OR REPLACE INTO ctf_scores (id,user, hints) VALUES (?,?, ?)")
+	solve := CTFSolve{Solves: CTFSolveCounts(server)[ctfname]}
+	solve.Points = ctf.Value(solve.Solves)
+	if solve.Solves == 0 {
+		solve.FirstBlood = config.FirstBloodFor(ctf)
+	}
+	_, err = DB.Exec("INSERT INTO ctf_solves (server, channel, challenge, user, account, team_id, first_blood, solved) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		server, channel, ctfname, user, account, team.ID, solve.FirstBlood, time.Now().Unix())
 	if err != nil {
-		log.Printf("[CTFHintTaken] Error, unable to prepare statement for updating %s's hints:%v\n", user, err)
-		return
+		log.Printf("[CTFSolved] Error, unable to record %s's solve of %s:%v\n", user, ctfname, err)
+		return CTFSolve{}, fmt.Errorf("unable to record the solve")
 	}
-	defer statement.Close()
 
-	_, err = statement.Exec(_id, user, hints)
+	/* Keep the highest level for anything still reading ctf_scores. */
+	_id := server + "/" + channel + "/" + user
+	_, err = DB.Exec("INSERT INTO ctf_scores (id, user, level, last_attempt) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT(id) DO UPDATE SET level = MAX(level, excluded.level), last_attempt = excluded.last_attempt",
+		_id, user, ctf.Level, int(time.Now().Unix()))
 	if err != nil {
-		log.Printf("[CTFHintTaken] Error, unable to Execute statement for updating %s's hints:%v\n", user, err)
-		return
+		log.Printf("[CTFSolved] Error, unable to update %s's level:%v\n", user, err)
 	}
-	log.Printf("[CTFHintTaken] Updated %s's hints with %d\n", user, hints)
+	log.Printf("[CTFSolved] %s solved %s for %d points (+%d first blood)\n", user, ctfname, solve.Points, solve.FirstBlood)
+	QueueOnboarding(settings, config, ctfname, user, account)
+	return solve, nil
 }
 
-func CTFScores(server string, channel string) map[string]string {
+/*
+ * The scoreboard of a channel's challenges, best first. Solves are worth what
+ * the challenge is worth now, so decaying values apply to earlier solvers too.
+ * Only solves up to until count, unless it's 0.
+ */
+func CTFScores(server string, channel string, config *CTFConfig, until int64) []CTFStanding {
 	channel = strings.ToLower(channel)
 	server = strings.ToLower(server)
 
-	var scores = make(map[string]string)
-	id := fmt.Sprintf("%s/%s/", server, channel)
-	id = id + "%"
-	rows, err := DB.Query("SELECT user, level, hints, last_attempt FROM ctf_scores WHERE id LIKE ?", id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("[CTFScores] No rows in the ctf  scores table")
-			return scores
-		} else {
-			log.Printf("[CTFScores] Warning, unexpected error when searching for ctf scores:%v\n", err)
-			return scores
+	standings := make(map[string]*CTFStanding)
+	standing := func(user string) *CTFStanding {
+		if _, ok := standings[user]; !ok {
+			standings[user] = &CTFStanding{User: user}
 		}
+		return standings[user]
+	}
+	counts := ctfSolveCountsUntil(server, until)
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	rows, err := DB.Query("SELECT user, challenge, first_blood, solved FROM ctf_solves WHERE server = ? AND channel = ? AND solved <= ?",
+		server, channel, until)
+	if err != nil {
+		log.Printf("[CTFScores] Warning, unexpected error when searching for ctf solves:%v\n", err)
+		return nil
 	}
-	defer rows.Close()
-
-	var user string
-	var level int
-	var hints int
-	var last_attempt int
-
 	for rows.Next() {
-		err := rows.Scan(&user, &level, &hints, &last_attempt)
-		if err != nil {
+		var user, challenge string
+		var firstBlood int
+		var solved int64
+		if err := rows.Scan(&user, &challenge, &firstBlood, &solved); err != nil {
 			log.Printf("[CTFScores] Error reading row:%v\n", err)
 			break
 		}
-
-		/*
-			Let's do something with last attempt in the future, leaving this uncommented for now.
-			now := int(time.Now().Unix()) - last_attempt
-			if now > oldest {
-				log.Printf("[CTFScores] Skipping user/score %s/%d, because %d is more than %s seconds old\n", user, score, last_attempt, oldest)
-				continue
-			}*/
-		points := (level * 100) - (hints * 10)
-		scores[user] = fmt.Sprintf("%d (Level %d)", points, level)
+		ctf, ok := config.CTFFlags[challenge]
+		if !ok {
+			/* Removed from the configuration. */
+			continue
+		}
+		s := standing(user)
+		s.Points += ctf.Value(counts[challenge]-1) + firstBlood
+		s.Solves++
+		s.FirstBloods += min(firstBlood, 1)
+		s.LastSolve = max(s.LastSolve, solved)
 	}
+	rows.Close()
 
-	return scores
+	/* Hints counted in ctf_scores from before ctf_hint_unlocks cost a flat penalty. */
+	id := fmt.Sprintf("%s/%s/", server, channel) + "%"
+	rows, err = DB.Query("SELECT user, hints, hints * ? FROM ctf_scores WHERE id LIKE ? AND hints > 0 "+
+		"UNION ALL SELECT user, COUNT(*), SUM(cost) FROM ctf_hint_unlocks WHERE server = ? AND channel = ? AND taken <= ? GROUP BY user HAVING SUM(cost) > 0",
+		ctfHintPenalty, id, server, channel, until)
+	if err != nil {
+		log.Printf("[CTFScores] Warning, unexpected error when searching for ctf hints:%v\n", err)
+	} else {
+		for rows.Next() {
+			var user string
+			var hints, cost int
+			if err := rows.Scan(&user, &hints, &cost); err != nil {
+				log.Printf("[CTFScores] Error reading row:%v\n", err)
+				break
+			}
+			s := standing(user)
+			s.Hints += hints
+			s.Points -= cost
+		}
+		rows.Close()
+	}
+	return SortStandings(standings)
 }
 
 func CTFUserLevel(server string, channel string, user string) int {
@@ -368,3 +626,79 @@ func CTFUserLevel(server string, channel string, user string) int {
 	}
 	return level
 }
+
+/* One stored message of an LLM conversation. */
+type ConversationTurn struct {
+	Role    string
+	Content string
+}
+
+/* Turns kept per server/channel/user; older ones are pruned on insert. */
+var maxConversationTurns = 50
+
+func AddConversationTurn(server, channel, user, role, content string) {
+	channel = strings.ToLower(channel)
+	user = strings.ToLower(user)
+	_, err := DB.Exec("INSERT INTO conversations (server, channel, user, role, content, created) VALUES (?, ?, ?, ?, ?, ?)",
+		server, channel, user, role, content, time.Now().Unix())
+	if err != nil {
+		log.Printf("[AddConversationTurn] Error, unable to store %s's conversation turn:%v\n", user, err)
+		return
+	}
+	_, err = DB.Exec(`DELETE FROM conversations WHERE server = ? AND channel = ? AND user = ? AND id NOT IN
+		(SELECT id FROM conversations WHERE server = ? AND channel = ? AND user = ? ORDER BY id DESC LIMIT ?)`,
+		server, channel, user, server, channel, user, maxConversationTurns)
+	if err != nil {
+		log.Printf("[AddConversationTurn] Error, unable to prune %s's conversation:%v\n", user, err)
+	}
+}
+
+/* Most recent turns, oldest first, that fit within the token budget. */
+func ConversationHistory(server, channel, user string, budget int) []ConversationTurn {
+	channel = strings.ToLower(channel)
+	user = strings.ToLower(user)
+	var history []ConversationTurn
+	rows, err := DB.Query("SELECT role, content FROM conversations WHERE server = ? AND channel = ? AND user = ? ORDER BY id DESC",
+		server, channel, user)
+	if err != nil {
+		log.Printf("[ConversationHistory] Warning, unexpected error when searching for %s's conversation:%v\n", user, err)
+		return history
+	}
+	defer rows.Close()
+
+	used := 0
+	for rows.Next() {
+		var turn ConversationTurn
+		if err := rows.Scan(&turn.Role, &turn.Content); err != nil {
+			log.Printf("[ConversationHistory] Error reading row:%v\n", err)
+			break
+		}
+		used += EstimateTokens(turn.Content)
+		if used > budget {
+			break
+		}
+		history = append(history, turn)
+	}
+	/* Rows come newest first, the LLM wants them in order. */
+	slices.Reverse(history)
+	/* Don't start the history with a dangling assistant reply. */
+	if len(history) > 0 && history[0].Role != "user" {
+		history = history[1:]
+	}
+	return history
+}
+
+func ResetConversation(server, channel, user string) {
+	channel = strings.ToLower(channel)
+	user = strings.ToLower(user)
+	if _, err := DB.Exec("DELETE FROM conversations WHERE server = ? AND channel = ? AND user = ?", server, channel, user); err != nil {
+		log.Printf("[ResetConversation] Error, unable to delete %s's conversation:%v\n", user, err)
+		return
+	}
+	log.Printf("[ResetConversation] Reset %s's conversation in %s/%s\n", user, server, channel)
+}
+
+/* Rough token count, about four characters per token for English text. */
+func EstimateTokens(text string) int {
+	return len(text)/4 + 1
+}
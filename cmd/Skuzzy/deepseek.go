@@ -28,25 +28,61 @@ type DeepseekRequest struct {
 	PromptName    string
 	OriginalQuery string /* Store orig query for re-processing if needed. */
 	User          string /* Going to need the user who sent the message too. */
+	LLM           string /* Name of the `llms:` entry to use, defaults to the channel's LLM. */
 }
 
-var DeepseekQueue = make(chan DeepseekRequest)
+/*
+ * One request queue per server: the worker consuming it owns that server's
+ * settings, API keys and connection, so replies go back to the network that asked.
+ */
+var DeepseekQueues = make(map[string]chan DeepseekRequest)
+var DeepseekQueuesMutex = sync.Mutex{}
 
-func Deepseek(settings *ServerConfig, llm LLM) {
-	model := ""
-	switch llm.Model {
+/* The LLM request queue for a server, created on first use. */
+func DeepseekQueue(server string) chan DeepseekRequest {
+	DeepseekQueuesMutex.Lock()
+	defer DeepseekQueuesMutex.Unlock()
+	queue, ok := DeepseekQueues[server]
+	if !ok {
+		queue = make(chan DeepseekRequest)
+		DeepseekQueues[server] = queue
+	}
+	return queue
+}
 
-	case "deepseekchat":
-		model = deepseek.DeepSeekChat
-	default:
-		log.Printf("[Deepseek] Error, usupported deepseek model %s\n", llm.Model)
+/* Consumes the server's DeepseekQueue and answers each request with the provider named by req.LLM. */
+func LLMWorker(settings *ServerConfig) {
+	providers := make(map[string]LLMProvider)
+	for _, llm := range settings.LLMS {
+		provider, err := NewLLMProvider(settings, llm)
+		if err != nil {
+			log.Printf("[LLMWorker] Error, unable to set up LLM %s: %v\n", llm.Name, err)
+			continue
+		}
+		log.Printf("[LLMWorker] Using %s LLM %s (%s)\n", llm.Type, llm.Name, llm.Model)
+		providers[strings.ToLower(llm.Name)] = provider
 	}
-	client := deepseek.NewClient(settings.DeepseekAPIKey)
 	for {
-		req := <-DeepseekQueue
-		log.Printf("[Deepseek]  Deepseek processing query [%s]: %v\n", llm.Name, req)
+		req := <-DeepseekQueue(settings.Name)
+		if req.Server != settings.Name {
+			log.Printf("[LLMWorker] Warning, %s worker received a request for %s: %v\n", settings.Name, req.Server, req)
+			continue
+		}
+		name := req.LLM
+		if name == "" {
+			name = ChannelLLM(settings, req.Channel)
+		}
+		provider, ok := providers[strings.ToLower(name)]
+		if !ok {
+			log.Printf("[LLMWorker] Error, no LLM named '%s' for query: %v\n", name, req)
+			if strings.EqualFold(req.OriginalQuery, "regex\nchallenge") {
+				go GeneratedRegexChallenge(req.Server, req.Channel)
+			}
+			continue
+		}
+		log.Printf("[LLMWorker] Processing query [%s]: %v\n", name, req)
 		if req.reload {
-			log.Printf("[Deepseek]  Reloading sys prompts\n")
+			log.Printf("[LLMWorker] Reloading sys prompts\n")
 			LoadSysPrompts(settings)
 		}
 
@@ -58,42 +94,72 @@ func Deepseek(settings *ServerConfig, llm LLM) {
 			currentSysPrompt = settings.SysPrompts["reminder_parse"]
 		case "reminder_change_parse":
 			currentSysPrompt = settings.SysPrompts["reminder_change_parse"]
+		case "moderation_classify":
+			currentSysPrompt = settings.SysPrompts["moderation_classify"]
 		}
-		log.Printf("[Deepseek] System prompt:%s\n", currentSysPrompt)
-		request := &deepseek.ChatCompletionRequest{
-			Model: model,
-			Messages: []deepseek.ChatCompletionMessage{
-				{Role: deepseek.ChatMessageRoleSystem, Content: currentSysPrompt +
-					"." + settings.SysPromptGlobalPrefix},
-				{Role: deepseek.ChatMessageRoleUser, Content: req.request},
-			},
+		log.Printf("[LLMWorker] System prompt:%s\n", currentSysPrompt)
+
+		/* Only plain chats with a user are remembered, not reminders or regex challenges. */
+		remember := req.User != "" && req.PromptName == "" && !strings.EqualFold(req.OriginalQuery, "regex\nchallenge")
+		if remember && req.reset {
+			ResetConversation(req.Server, req.Channel, req.User)
+			if len(strings.TrimSpace(req.request)) < 1 {
+				send_irc(req.Server, req.Channel, req.User+", I've forgotten our conversation.")
+				continue
+			}
+		}
+
+		messages := []deepseek.ChatCompletionMessage{
+			{Role: deepseek.ChatMessageRoleSystem, Content: currentSysPrompt +
+				"." + settings.SysPromptGlobalPrefix},
+		}
+		if remember {
+			budget := ConversationBudget(settings) - EstimateTokens(messages[0].Content) - EstimateTokens(req.request)
+			for _, turn := range ConversationHistory(req.Server, req.Channel, req.User, budget) {
+				messages = append(messages, deepseek.ChatCompletionMessage{Role: turn.Role, Content: turn.Content})
+			}
 		}
+		messages = append(messages, deepseek.ChatCompletionMessage{Role: deepseek.ChatMessageRoleUser, Content: req.request})
 
 		ctx := context.Background()
-		response, err := client.CreateChatCompletion(ctx, request)
+		llm_response, err := provider.ChatCompletion(ctx, messages)
 		if err != nil {
-			log.Printf("[Deepseek] Deepseek chat completion request returned an error: %v", err)
+			log.Printf("[LLMWorker] %s chat completion request returned an error: %v", name, err)
+			if strings.EqualFold(req.OriginalQuery, "regex\nchallenge") {
+				/* The LLM is down, generate the challenge instead. */
+				go GeneratedRegexChallenge(req.Server, req.Channel)
+			}
 			continue
 		}
+		if remember {
+			AddConversationTurn(req.Server, req.Channel, req.User, deepseek.ChatMessageRoleUser, req.request)
+			AddConversationTurn(req.Server, req.Channel, req.User, deepseek.ChatMessageRoleAssistant, llm_response)
+		}
 
-		deepseek_response := response.Choices[0].Message.Content
 		if req.PromptName == "reminder_parse" || req.PromptName == "reminder_change_parse" {
-			ReminderParseQueue <- struct {
-				Result      string
-				OriginalReq DeepseekRequest
-			}{Result: deepseek_response, OriginalReq: req}
+			ReminderParseQueue(req.Server) <- ReminderParse{Result: llm_response, OriginalReq: req}
+		} else if req.PromptName == "moderation_classify" {
+			go HandleClassification(settings, req, llm_response)
 		} else if strings.EqualFold(req.OriginalQuery, "regex\nchallenge") {
-			log.Printf("[Deepseek] Regex challenge response:%s\n", deepseek_response)
-			go NewRegexChallenge(req, deepseek_response)
+			log.Printf("[LLMWorker] Regex challenge response:%s\n", llm_response)
+			go NewRegexChallenge(req, llm_response)
 
 		} else {
-			log.Printf("[Deepseek] Deepseek response:%s\n", deepseek_response)
-			send_irc(settings.Name, req.Channel, deepseek_response)
+			log.Printf("[LLMWorker] %s response:%s\n", name, llm_response)
+			send_irc_reply(req.Server, req.Channel, req.User, llm_response)
 		}
 	}
 }
 
-func FindPromptDeepseek(settings *ServerConfig, from_channel string, user string, query string) (string, string) {
+/* Token budget for a user's conversation history, including the system prompt and the new query. */
+func ConversationBudget(settings *ServerConfig) int {
+	if settings.ConversationBudget == 0 {
+		return 2000
+	}
+	return settings.ConversationBudget
+}
+
+func FindChannelPrompt(settings *ServerConfig, from_channel string, user string, query string) (string, string) {
 	prefix := settings.Name + "/" + from_channel
 	SysPromptsMutex.RLock()
 	prompt := ""
@@ -104,23 +170,23 @@ func FindPromptDeepseek(settings *ServerConfig, from_channel string, user string
 		if strings.HasPrefix(key, prefix) {
 			log.Printf(">P>%s\n", key)
 			if strings.HasSuffix(key, "/greet") && rGreet.MatchString(query) {
-				log.Printf("[FindPromptDeepseek] Found greeting prompt %s for query:%s\n", key, query)
+				log.Printf("[FindChannelPrompt] Found greeting prompt %s for query:%s\n", key, query)
 				prompt = key
 				text = value
 				break
 			} else if strings.HasSuffix(key, "/regex_challenge") && query == "regex\nchallenge" {
-				log.Printf("[FindPromptDeepseek] Found regex challenge prompt\n")
+				log.Printf("[FindChannelPrompt] Found regex challenge prompt\n")
 				prompt = key
 				text = value
 				break
 			} else if preferred_prompt != "" && strings.HasSuffix(key, "/"+preferred_prompt) {
-				log.Printf("[FindPromptDeepseek] Found user preferred prompt %s for query:%s\n", key, query)
+				log.Printf("[FindChannelPrompt] Found user preferred prompt %s for query:%s\n", key, query)
 
 				prompt = key
 				text = value
 				break
 			} else if strings.HasSuffix(key, "/default") {
-				log.Printf("[FindPromptDeepseek] Defaulting to prompt %s for query:%s\n", key, query)
+				log.Printf("[FindChannelPrompt] Defaulting to prompt %s for query:%s\n", key, query)
 
 				prompt = key
 				text = value
@@ -148,7 +214,8 @@ func LoadSysPrompts(settings *ServerConfig) {
 					log.Printf("Loaded Prompt '%s/%s/%s' -> Prompt: %s\n", settings.Name, channel.Name, promptName, text)
 					if strings.EqualFold(promptName, "regex_challenge") {
 						RegexChallengeMutex.Lock()
-						RegexChallengeChannels[settings.Name+"/"+channel.Name] = RegexChallenge{settings, channel.Name, time.Now().Unix(), pcre.MustCompile("^\n\n$"), "^$", false, 0}
+						RegexChallengeChannels[settings.Name+"/"+channel.Name] = RegexChallenge{settings: settings, Channel: channel.Name, Timer: time.Now().Unix(),
+							Regex: pcre.MustCompile("^\n\n$"), RegexText: "^$"}
 						RegexChallengeMutex.Unlock()
 					}
 				}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A CTF event, in ctf.yaml under event:. Flags are only accepted between start
+ * and end, and after freeze the public scoreboard stops changing.
+ */
+type CTFEvent struct {
+	Name    string    `yaml:"name"`
+	Start   time.Time `yaml:"start"`            /* e.g. 2026-10-24T18:00:00Z */
+	End     time.Time `yaml:"end"`              /* Required. */
+	Freeze  time.Time `yaml:"freeze,omitempty"` /* Optional, between start and end. */
+	Channel string    `yaml:"channel,omitempty"`
+}
+
+/* Check the times, so mistakes show up when the config is loaded. */
+func (event *CTFEvent) Validate() error {
+	if event.Name == "" {
+		event.Name = "The CTF"
+	}
+	if event.End.IsZero() {
+		return fmt.Errorf("no end time")
+	}
+	if !event.Start.IsZero() && !event.End.After(event.Start) {
+		return fmt.Errorf("ends before it starts")
+	}
+	if !event.Freeze.IsZero() && (event.Freeze.After(event.End) || event.Freeze.Before(event.Start)) {
+		return fmt.Errorf("freeze isn't between start and end")
+	}
+	return nil
+}
+
+/* Whether flags are accepted at t, and if not why. */
+func (event *CTFEvent) Open(t time.Time) (bool, string) {
+	if event == nil {
+		return true, ""
+	}
+	if t.Before(event.Start) {
+		return false, fmt.Sprintf("%s hasn't started yet, it opens in %s.", event.Name, formatDuration(event.Start.Sub(t)))
+	}
+	if !t.Before(event.End) {
+		return false, fmt.Sprintf("%s is over.", event.Name)
+	}
+	return true, ""
+}
+
+/* Until when solves count on the public scoreboard, 0 if it isn't frozen. It thaws at the end. */
+func (event *CTFEvent) FrozenAt(t time.Time) int64 {
+	if event == nil || event.Freeze.IsZero() || t.Before(event.Freeze) || !t.Before(event.End) {
+		return 0
+	}
+	return event.Freeze.Unix()
+}
+
+/* Where announcements go: the event's channel or those of its challenges. */
+func (config *CTFConfig) eventChannels() []string {
+	if config.Event.Channel != "" {
+		return []string{config.Event.Channel}
+	}
+	var channels []string
+	for _, ctf := range config.CTFFlags {
+		channel := strings.ToLower(ctf.Channel)
+		if channel != "" && !slices.Contains(channels, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+type scheduledEvent struct {
+	event  CTFEvent
+	timers []*time.Timer
+}
+
+var scheduledEvents = make(map[string]*scheduledEvent)
+var scheduledEventsMutex = sync.Mutex{}
+
+/*
+ * Schedule the announcements of a server's event. Called on every load of the
+ * CTF config, timers are only replaced if the event changed.
+ */
+func ScheduleCTFEvent(server string, config *CTFConfig) {
+	scheduledEventsMutex.Lock()
+	defer scheduledEventsMutex.Unlock()
+	scheduled, ok := scheduledEvents[server]
+	if ok && config.Event != nil && scheduled.event == *config.Event {
+		return
+	}
+	if ok {
+		for _, timer := range scheduled.timers {
+			timer.Stop()
+		}
+		delete(scheduledEvents, server)
+	}
+	if config.Event == nil {
+		return
+	}
+	event := *config.Event
+	channels := config.eventChannels()
+	scheduled = &scheduledEvent{event: event}
+	announce := func(at time.Time, message string) {
+		if at.IsZero() || time.Until(at) <= 0 {
+			return
+		}
+		scheduled.timers = append(scheduled.timers, time.AfterFunc(time.Until(at), func() {
+			log.Printf("[CTFEvent] %s: %s\n", server, message)
+			for _, channel := range channels {
+				send_irc_priority(server, channel, message, PriorityHigh)
+			}
+		}))
+	}
+	announce(event.Start, fmt.Sprintf("🚩 %s is open! Send me flags in private until %s. !challenges lists them.",
+		event.Name, event.End.UTC().Format("Mon 15:04 MST")))
+	announce(event.Freeze, fmt.Sprintf("❄️ The %s scoreboard is now frozen, final standings after the end.", event.Name))
+	announce(event.End, fmt.Sprintf("🏁 %s is over, thanks for playing! Final standings: !ctf_scores", event.Name))
+	scheduledEvents[server] = scheduled
+	log.Printf("[CTFEvent] Scheduled %s on %s, %s to %s\n", event.Name, server, event.Start, event.End)
+}
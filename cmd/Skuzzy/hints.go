@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * CTF hints are ordered. Each costs points once per player, and once per
+ * team, can require earlier hints and can stay locked for a while after the
+ * challenge opens. Taking a hint again, or after solving, is free.
+ */
+
+/* A CTF hint: just its text, or a mapping with text and the other fields. */
+type Hint struct {
+	Name     string   `yaml:"name,omitempty"` /* The mapping key in ctf.yaml. */
+	Text     string   `yaml:"text"`
+	Cost     *int     `yaml:"cost,omitempty"`     /* Points, default 10. */
+	Delay    string   `yaml:"delay,omitempty"`    /* e.g. 30m or 1d after the challenge opens. */
+	Requires []string `yaml:"requires,omitempty"` /* Hints to take first, by default the one before. */
+}
+
+/* Hints in order, written as a mapping of name to hint in ctf.yaml. */
+type Hints []Hint
+
+func (hint Hint) Points() int {
+	if hint.Cost == nil {
+		return ctfHintPenalty
+	}
+	return *hint.Cost
+}
+
+func (hint Hint) DelayDuration() time.Duration {
+	delay, _ := ParseModDuration(hint.Delay)
+	return delay
+}
+
+func (hints *Hints) UnmarshalYAML(value *yaml.Node) error {
+	type plain Hint
+	switch value.Kind {
+	case yaml.MappingNode:
+		/* Decoding the nodes one by one keeps the order of the file. */
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			var hint Hint
+			if value.Content[i+1].Kind == yaml.ScalarNode {
+				hint.Text = value.Content[i+1].Value
+			} else if err := value.Content[i+1].Decode((*plain)(&hint)); err != nil {
+				return err
+			}
+			hint.Name = value.Content[i].Value
+			*hints = append(*hints, hint)
+		}
+		return nil
+	case yaml.SequenceNode:
+		var list []plain
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		for _, hint := range list {
+			*hints = append(*hints, Hint(hint))
+		}
+		return nil
+	}
+	return fmt.Errorf("hints must be a mapping of name to hint")
+}
+
+func (hints Hints) MarshalYAML() (any, error) {
+	type plain Hint
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, hint := range hints {
+		key := &yaml.Node{}
+		key.SetString(hint.Name)
+		value := &yaml.Node{}
+		if hint.Cost == nil && hint.Delay == "" && hint.Requires == nil {
+			value.SetString(hint.Text)
+		} else {
+			/* omitempty would drop a cost of 0, which isn't the default. */
+			cost := hint.Cost
+			hint.Name, hint.Cost = "", nil
+			if err := value.Encode(plain(hint)); err != nil {
+				return nil, err
+			}
+			if cost != nil {
+				costKey, costValue := &yaml.Node{}, &yaml.Node{}
+				costKey.SetString("cost")
+				costValue.Encode(*cost)
+				value.Content = append(value.Content[:2], append([]*yaml.Node{costKey, costValue}, value.Content[2:]...)...)
+			}
+			/* Nor requires: [], which makes a hint independent of the one before it. */
+			if hint.Requires != nil && len(hint.Requires) == 0 {
+				requiresKey := &yaml.Node{}
+				requiresKey.SetString("requires")
+				value.Content = append(value.Content, requiresKey, &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle})
+			}
+		}
+		node.Content = append(node.Content, key, value)
+	}
+	return node, nil
+}
+
+/* The index of a hint by name, -1 if there's none. */
+func (hints Hints) Find(name string) int {
+	for i, hint := range hints {
+		if strings.EqualFold(hint.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+/* The hints to take before hints[i]. */
+func (hints Hints) Prerequisites(i int) []string {
+	if hints[i].Requires != nil {
+		return hints[i].Requires
+	}
+	if i > 0 {
+		return []string{hints[i-1].Name}
+	}
+	return nil
+}
+
+/* Hints can only require earlier hints, so there are no cycles. */
+func (hints Hints) Validate() error {
+	for i, hint := range hints {
+		if hint.Name == "" || hints.Find(hint.Name) != i {
+			return fmt.Errorf("hint names must be set and unique: '%s'", hint.Name)
+		}
+		if _, ok := ParseModDuration(hint.Delay); hint.Delay != "" && !ok {
+			return fmt.Errorf("bad delay for hint %s: %s", hint.Name, hint.Delay)
+		}
+		for _, required := range hints.Prerequisites(i) {
+			if j := hints.Find(required); j < 0 || j >= i {
+				return fmt.Errorf("hint %s requires %s, which isn't a hint before it", hint.Name, required)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * When a challenge opened for user: when they or their team solved the last
+ * of its prerequisites, otherwise when the event started. Zero if unknown.
+ */
+func (config *CTFConfig) challengeOpened(server, ctfname, user string, team CTFTeam) time.Time {
+	var opened time.Time
+	if config.Event != nil {
+		opened = config.Event.Start
+	}
+	required := config.Prerequisites(ctfname)
+	if len(required) == 0 {
+		return opened
+	}
+	query := "SELECT MAX(solved) FROM ctf_solves WHERE server = ? AND (user = ? OR (team_id = ? AND team_id != 0)) AND challenge IN (?" +
+		strings.Repeat(", ?", len(required)-1) + ")"
+	args := []any{strings.ToLower(server), strings.ToLower(user), team.ID}
+	for _, name := range required {
+		args = append(args, name)
+	}
+	var solved int64
+	if err := DB.QueryRow(query, args...).Scan(&solved); err == nil && time.Unix(solved, 0).After(opened) {
+		opened = time.Unix(solved, 0)
+	}
+	return opened
+}
+
+/* The hints of a challenge user or their team already took. */
+func hintsTaken(server, ctfname, user string, team CTFTeam) map[string]bool {
+	taken := make(map[string]bool)
+	rows, err := DB.Query("SELECT hint FROM ctf_hint_unlocks WHERE server = ? AND challenge = ? AND (user = ? OR (team_id = ? AND team_id != 0))",
+		strings.ToLower(server), ctfname, strings.ToLower(user), team.ID)
+	if err != nil {
+		log.Printf("[hintsTaken] Error: %v\n", err)
+		return taken
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hint string
+		if rows.Scan(&hint) == nil {
+			taken[hint] = true
+		}
+	}
+	return taken
+}
+
+type HintState struct {
+	Hint
+	Taken  bool
+	Locked string /* Why it can't be taken yet, empty if it can. */
+}
+
+/* Every hint of a challenge, with whether user took it and can take it. */
+func (config *CTFConfig) HintStates(server, ctfname, user string) []HintState {
+	ctf := config.CTFFlags[ctfname]
+	team, _ := CTFUserTeam(server, user)
+	taken := hintsTaken(server, ctfname, user, team)
+	opened := config.challengeOpened(server, ctfname, user, team)
+	solved := CTFUserSolves(server, user)
+	for name := range CTFTeamSolves(server, team) {
+		solved[name] = true
+	}
+	var unsolved []string
+	for _, required := range config.Prerequisites(ctfname) {
+		if !solved[required] {
+			unsolved = append(unsolved, required)
+		}
+	}
+	var states []HintState
+	for i, hint := range ctf.Hints {
+		state := HintState{Hint: hint, Taken: taken[hint.Name]}
+		if !state.Taken {
+			var missing []string
+			for _, required := range ctf.Hints.Prerequisites(i) {
+				if !taken[required] {
+					missing = append(missing, required)
+				}
+			}
+			if len(unsolved) > 0 {
+				state.Locked = "solve " + strings.Join(unsolved, ", ") + " first"
+			} else if len(missing) > 0 {
+				state.Locked = "take " + strings.Join(missing, ", ") + " first"
+			} else if delay := hint.DelayDuration(); delay > 0 && !opened.IsZero() && time.Since(opened) < delay {
+				state.Locked = "unlocks in " + formatDuration(time.Until(opened.Add(delay)))
+			}
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+var ErrHintLocked = errors.New("hint locked")
+
+/*
+ * Give user a hint, charging its cost unless they or their team already took
+ * it or the challenge is solved. Returns what was charged.
+ */
+func TakeHint(settings *ServerConfig, config *CTFConfig, ctfname, hintname, user string) (Hint, int, error) {
+	server := strings.ToLower(settings.Name)
+	user = strings.ToLower(user)
+	ctf := config.CTFFlags[ctfname]
+	if ctf.Disabled {
+		return Hint{}, 0, fmt.Errorf("%s is disabled", ctfname)
+	}
+	i := ctf.Hints.Find(hintname)
+	if i < 0 {
+		return Hint{}, 0, fmt.Errorf("%s has no hint %s", ctfname, hintname)
+	}
+	state := config.HintStates(server, ctfname, user)[i]
+	if state.Taken {
+		/* Charged once already, for them or their team. */
+		if _, err := DB.Exec("INSERT OR IGNORE INTO ctf_hint_unlocks (server, channel, challenge, hint, user, team_id, cost, taken) "+
+			"SELECT ?, ?, ?, ?, ?, team_id, 0, ? FROM ctf_team_members WHERE server = ? AND user = ?",
+			server, strings.ToLower(ctf.Channel), ctfname, state.Name, user, time.Now().Unix(), server, user); err != nil {
+			log.Printf("[TakeHint] Error: %v\n", err)
+		}
+		return state.Hint, 0, nil
+	}
+	if state.Locked != "" {
+		return state.Hint, 0, fmt.Errorf("%w: %s", ErrHintLocked, state.Locked)
+	}
+	team, _ := CTFUserTeam(server, user)
+	cost := state.Points()
+	if CTFUserSolves(server, user)[ctfname] || CTFTeamSolves(server, team)[ctfname] {
+		cost = 0
+	}
+	_, err := DB.Exec("INSERT OR IGNORE INTO ctf_hint_unlocks (server, channel, challenge, hint, user, team_id, cost, taken) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		server, strings.ToLower(ctf.Channel), ctfname, state.Name, user, team.ID, cost, time.Now().Unix())
+	if err != nil {
+		log.Printf("[TakeHint] Error, unable to record %s's hint %s:%v\n", user, state.Name, err)
+		return state.Hint, 0, fmt.Errorf("unable to record the hint")
+	}
+	log.Printf("[TakeHint] %s took hint %s of %s for %d points\n", user, state.Name, ctfname, cost)
+	return state.Hint, cost, nil
+}
+
+/* Send a hint privately, and say so in the channel it was asked in. */
+func sendHint(ctx *CommandContext, config *CTFConfig, ctfname, hintname string) {
+	hint, cost, err := TakeHint(ctx.Settings, config, ctfname, hintname, ctx.User)
+	if err != nil {
+		send_irc(ctx.Settings.Name, ctx.User, fmt.Sprintf("%s %s: %v", ctfname, hintname, err))
+		return
+	}
+	charged := ""
+	if cost > 0 {
+		charged = fmt.Sprintf(" (-%d points)", cost)
+	}
+	send_irc(ctx.Settings.Name, ctx.User, fmt.Sprintf("%s %s%s: %s", ctfname, hint.Name, charged, hint.Text))
+	if ctx.Channel != "" {
+		ctx.Reply("Check your private messages " + ctx.User + ", I just sent you the hint:" + hint.Name + " for " + ctfname + ".")
+	}
+}
+
+/*
+ * The challenge a hint name given as a command is for: the only challenge
+ * (of the channel, if asked in one) with a hint by that name, or the only one
+ * of those the player is on, open but not solved yet. Otherwise "" and the
+ * challenges it could be.
+ */
+func hintOwner(ctx *CommandContext, config *CTFConfig, hintname string) (string, []string) {
+	var candidates []string
+	for name, ctf := range config.CTFFlags {
+		if ctf.Disabled || (ctx.Channel != "" && !strings.EqualFold(ctx.Channel, ctf.Channel)) {
+			continue
+		}
+		if ctf.Hints.Find(hintname) >= 0 {
+			candidates = append(candidates, name)
+		}
+	}
+	slices.Sort(candidates)
+	if len(candidates) == 1 {
+		return candidates[0], candidates
+	}
+	solved := CTFUserSolves(ctx.Settings.Name, ctx.User)
+	if team, err := CTFUserTeam(ctx.Settings.Name, ctx.User); err == nil {
+		for name := range CTFTeamSolves(ctx.Settings.Name, team) {
+			solved[name] = true
+		}
+	}
+	var current []string
+	for _, name := range candidates {
+		open := !solved[name]
+		for _, required := range config.Prerequisites(name) {
+			open = open && solved[required]
+		}
+		if open {
+			current = append(current, name)
+		}
+	}
+	if len(current) == 1 {
+		return current[0], candidates
+	}
+	return "", candidates
+}
+
+/* The challenge named by args[0], or the only one of the channel. Disabled challenges are left out. */
+func hintChallenge(ctx *CommandContext, config *CTFConfig) (string, bool) {
+	if len(ctx.Args) > 0 {
+		for name, ctf := range config.CTFFlags {
+			if strings.EqualFold(name, ctx.Args[0]) && !ctf.Disabled {
+				return name, true
+			}
+		}
+		return "", false
+	}
+	found := ""
+	for name, ctf := range config.CTFFlags {
+		if !ctf.Disabled && ctx.Channel != "" && strings.EqualFold(ctf.Channel, ctx.Channel) {
+			if found != "" {
+				return "", false
+			}
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "hints",
+		Syntax:      "[challenge]",
+		Description: "List the hints of a challenge, what they cost and which you can take",
+		Category:    "CTF Challenge",
+		Channel:     true,
+		Private:     true,
+		Cooldown:    5 * time.Second,
+		PerUser:     true,
+		Handler: func(ctx *CommandContext) {
+			ctfconfig := ServerCTF(ctx.Settings.Name)
+			if ctfconfig == nil {
+				ctx.Reply("There is no CTF running here.")
+				return
+			}
+			ctfname, ok := hintChallenge(ctx, ctfconfig)
+			if !ok {
+				send_irc(ctx.Settings.Name, ctx.User, "Which challenge? Usage: "+ctx.Command.Usage())
+				return
+			}
+			states := ctfconfig.HintStates(ctx.Settings.Name, ctfname, ctx.User)
+			if len(states) == 0 {
+				send_irc(ctx.Settings.Name, ctx.User, ctfname+" has no hints.")
+				return
+			}
+			for _, state := range states {
+				status := "available, !hint " + ctfname + " " + state.Name
+				if state.Taken {
+					status = "taken"
+				} else if state.Locked != "" {
+					status = state.Locked
+				}
+				send_irc_priority(ctx.Settings.Name, ctx.User, fmt.Sprintf("%s %s: %d points, %s", ctfname, state.Name, state.Points(), status), PriorityLow)
+			}
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "hint",
+		Syntax:      "[challenge] [hint]",
+		Description: "Take a hint of a challenge, the next one you can take by default",
+		Category:    "CTF Challenge",
+		Channel:     true,
+		Private:     true,
+		Cooldown:    5 * time.Second,
+		PerUser:     true,
+		Handler: func(ctx *CommandContext) {
+			ctfconfig := ServerCTF(ctx.Settings.Name)
+			if ctfconfig == nil {
+				ctx.Reply("There is no CTF running here.")
+				return
+			}
+			ctfname, ok := hintChallenge(ctx, ctfconfig)
+			if !ok {
+				send_irc(ctx.Settings.Name, ctx.User, "Which challenge? Usage: "+ctx.Command.Usage())
+				return
+			}
+			if len(ctx.Args) > 1 {
+				sendHint(ctx, ctfconfig, ctfname, ctx.Args[1])
+				return
+			}
+			for _, state := range ctfconfig.HintStates(ctx.Settings.Name, ctfname, ctx.User) {
+				if !state.Taken && state.Locked == "" {
+					sendHint(ctx, ctfconfig, ctfname, state.Name)
+					return
+				}
+			}
+			send_irc(ctx.Settings.Name, ctx.User, "No hint of "+ctfname+" you can take now, see !hints "+ctfname)
+		},
+	})
+}
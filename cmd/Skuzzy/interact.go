@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -22,10 +23,28 @@ Usage:
 /server                           Switch to server, e.g.: /Server libera
 /channel                          Switch to channel, e.g.: /Channel #hackers
 /info                             Display information about the current server and channel
+/status                           Display connection state and lag of every server
+/names [channel]                  List tracked members of the current or given channel
+/whois <nick>                     Display what is known about a user
+/commands                         List the registered IRC commands
 /interactive                      Turn interactive mode on or off
 /admin reminders list             List all active reminders 
 /admin reminders delete <id>      Delete a reminder by ID
 /admin reminders purge            Delete all reminders
+/admin roles list [channel|*]     List roles granted on the current server
+/admin roles grant <mask> <role> [channel|*]
+                                  Grant a role (user, trusted, op, admin, owner), server-wide by default
+/admin roles revoke <mask> [channel|*]
+                                  Remove a granted role
+/admin ctf attempts [nick|account|challenge|shared|top]
+                                  Show flag submissions on the current server
+/admin ctf scores [channel]       Show the live CTF standings of the current or given channel
+/admin ctf export [channel] [teams] [solves]
+                                  Print the live standings as CTFd scoreboard JSON
+/admin ctf <reload|show|add|edit|disable|enable|flag|hint|award|revoke|reset|announce> ...
+                                  Change challenges in ctf.yaml, manage solves, announce (see the Readme)
+/admin ctf onboard [list|show <nick>|approve <nick> [note]|reapprove <nick> [note]|reject <nick> [reason]]
+                                  Review the players waiting to join the community
 `
 
 func interact(socketPath string) {
@@ -73,6 +92,23 @@ func interact_triage(_input string, conn *net.UnixConn) {
 			conn.Write([]byte(fmt.Sprintf("Output channel set to %v\n", Channel)))
 		case "/info":
 			conn.Write([]byte(fmt.Sprintf("Current output:\nServer:%v\nChannel:%v\n", Server, Channel)))
+		case "/status":
+			conn.Write([]byte(SupervisorStatus() + "\n"))
+		case "/names":
+			channel := strings.TrimSpace(strings.Replace(input, "/names", "", 1))
+			if channel == "" {
+				channel = Channel
+			}
+			conn.Write([]byte(interact_names(Server, channel)))
+		case "/whois":
+			nick := strings.TrimSpace(strings.Replace(input, "/whois", "", 1))
+			if user, ok := LookupUser(Server, nick); ok {
+				conn.Write([]byte(fmt.Sprintf("%s account:%s away:%v\n", user.Hostmask(), user.Account, user.Away)))
+			} else {
+				conn.Write([]byte(fmt.Sprintf("%s is not in any channel I'm in on %s\n", nick, Server)))
+			}
+		case "/commands":
+			conn.Write([]byte(strings.Join(CommandNames(), " ") + "\n"))
 		case "/interactive":
 			if Interactive {
 				Interactive = false
@@ -114,6 +150,10 @@ func interact_triage(_input string, conn *net.UnixConn) {
 				default:
 					conn.Write([]byte(fmt.Sprintf("Unknown admin reminders command: '%s'\n", reminderSubcommand)))
 				}
+			case "roles":
+				conn.Write([]byte(interact_roles(Server, parts[2:]) + "\n"))
+			case "ctf":
+				conn.Write([]byte(interact_ctf(Server, parts[2:]) + "\n"))
 			default:
 				conn.Write([]byte(fmt.Sprintf("Unknown admin command: '%s'\n", adminCommand)))
 			}
@@ -131,9 +171,114 @@ func interact_triage(_input string, conn *net.UnixConn) {
 	}
 }
 
+func interact_names(server, channel string) string {
+	members := ChannelMembers(server, channel)
+	if len(members) == 0 {
+		return fmt.Sprintf("No members tracked for %s/%s. Channels: %s\n", server, channel, strings.Join(TrackedChannels(server), " "))
+	}
+	var names strings.Builder
+	names.WriteString(fmt.Sprintf("%s/%s (%d):\n", server, channel, len(members)))
+	for _, m := range members {
+		names.WriteString(fmt.Sprintf("%s%s (%s) account:%s\n", m.Prefixes, m.Nick, m.Hostmask(), m.Account))
+	}
+	return names.String()
+}
+
 func interact_output(conn *net.UnixConn) {
 	for {
 		output := <-InteractQueue
 		conn.Write([]byte(output))
 	}
 }
+
+/* /admin roles subcommands, on the current server. */
+func interact_roles(server string, args []string) string {
+	if server == "" {
+		return "Select a server first with /server."
+	}
+	if len(args) < 1 {
+		return "Usage: /admin roles <list|grant|revoke>"
+	}
+	channel := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return AnyChannel
+	}
+	switch args[0] {
+	case "list":
+		return formatGrants(ListGrants(server, channel(1)))
+	case "grant":
+		if len(args) < 3 {
+			return "Usage: /admin roles grant <mask> <role> [channel|*]"
+		}
+		role, err := ParseRole(args[2])
+		if err != nil {
+			return err.Error()
+		}
+		mask := MaskFor(server, args[1])
+		if err := SetGrant(server, channel(3), mask, role, "interact"); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%s is now %s in %s", mask, role, channel(3))
+	case "revoke":
+		if len(args) < 2 {
+			return "Usage: /admin roles revoke <mask> [channel|*]"
+		}
+		mask := MaskFor(server, args[1])
+		removed, err := RemoveGrant(server, channel(2), mask)
+		if err != nil {
+			return err.Error()
+		}
+		if !removed {
+			return fmt.Sprintf("%s has no role in %s", mask, channel(2))
+		}
+		return fmt.Sprintf("Removed the role of %s in %s", mask, channel(2))
+	}
+	return fmt.Sprintf("Unknown admin roles command: '%s'", args[0])
+}
+
+/* /admin ctf subcommands, on the current server. */
+func interact_ctf(server string, args []string) string {
+	if server == "" {
+		return "Select a server first with /server."
+	}
+	if len(args) < 1 {
+		return "Usage: /admin ctf <attempts|scores|export|onboard|reload|show|add|edit|disable|enable|flag|hint|award|revoke|reset|announce>"
+	}
+	switch args[0] {
+	case "attempts":
+		return strings.Join(AttemptsReport(server, args[1:]), "\n")
+	case "scores":
+		ctfconfig := ServerCTF(server)
+		if ctfconfig == nil {
+			return "No CTF configured on " + server
+		}
+		channel := Channel
+		if len(args) > 1 {
+			channel = args[1]
+		}
+		return "Live CTF Scores for " + channel + ":" + FormatStandings(CTFScores(server, channel, ctfconfig, 0), 50)
+	case "export":
+		ctfconfig := ServerCTF(server)
+		if ctfconfig == nil {
+			return "No CTF configured on " + server
+		}
+		channel := Channel
+		if len(args) > 1 && !slices.Contains([]string{"teams", "solves"}, args[1]) {
+			channel = args[1]
+		}
+		out, err := ExportCTFdScoreboard(server, channel, ctfconfig, slices.Contains(args, "teams"), slices.Contains(args, "solves"))
+		if err != nil {
+			return err.Error()
+		}
+		return string(out)
+	}
+	if sup := FindSupervisor(server); sup != nil {
+		if args[0] == "onboard" {
+			return strings.Join(OnboardingReview(sup.settings, "interact", args[1:]), "\n")
+		}
+		return strings.Join(CTFAdmin(sup.settings, "interact", args), "\n")
+	}
+	return fmt.Sprintf("Unknown admin ctf command: '%s'", args[0])
+}
@@ -7,8 +7,8 @@ import (
 	//"io"
 	"log"
 	"net"
+	"os"
 	"regexp"
-	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,33 +17,58 @@ import (
 
 type Connection struct {
 	cx   net.Conn
-	pong int64
 	CTF  *CTFConfig
+	Caps map[string]string /* Acknowledged IRCv3 capabilities. */
+	out  *OutQueue
+
+	prefix        string /* Our own nick!user@host, once seen. */
+	maxReplyLines int
+	maxPMLines    int
 }
 
 var Connections = make(map[string]Connection)
 var ConnectionsMutex = sync.RWMutex{}
 
 func send_irc(server string, channel string, message string) {
-	log.Printf("Sending to %v/%v:%v\n", server, channel, message)
-	max := len(message)
-	if max > 1600 {
-		max = 1600
-	}
-	message = message[:max]
-	remaining_message := ""
-	if len(message) >= 397 {
-		remaining_message = "..." + message[397:max]
-		message = message[:397] + "..."
+	send_irc_priority(server, channel, message, PriorityNormal)
+}
 
-	}
+/* Lines of a reply sent to a channel before it is truncated, and to a private message. */
+var defaultMaxReplyLines = 4
+var defaultMaxPMLines = 20
 
-	sanitizer := strings.NewReplacer(
-		"\r", "",
-		"\n", "",
-		"\b", "",
-	)
+var sanitizer = strings.NewReplacer(
+	"\r\n", " ",
+	"\r", " ",
+	"\n", " ",
+	"\b", "",
+	"\x00", "",
+)
+
+/*
+ * Like send_irc, but queued at the given priority. Continuation lines are always low priority.
+ * Returns true if the message had to be truncated.
+ */
+func send_irc_priority(server string, channel string, message string, priority Priority) bool {
+	return send_irc_lines(server, channel, message, priority, " … (truncated)")
+}
+
+/*
+ * Send an LLM reply to a channel on behalf of user. If it's too long for the channel,
+ * the channel gets the first lines and the user gets the full reply in private.
+ */
+func send_irc_reply(server string, channel string, user string, message string) {
+	if user == "" || strings.EqualFold(user, channel) {
+		send_irc(server, channel, message)
+		return
+	}
+	if send_irc_lines(server, channel, message, PriorityNormal, " … (truncated, full reply sent via PM)") {
+		send_irc_lines(server, user, message, PriorityLow, " … (truncated)")
+	}
+}
 
+func send_irc_lines(server string, channel string, message string, priority Priority, marker string) bool {
+	log.Printf("Sending to %v/%v:%v\n", server, channel, message)
 	message = sanitizer.Replace(message)
 
 	ConnectionsMutex.RLock()
@@ -51,41 +76,56 @@ func send_irc(server string, channel string, message string) {
 	ConnectionsMutex.RUnlock()
 	if !ok || conn.cx == nil {
 		log.Printf("Error: no valid IRC connection found for '%s'. Message not sent: %s", server, message)
-		return /* If no valid connection. Exit. */
+		return false /* If no valid connection. Exit. */
 	}
 
-	msg := ""
-	if channel != "" {
-		msg = fmt.Sprintf("PRIVMSG %v :%s\r\n", channel, message)
-	} else {
-
-		msg = fmt.Sprintf("%s\r\n", message)
+	if channel == "" {
+		/* Raw line from the operator, only needs to fit in one message. */
+		msg := message[:splitPoint(message, maxIRCMessage-2)] + "\r\n"
+		send_irc_raw(conn, msg)
+		return false
 	}
 
-	send_irc_raw(conn, msg)
-
-	if remaining_message != "" {
-		send_irc(server, channel, remaining_message)
+	maxLines := conn.maxReplyLines
+	if !strings.ContainsAny(channel[:1], "#&+!") {
+		maxLines = conn.maxPMLines
+	}
+	prefixLen := 0
+	if conn.prefix != "" {
+		prefixLen = len(":" + conn.prefix + " ")
 	}
+	lines, truncated := SplitIRCMessage(message, PayloadLimit(prefixLen, channel), maxLines, marker)
+	for i, line := range lines {
+		msg := fmt.Sprintf("PRIVMSG %v :%s\r\n", channel, line)
+		if i > 0 {
+			priority = PriorityLow
+		}
+		if conn.out != nil {
+			conn.out.Push(msg, priority, false)
+		} else {
+			send_irc_raw(conn, msg)
+		}
+	}
+	return truncated
 }
 
+/* Queue a raw line on the connection's outbound queue, prioritised by its command. */
 func send_irc_raw(conn Connection, msg string) {
 	if len(msg) < 1 {
 		return
 	}
-	_, err := conn.cx.Write([]byte(msg))
-	if err != nil {
-		log.Printf("Failed to send IRC message:%v\nError:%v\n", msg, err)
+	if conn.out == nil {
+		log.Printf("Error: no outbound queue, message not sent:%v\n", msg)
+		return
 	}
-	fmt.Printf("< %v", msg)
+	conn.out.Push(msg, linePriority(msg), false)
 }
 func send_irc_raw_secret(conn Connection, msg string) {
-	ConnectionsMutex.RLock()
-	defer ConnectionsMutex.RUnlock()
-	_, err := conn.cx.Write([]byte(msg))
-	if err != nil {
-		log.Printf("Failed to send IRC message containing a secret:\nError:%v\n", err)
+	if conn.out == nil {
+		log.Printf("Error: no outbound queue, message containing a secret not sent\n")
+		return
 	}
+	conn.out.Push(msg, linePriority(msg), true)
 }
 func irc_connect(settings *ServerConfig) error {
 	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
@@ -97,16 +137,29 @@ func irc_connect(settings *ServerConfig) error {
 	}
 	ConnectionsMutex.Lock()
 
+	if old, ok := Connections[settings.Name]; ok && old.out != nil {
+		old.out.Close()
+	}
+	connection := Connection{
+		cx:            conn,
+		out:           NewOutQueue(settings.Name, conn, settings.FloodBurst, settings.FloodRate),
+		maxReplyLines: settings.MaxReplyLines,
+		maxPMLines:    settings.MaxPMLines,
+	}
+	if connection.maxReplyLines == 0 {
+		connection.maxReplyLines = defaultMaxReplyLines
+	}
+	if connection.maxPMLines == 0 {
+		connection.maxPMLines = defaultMaxPMLines
+	}
 	if len(settings.CtfConfigPath) > 0 {
 		ctfconfig, err := LoadCTFConfig(settings.CtfConfigPath)
 		if err == nil {
-			Connections[settings.Name] = Connection{conn, time.Now().Unix(), ctfconfig}
-		} else {
-			Connections[settings.Name] = Connection{conn, time.Now().Unix(), nil}
+			connection.CTF = ctfconfig
+			ScheduleCTFEvent(settings.Name, ctfconfig)
 		}
-	} else {
-		Connections[settings.Name] = Connection{conn, time.Now().Unix(), nil}
 	}
+	Connections[settings.Name] = connection
 
 	ConnectionsMutex.Unlock()
 	Server = settings.Name
@@ -119,6 +172,9 @@ func CloseConnections() {
 	defer ConnectionsMutex.Unlock()
 	for name, conn := range Connections {
 		log.Printf("Closing %v\n", name)
+		if conn.out != nil {
+			conn.out.Close()
+		}
 		conn.cx.Close()
 		/*
 		 * Removed irc_disconnect in favour of directly handling connection closures
@@ -140,346 +196,322 @@ var rListReminders = regexp.MustCompile(`(?i)(list|my) reminders`)
 var rDeleteReminder = regexp.MustCompile(`(?i)(delete|remove) reminder (\d+)`)
 var rChangeReminder = regexp.MustCompile(`(?i)(change|update) reminder (?:id )?(\d+)(?:[.:, ])?(.+)`)
 
-func Ping(settings *ServerConfig) {
-	timeout := int64(499)
-	sleep := time.Duration(int(timeout / 2))
-	for {
-		ConnectionsMutex.RLock()
-		pong := Connections[settings.Name].pong
-		ConnectionsMutex.RUnlock()
-
-		latency := time.Now().Unix() - pong
-		log.Printf("[PING] latency %d, pong %d\n", latency, pong)
-		if pong > 0 && latency > timeout {
-			log.Printf("[PING] %s has latency %d >= %d, starting a new server and breaking PING routine.\n", settings.Name, latency, timeout)
-			go ServerRun(settings)
-			break
-		} else if pong > 0 && latency > timeout/2 {
-			log.Printf("[PING] %s has latency %d >= %v.\n", settings.Name, latency, sleep)
-			time.Sleep(sleep * time.Second)
-			continue
-		}
-		send_irc_raw(Connections[settings.Name], "PING :HACK THE PLANET\r\n")
-		time.Sleep(sleep * time.Second)
-	}
-
-}
-
-func irc_loop(settings *ServerConfig) {
+/* Read and dispatch messages until the connection fails or authentication is rejected. */
+func irc_loop(settings *ServerConfig) error {
 	log.Printf("IRC message loop for %s\n", settings.Name)
 	ConnectionsMutex.RLock()
 	cx := Connections[settings.Name].cx
 	ConnectionsMutex.RUnlock()
 
-	send_irc_raw(Connections[settings.Name], "CAP REQ :sasl\r\n")
-
-	auth_sent := false
-	breakout := false
+	send_irc_raw(Connections[settings.Name], "CAP LS 302\r\n")
 
-	cx.SetReadDeadline(time.Now().Add(240 * time.Second))
+	state := &ircSession{}
+	reader := NewIRCReader(cx)
 
 	for {
-		buf := make([]byte, 65535)
-		nbytes, err := cx.Read(buf)
+		cx.SetReadDeadline(time.Now().Add(240 * time.Second))
+		line, err := reader.ReadLine()
 		if err != nil {
 			log.Printf("[%v] Error receiving data from %s:%v\n", settings.Name, settings.Host, err)
 
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				log.Printf("[%s] Read timeout, sending PING to server.", settings.Name)
 				send_irc_raw(Connections[settings.Name], fmt.Sprintf("PING %s\r\n", settings.Host))
-				cx.SetReadDeadline(time.Now().Add(240 * time.Second))
 				continue
+			}
+			return err
+		}
+		fmt.Printf(">%v\n", line)
+
+		msg, err := ParseIRCMessage(line)
+		if err != nil {
+			continue
+		}
+		handleIRCMessage(settings, state, msg)
+		if state.breakout {
+			return fmt.Errorf("SASL authentication failed")
+		}
+	}
+}
+
+/* Per-connection state kept by the dispatcher between messages. */
+type ircSession struct {
+	auth_sent bool
+	breakout  bool
+	caps      capNegotiation
+}
+
+/* Dispatch one message from the server. */
+func handleIRCMessage(settings *ServerConfig, state *ircSession, msg *IRCMessage) {
+	TrackState(settings, msg)
+	switch msg.Command {
+	case "CAP":
+		handleCap(settings, state, msg)
+	case "AUTHENTICATE":
+		if !state.auth_sent && msg.Param(0) == "+" {
+			PLAIN := []byte(fmt.Sprintf("\x00%s\x00%s", settings.SaslUser, settings.SaslPassword))
+			state.auth_sent = true
+			send_irc_raw_secret(Connections[settings.Name], fmt.Sprintf("AUTHENTICATE %s\r\n", base64.StdEncoding.EncodeToString(PLAIN)))
+		}
+	case "903":
+		log.Printf("SASL authentication successful")
+		finishRegistration(settings, state)
+	case "904", "905", "906", "907", "908":
+		state.auth_sent = false
+		log.Printf("SASL authentication has failed!")
+		state.breakout = true
+	case "MODE":
+		/* Our own user mode being set means registration is done. */
+		if strings.EqualFold(msg.Nick(), settings.Nick) && strings.EqualFold(msg.Param(0), settings.Nick) {
+			for _, channel := range settings.Channels {
+				send_irc_raw(Connections[settings.Name], fmt.Sprintf("JOIN %s\r\n", channel.Name))
+				Channel = channel.Name
+			}
+		}
+	case "JOIN":
+		/* Our own JOIN shows the prefix the server prepends to our messages. */
+		if strings.EqualFold(msg.Nick(), settings.Nick) {
+			ConnectionsMutex.Lock()
+			if conn, ok := Connections[settings.Name]; ok {
+				conn.prefix = msg.Prefix
+				Connections[settings.Name] = conn
+			}
+			ConnectionsMutex.Unlock()
+		} else {
+			CheckJoinPart(settings, msg)
+		}
+	case "PART":
+		CheckJoinPart(settings, msg)
+	case "PING":
+		send_irc_raw(Connections[settings.Name], fmt.Sprintf("PONG :%s\r\n", msg.Trailing()))
+	case "PONG":
+		if msg.Trailing() == "HACK THE PLANET" {
+			if sup := FindSupervisor(settings.Name); sup != nil {
+				sup.Pong()
+				log.Println("!PONG!")
 			} else {
-				break
+				log.Println("PONG FAILURE")
 			}
-		} else if nbytes > 0 {
-			cx.SetReadDeadline(time.Now().Add(240 * time.Second))
-			for _, line := range strings.Split(string(buf), "\n") {
-				response := strings.TrimSpace(line)
-				words := strings.Split(response, " ")
-				words_len := len(words)
-				fmt.Printf(">%v\n", response)
-
-				if !auth_sent && strings.HasSuffix(response, "ACK :sasl") {
-					send_irc_raw(Connections[settings.Name], "AUTHENTICATE PLAIN\r\n")
-				} else if !auth_sent && response == "AUTHENTICATE +" {
-					PLAIN := []byte(fmt.Sprintf("\x00%s\x00%s", settings.SaslUser, settings.SaslPassword))
-					auth_sent = true
-					send_irc_raw_secret(Connections[settings.Name], fmt.Sprintf("AUTHENTICATE %s\r\n", base64.StdEncoding.EncodeToString(PLAIN)))
-				} else if words_len >= 2 {
-					if strings.HasPrefix(words[1], "90") && !slices.Contains([]string{"900", "901", "902", "903"}, words[1]) {
-						auth_sent = false
-						log.Printf("SASL authentication has failed!")
-						breakout = true
-					} else if words[1] == "903" {
-						log.Printf("SASL authentication successful")
-						send_irc_raw(Connections[settings.Name], "CAP END\r\n")
-
-						send_irc_raw(Connections[settings.Name], fmt.Sprintf("NICK %s\r\n", settings.Nick))
-						send_irc_raw_secret(Connections[settings.Name], fmt.Sprintf("PRIVMSG NICKSERV :IDENTIFY %s %s\r\n", settings.Nick, settings.NickservPassword))
-						send_irc_raw(Connections[settings.Name], fmt.Sprintf("USER %s 0 * :%s\r\n", settings.NickservUsername, settings.NickservUsername))
-					} else if words[1] == "MODE" && words[0] == ":"+settings.Nick {
-
-						for _, channel := range settings.Channels {
-							send_irc_raw(Connections[settings.Name], fmt.Sprintf("JOIN %s\r\n", channel.Name))
-							Channel = channel.Name
-						}
+		}
+	case "001":
+		if sup := FindSupervisor(settings.Name); sup != nil {
+			sup.Registered()
+		}
+	case "433":
+		if len(settings.Nick) < 32 {
+			if strings.HasSuffix(settings.Nick, "_") && len(settings.Nick) > 16 {
+				settings.Nick = "_" + settings.Nick
+			} else {
+				settings.Nick = settings.Nick + "_"
+			}
+			send_irc_raw(Connections[settings.Name], fmt.Sprintf("NICK %s\r\n", settings.Nick))
+		}
+	case "PRIVMSG":
+		/* With echo-message our own messages come back, don't answer ourselves. */
+		if strings.EqualFold(msg.Nick(), settings.Nick) {
+			return
+		}
+		if len(msg.Params) >= 2 {
+			handlePrivmsg(settings, msg)
+		}
+	}
+}
 
-					} else if words[0] == "PING" {
-						send_irc_raw(Connections[settings.Name], strings.Replace(response, "PING", "PONG", 1)+"\r\n")
-					} else if words[0] == "PONG" && strings.HasSuffix(response, ":HACK THE PLANET") {
-						if conn, ok := Connections[settings.Name]; ok {
-							conn.pong = time.Now().Unix()
-							ConnectionsMutex.Lock()
-							Connections[settings.Name] = conn
-							ConnectionsMutex.Unlock()
-							log.Println("!PONG!")
-						} else {
-							log.Println("PONG FAILURE")
-						}
-					} else if words[1] == "433" && len(settings.Nick) < 32 {
-						if strings.HasSuffix(settings.Nick, "_") && len(settings.Nick) > 16 {
-							settings.Nick = "_" + settings.Nick
-						} else {
-							settings.Nick = settings.Nick + "_"
-						}
-						send_irc_raw(Connections[settings.Name], fmt.Sprintf("NICK %s\r\n", settings.Nick))
-					} else if words[1] == "PRIVMSG" && words_len >= 3 {
-						from_channel := ""
-						query := strings.TrimLeft(strings.Join(words[3:], " "), ":")
-						user := strings.TrimLeft(words[0], ":")
-
-						user = strings.Split(user, "!")[0]
-						/* Handle messages from Discord bridge bots by stripping the <username> prefix. */
-
-						user, query = BridgeUser(query, user, settings)
-
-						llm := ""
-						var channel *ChannelConfig
-
-						for i := range settings.Channels {
-							ch := &settings.Channels[i]
-							if strings.EqualFold(ch.Name, words[2]) {
-								channel = ch
-								from_channel = ch.Name
-								privmsg := fmt.Sprintf("[>][%s/%s] <%s> %s\n", settings.Host, ch.Name, user, query)
-								select {
-								case InteractQueue <- privmsg:
-								default:
-								}
-								log.Print(privmsg)
-								llm = ch.LLM
-								if len(ch.Backlog) > 10 {
-									ch.Backlog = ch.Backlog[1:]
-								}
-								ch.Backlog = append(ch.Backlog, fmt.Sprintf("<%s> %s", user, query))
-								break
-							}
-						}
-						if channel != nil {
-							if strings.EqualFold(query, "!help") {
-								sendHelp(settings, from_channel, user)
-								continue
-							}
-							if strings.EqualFold(query, "!topic") {
-								sendTopicHelp(settings, from_channel, user)
-								continue
-							}
-
-							if strings.HasPrefix(query, `"`) && strings.HasSuffix(query, `"`) {
-								log.Printf("Debug: query has double quotes:[%s]\n", query)
-								go CheckRegexChallenge(settings.Name, from_channel, user, strings.Trim(query, `"`))
-							} else {
-								log.Printf("Debug: query has NO double quotes:[%s]\n", query)
-							}
-							if strings.EqualFold(query, "!regex scores") || strings.EqualFold(query, "!regex_scores") {
-								go SendRegexScores(settings.Name, from_channel)
-								continue
-							}
-							if strings.EqualFold(query, "!next regex") || strings.EqualFold(query, "!next_regex") {
-								go NextRegexChallenge(settings.Name, from_channel, user)
-								continue
-							}
-							if strings.EqualFold(query, "!last regex") || strings.EqualFold(query, "!last_regex") {
-								go LastRegexChallenge(settings.Name, from_channel, user)
-								continue
-							}
-							if strings.Contains(query, "@@") {
-								query = ParsePreferences(settings.Name, from_channel, user, query)
-							}
-							if words_len >= 4 && strings.HasPrefix(query, "!quiet ") {
-								go HandleQuietRequest(settings.Name, from_channel, user, words[4])
-								continue
-							}
-							if words_len >= 4 && strings.HasPrefix(query, "!unquiet ") {
-								go HandleUnquietRequest(settings.Name, from_channel, user, words[4])
-								continue
-							}
-							if strings.HasPrefix(query, "!") {
-
-								for k, ctf := range Connections[settings.Name].CTF.CTFFlags {
-									for hintname, hint := range ctf.Hints {
-										if strings.EqualFold("!"+hintname, query) && strings.EqualFold(from_channel, ctf.Channel) {
-											send_irc(settings.Name, user, hint)
-											send_irc(settings.Name, from_channel, "Check your private messages "+user+", I just sent you the hint:"+hintname+" for "+k+".")
-											CTFHintTaken(settings, ctf, user)
-											break
-										}
-									}
-									if strings.EqualFold("!"+k, query) && len(ctf.Description) > 0 {
-										send_irc(settings.Name, from_channel, "Check your private messages "+user+", I just sent you the description for "+k+".")
-
-										send_irc(settings.Name, user, ctf.Description)
-									}
-								}
-								if strings.EqualFold(query, "!ctf_scores") {
-									SendCTFScores(settings.Name, from_channel)
-
-								}
-							}
-
-						} else if strings.EqualFold(settings.Nick, words[2]) {
-							handlePM(settings, user, query)
-							continue
-						}
-						if channel != nil && strings.EqualFold(llm, "deepseek") {
-							mention := mentioned(settings.Nick, query)
-							if mention {
-								/* Skuzzy mentioned, process the command. */
-								log.Printf("Mentioned!\n")
-								query = strings.TrimLeft(query, "~")
-
-								nickPattern := `(?i)^` + regexp.QuoteMeta(settings.Nick) + `[:, ]*`
-								r, _ := regexp.Compile(nickPattern)
-								cleanQuery := r.ReplaceAllString(query, "")
-								first_word := strings.Split(query, " ")[0]
-								if strings.HasPrefix(first_word, "http://") || strings.HasPrefix(first_word, "https://") {
-									httpBody := HttpGetHead(first_word)
-									if len(httpBody) > 2 {
-										query = httpBody
-										cleanQuery = httpBody
-										log.Printf("Using http body from url %s:\n---\n%s\n---\n", first_word, httpBody)
-									}
-								}
-								if rListReminders.MatchString(cleanQuery) {
-									/* List reminders. */
-									send_irc(settings.Name, from_channel, ListReminders(settings, user))
-									log.Printf("Deepseek reminder listing query:\n%v\n", cleanQuery)
-								} else if rDeleteReminder.MatchString(cleanQuery) {
-									/* Delete a reminder. */
-									matches := rDeleteReminder.FindStringSubmatch(cleanQuery)
-									if len(matches) > 2 {
-										id, err := strconv.Atoi(matches[2])
-										if err == nil {
-											send_irc(settings.Name, from_channel, DeleteReminder(settings,
-												user, id))
-											log.Printf("%s requested to delete reminder ID %d", user, id)
-										}
-									}
-								} else if rChangeReminder.MatchString(cleanQuery) {
-									/* Change reminder. */
-									matches := rChangeReminder.FindStringSubmatch(cleanQuery)
-									if len(matches) > 3 {
-										id, err := strconv.Atoi(matches[2])
-										newDetails := matches[3]
-										if err == nil {
-											req := DeepseekRequest{
-												Channel:       from_channel,
-												Server:        settings.Name,
-												request:       fmt.Sprintf("Reminder ID: %d, Details: %s", id, newDetails),
-												PromptName:    "reminder_change_parse",
-												OriginalQuery: cleanQuery,
-												User:          user,
-											}
-											DeepseekQueue <- req
-											log.Printf("%s requested to change reminder ID %d with details: %s",
-												user, id, newDetails)
-										}
-									}
-								} else if rReminder.MatchString(cleanQuery) {
-									req := DeepseekRequest{
-										Channel:       from_channel,
-										Server:        settings.Name,
-										request:       cleanQuery,
-										PromptName:    "reminder_parse",
-										OriginalQuery: cleanQuery,
-										User:          user,
-									}
-									DeepseekQueue <- req
-									log.Printf("Deepseek reminder parsing query:\n%v\n", req)
-								} else {
-									/* Handle other commands like @reset, @reload, or default chat. */
-									reload := false
-									reset := false
-									if strings.Contains(cleanQuery, "@reset") {
-										cleanQuery = strings.ReplaceAll(cleanQuery, "@reset", "")
-										reset = true
-									}
-									if strings.Contains(cleanQuery, "@reload") {
-										cleanQuery = strings.ReplaceAll(cleanQuery, "@reload", "")
-										reload = true
-									}
-									prompt, text := FindPrompt(settings, llm, from_channel, user, cleanQuery)
-									text = strings.Replace(text, "{NICK}", settings.Nick, -1)
-									text = strings.Replace(text, "{USER}", user, -1)
-									text = strings.Replace(text, "{CHANNEL}", from_channel, -1)
-									text = strings.Replace(text, "{VERSION}", "2.0", -1)
-									text = strings.Replace(text, "{BACKLOG}", strings.Join(channel.Backlog, "\n"), -1)
-									req := DeepseekRequest{
-										Channel:       from_channel,
-										Server:        settings.Name,
-										sysprompt:     text,
-										request:       cleanQuery,
-										reload:        reload,
-										reset:         reset,
-										OriginalQuery: cleanQuery,
-										User:          user,
-									}
-									DeepseekQueue <- req
-									log.Printf("Deepseek query [%s]:\n%v\n", prompt, req)
-								}
-							} else {
-								prompt, _ := FindPrompt(settings, llm, from_channel, user, query)
-								if len(prompt) == 0 || !mention { //|| strings.HasSuffix(prompt, "/default") {
-									log.Printf("Skipping LLM query due to null prompt and no mention.")
-								} else {
-									prompt, text := FindPrompt(settings, llm, from_channel, user, query)
-									text = strings.Replace(text, "{NICK}", settings.Nick, -1)
-									text = strings.Replace(text, "{USER}", user, -1)
-									text = strings.Replace(text, "{CHANNEL}", from_channel, -1)
-									text = strings.Replace(text, "{VERSION}", "2.0", -1)
-									text = strings.Replace(text, "{BACKLOG}", strings.Join(channel.Backlog, "\n"), -1)
-
-									req := DeepseekRequest{
-										Channel:       from_channel,
-										Server:        settings.Name,
-										sysprompt:     text,
-										request:       query,
-										reload:        false,
-										reset:         false,
-										OriginalQuery: query,
-										User:          user,
-									}
-									DeepseekQueue <- req
-									log.Printf("Deepseek query [%s]:\n%v\n", prompt, req)
-								}
-							}
+/* Channel and private messages: commands, CTF, regex challenge and LLM queries. */
+func handlePrivmsg(settings *ServerConfig, msg *IRCMessage) {
+	from_channel := ""
+	target := msg.Param(0)
+	query := msg.Trailing()
+	user := msg.Nick()
+	/* Handle messages from Discord bridge bots by stripping the <username> prefix. */
+	user, query = BridgeUser(query, user, msg.Account(), settings)
+
+	llm := ""
+	var channel *ChannelConfig
+
+	for i := range settings.Channels {
+		ch := &settings.Channels[i]
+		if strings.EqualFold(ch.Name, target) {
+			channel = ch
+			from_channel = ch.Name
+			privmsg := fmt.Sprintf("[>][%s/%s] <%s> %s\n", settings.Host, ch.Name, user, query)
+			select {
+			case InteractQueue <- privmsg:
+			default:
+			}
+			log.Print(privmsg)
+			if CheckSpam(settings, ch.Name, msg) {
+				return
+			}
+			ClassifyMessage(settings, ch.Name, msg)
+			llm = ch.LLM
+			if len(ch.Backlog) > 10 {
+				ch.Backlog = ch.Backlog[1:]
+			}
+			ch.Backlog = append(ch.Backlog, fmt.Sprintf("<%s> %s", user, query))
+			break
+		}
+	}
+	account := msg.Account()
+	relayed := !strings.EqualFold(user, msg.Nick())
+	if relayed {
+		/* Relayed, the account belongs to the bridge bot. */
+		account = ""
+	}
+	if channel != nil {
+		if strings.HasPrefix(query, `"`) && strings.HasSuffix(query, `"`) {
+			log.Printf("Debug: query has double quotes:[%s]\n", query)
+			go CheckRegexChallenge(settings.Name, from_channel, user, strings.Trim(query, `"`))
+		} else {
+			log.Printf("Debug: query has NO double quotes:[%s]\n", query)
+		}
+		if strings.HasPrefix(query, "!") {
+			ctx := &CommandContext{Settings: settings, Msg: msg, Channel: from_channel, User: user, Account: account, Relayed: relayed}
+			if DispatchCommand(ctx, query) {
+				return
+			}
+		}
+		if strings.Contains(query, "@@") {
+			query = ParsePreferences(settings.Name, from_channel, user, query)
+		}
+
+	} else if strings.EqualFold(settings.Nick, target) {
+		handlePM(settings, msg, user, account, relayed, query)
+		return
+	}
+	if channel != nil && settings.FindLLM(llm) != nil {
+		mention := mentioned(settings.Nick, query)
+		if mention {
+			/* Skuzzy mentioned, process the command. */
+			log.Printf("Mentioned!\n")
+			query = strings.TrimLeft(query, "~")
+
+			nickPattern := `(?i)^` + regexp.QuoteMeta(settings.Nick) + `[:, ]*`
+			r, _ := regexp.Compile(nickPattern)
+			cleanQuery := r.ReplaceAllString(query, "")
+			first_word := strings.Split(query, " ")[0]
+			if strings.HasPrefix(first_word, "http://") || strings.HasPrefix(first_word, "https://") {
+				httpBody := HttpGetHead(first_word)
+				if len(httpBody) > 2 {
+					query = httpBody
+					cleanQuery = httpBody
+					log.Printf("Using http body from url %s:\n---\n%s\n---\n", first_word, httpBody)
+				}
+			}
+			if rListReminders.MatchString(cleanQuery) {
+				/* List reminders. */
+				send_irc(settings.Name, from_channel, ListReminders(settings, user))
+				log.Printf("Deepseek reminder listing query:\n%v\n", cleanQuery)
+			} else if rDeleteReminder.MatchString(cleanQuery) {
+				/* Delete a reminder. */
+				matches := rDeleteReminder.FindStringSubmatch(cleanQuery)
+				if len(matches) > 2 {
+					id, err := strconv.Atoi(matches[2])
+					if err == nil {
+						send_irc(settings.Name, from_channel, DeleteReminder(settings,
+							user, id))
+						log.Printf("%s requested to delete reminder ID %d", user, id)
+					}
+				}
+			} else if rChangeReminder.MatchString(cleanQuery) {
+				/* Change reminder. */
+				matches := rChangeReminder.FindStringSubmatch(cleanQuery)
+				if len(matches) > 3 {
+					id, err := strconv.Atoi(matches[2])
+					newDetails := matches[3]
+					if err == nil {
+						req := DeepseekRequest{
+							Channel:       from_channel,
+							Server:        settings.Name,
+							request:       fmt.Sprintf("Reminder ID: %d, Details: %s", id, newDetails),
+							PromptName:    "reminder_change_parse",
+							OriginalQuery: cleanQuery,
+							User:          user,
+							LLM:           llm,
 						}
+						DeepseekQueue(req.Server) <- req
+						log.Printf("%s requested to change reminder ID %d with details: %s",
+							user, id, newDetails)
 					}
 				}
+			} else if rReminder.MatchString(cleanQuery) {
+				req := DeepseekRequest{
+					Channel:       from_channel,
+					Server:        settings.Name,
+					request:       cleanQuery,
+					PromptName:    "reminder_parse",
+					OriginalQuery: cleanQuery,
+					User:          user,
+					LLM:           llm,
+				}
+				DeepseekQueue(req.Server) <- req
+				log.Printf("Deepseek reminder parsing query:\n%v\n", req)
+			} else {
+				/* Handle other commands like @reset, @reload, or default chat. */
+				reload := false
+				reset := false
+				if strings.Contains(cleanQuery, "@reset") {
+					cleanQuery = strings.ReplaceAll(cleanQuery, "@reset", "")
+					reset = true
+				}
+				if strings.Contains(cleanQuery, "@reload") {
+					cleanQuery = strings.ReplaceAll(cleanQuery, "@reload", "")
+					reload = true
+				}
+				prompt, text := FindPrompt(settings, llm, from_channel, user, cleanQuery)
+				text = strings.Replace(text, "{NICK}", settings.Nick, -1)
+				text = strings.Replace(text, "{USER}", user, -1)
+				text = strings.Replace(text, "{CHANNEL}", from_channel, -1)
+				text = strings.Replace(text, "{VERSION}", "2.0", -1)
+				text = strings.Replace(text, "{BACKLOG}", strings.Join(channel.Backlog, "\n"), -1)
+				req := DeepseekRequest{
+					Channel:       from_channel,
+					Server:        settings.Name,
+					sysprompt:     text,
+					request:       cleanQuery,
+					reload:        reload,
+					reset:         reset,
+					OriginalQuery: cleanQuery,
+					User:          user,
+					LLM:           llm,
+				}
+				DeepseekQueue(req.Server) <- req
+				log.Printf("Deepseek query [%s]:\n%v\n", prompt, req)
+			}
+		} else {
+			prompt, _ := FindPrompt(settings, llm, from_channel, user, query)
+			if len(prompt) == 0 || !mention { //|| strings.HasSuffix(prompt, "/default") {
+				log.Printf("Skipping LLM query due to null prompt and no mention.")
+			} else {
+				prompt, text := FindPrompt(settings, llm, from_channel, user, query)
+				text = strings.Replace(text, "{NICK}", settings.Nick, -1)
+				text = strings.Replace(text, "{USER}", user, -1)
+				text = strings.Replace(text, "{CHANNEL}", from_channel, -1)
+				text = strings.Replace(text, "{VERSION}", "2.0", -1)
+				text = strings.Replace(text, "{BACKLOG}", strings.Join(channel.Backlog, "\n"), -1)
+
+				req := DeepseekRequest{
+					Channel:       from_channel,
+					Server:        settings.Name,
+					sysprompt:     text,
+					request:       query,
+					reload:        false,
+					reset:         false,
+					OriginalQuery: query,
+					User:          user,
+					LLM:           llm,
+				}
+				DeepseekQueue(req.Server) <- req
+				log.Printf("Deepseek query [%s]:\n%v\n", prompt, req)
 			}
-
-		}
-		if breakout {
-			break
 		}
 	}
 }
 
 func FindPrompt(settings *ServerConfig, llm string, from_channel string, user string, query string) (string, string) {
 
-	if strings.EqualFold(llm, "deepseek") {
-		return FindPromptDeepseek(settings, from_channel, user, query)
+	if settings.FindLLM(llm) != nil {
+		return FindChannelPrompt(settings, from_channel, user, query)
 	}
 
 	return "", ""
@@ -507,105 +539,133 @@ func ParsePreferences(server, channel, user, query string) string {
 
 var rBridge = regexp.MustCompile(`^<([^>]+)>.*$`)
 
-func BridgeUser(query, user string, settings *ServerConfig) (string, string) {
+/*
+ * Messages relayed by a bot in RelayBots are attributed to the <username> they carry.
+ * The relay bot is recognised by its services account when account-tag is
+ * available, since nicks can be spoofed; otherwise by nick.
+ */
+func BridgeUser(query, user, account string, settings *ServerConfig) (string, string) {
+	sender := user
+	if account != "" {
+		sender = account
+	}
+	relayed := false
+	for _, relay_bot := range settings.RelayBots {
+		if strings.EqualFold(sender, relay_bot) {
+			relayed = true
+			break
+		}
+	}
+	if !relayed {
+		return user, query
+	}
 	matches := rBridge.FindAllStringSubmatch(query, -1)
 	log.Printf("[BridgeUser] Debug:%s\n", query)
 	for _, match := range matches {
 		log.Printf("[BridgeUser] Found [%s]:%s\n", match[1], match[0])
-		for _, relay_bot := range settings.RelayBots {
-			if strings.EqualFold(match[1], relay_bot) {
-				return match[1], strings.TrimSpace(strings.Replace(query, "<"+match[1]+">", "", -1))
-			}
-		}
-
+		return match[1], strings.TrimSpace(strings.Replace(query, "<"+match[1]+">", "", -1))
 	}
 
 	return user, query
 
 }
 
-func reloadCTFConfig(settings *ServerConfig) {
+/* The CTF config of a server, nil without one or while it isn't connected. */
+func ServerCTF(server string) *CTFConfig {
+	ConnectionsMutex.RLock()
+	defer ConnectionsMutex.RUnlock()
+	if conn, ok := Connections[server]; ok {
+		return conn.CTF
+	}
+	return nil
+}
+
+/* Load the CTF config again and swap it in whole, the old one stays if the new one doesn't load. */
+func reloadCTFConfig(settings *ServerConfig) error {
 	ctfconfig, err := LoadCTFConfig(settings.CtfConfigPath)
-	if err == nil {
-		cx := Connections[settings.Name]
-		cx.CTF = ctfconfig
-		Connections[settings.Name] = cx
-	} else {
+	if err != nil {
 		log.Printf("[reloadCTFConfig] Error reloading CTF config:%v\n", err)
+		return err
 	}
+	ConnectionsMutex.Lock()
+	cx, ok := Connections[settings.Name]
+	if !ok {
+		/* Torn down meanwhile, the next connection loads the config anyway. */
+		ConnectionsMutex.Unlock()
+		return fmt.Errorf("not connected to %s", settings.Name)
+	}
+	cx.CTF = ctfconfig
+	Connections[settings.Name] = cx
+	ConnectionsMutex.Unlock()
+	ScheduleCTFEvent(settings.Name, ctfconfig)
+	return nil
 }
 
-func handlePM(settings *ServerConfig, user, query string) {
-
-	if strings.HasSuffix(query, "help") {
-		sendHelp(settings, user, user)
-	} else if strings.HasSuffix(query, "topic") {
-		sendTopicHelp(settings, user, user)
+/* Pick up changes made to the CTF config file by hand. */
+func reloadCTFConfigIfChanged(settings *ServerConfig) {
+	if settings.CtfConfigPath == "" {
+		return
+	}
+	info, err := os.Stat(settings.CtfConfigPath)
+	if err != nil {
+		return
+	}
+	ctfconfig := ServerCTF(settings.Name)
+	if ctfconfig != nil && info.ModTime().Equal(ctfconfig.modified) {
+		return
 	}
 	reloadCTFConfig(settings)
+}
 
-	if Connections[settings.Name].CTF != nil {
-		for k, ctf := range Connections[settings.Name].CTF.CTFFlags {
-			if strings.EqualFold(query, ctf.Flag) {
-				CTFSolved(settings, k, ctf, user)
-				solve_message := fmt.Sprintf("Congrats to %s on finding the flag for '%s'!! 🎉🎉🎉. New level:%d",
-					user, k, ctf.Level)
-				send_irc(settings.Name, ctf.Channel, solve_message)
-			}
-			for hintname, hint := range ctf.Hints {
-				if strings.EqualFold("!"+hintname, query) || strings.EqualFold(hintname, query) {
-					send_irc(settings.Name, user, hint)
-					CTFHintTaken(settings, ctf, user)
-				}
-			}
-			if (strings.EqualFold(k, query) || strings.EqualFold("!"+k, query)) && len(ctf.Description) > 0 {
-				send_irc(settings.Name, user, ctf.Description)
-			}
-		}
+func handlePM(settings *ServerConfig, msg *IRCMessage, user, account string, relayed bool, query string) {
+	reloadCTFConfigIfChanged(settings)
+	ctx := &CommandContext{Settings: settings, Msg: msg, User: user, Account: account, Relayed: relayed}
+
+	/* In private the leading '!' of commands is optional. */
+	if DispatchCommand(ctx, query) {
+		return
 	}
+	QueueFlagSubmission(settings, msg, user, account, query)
 }
 
+/* Post a channel's scoreboard, as it was at the freeze while an event is frozen. */
 func SendCTFScores(server, channel string) {
-	ctfscores := CTFScores(server, channel)
+	ctfconfig := ServerCTF(server)
+	if ctfconfig == nil {
+		return
+	}
+	frozen := ctfconfig.Event.FrozenAt(time.Now())
 	response := "CTF Scores for " + channel + ": "
-	for user, score_msg := range ctfscores {
-		response = fmt.Sprintf("%s | %s: %s |", response, user, score_msg)
+	if frozen > 0 {
+		response = "CTF Scores for " + channel + " (frozen): "
 	}
-	send_irc(server, channel, response)
+	send_irc(server, channel, response+FormatStandings(CTFScores(server, channel, ctfconfig, frozen), 10))
 }
+
+/* The current standings, frozen or not, sent privately to an admin. */
+func SendLiveCTFScores(server, channel, user string) {
+	ctfconfig := ServerCTF(server)
+	if ctfconfig == nil {
+		return
+	}
+	send_irc(server, user, "Live CTF Scores for "+channel+": "+FormatStandings(CTFScores(server, channel, ctfconfig, 0), 20))
+}
+
 func sendHelp(settings *ServerConfig, target, user string) {
 	send_irc(settings.Name, target, target+", Check your private messages. Sending you my usage instructions.")
 
-	for _, v := range strings.Split(Help, "\n") {
-		send_irc(settings.Name, user, v)
-		time.Sleep(1 * time.Second)
+	channel := ""
+	if !strings.EqualFold(target, user) {
+		channel = target
+	}
+	for _, v := range strings.Split(HelpText(settings, channel), "\n") {
+		send_irc_priority(settings.Name, user, v, PriorityLow)
 	}
 }
 
 func sendTopicHelp(settings *ServerConfig, target, user string) {
 	send_irc(settings.Name, target, target+", Check your private messages. Sending you help about the topic CTF challenge.")
 	for _, v := range strings.Split(TopicHelp, "\n") {
-		send_irc(settings.Name, user, v)
-		time.Sleep(1 * time.Second)
-	}
-}
-
-func HandleQuietRequest(server, channel, user, target string) {
-	// we should really have a channel-specific feature flag-check here
-	// but for now any user that has a > 0 level can quiet anywhere
-	log.Printf("[HandleQuietRequest] %s asking to quiet '%s' in %s/%s", user, target, server, channel)
-	level := CTFUserLevel(server, channel, user)
-	if level > 0 {
-		send_irc(server, "ChanServ", fmt.Sprintf("QUIET %s %s", channel, target))
-	}
-}
-
-func HandleUnquietRequest(server, channel, user, target string) {
-	// we should really have a channel-specific feature flag-check here
-	// but for now any user that has a > 0 level can quiet anywhere
-	log.Printf("[HandleQuietRequest] %s asking to quiet '%s' in %s/%s", user, target, server, channel)
-	level := CTFUserLevel(server, channel, user)
-	if level > 0 {
-		send_irc(server, "ChanServ", fmt.Sprintf("UNQUIET %s %s", channel, target))
+		send_irc_priority(settings.Name, user, v, PriorityLow)
 	}
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+/* A single parsed IRC protocol line (RFC 1459 with IRCv3 message tags). */
+type IRCMessage struct {
+	Tags    map[string]string
+	Prefix  string /* nick!user@host or server name, without the leading ':' */
+	Command string /* Upper-cased command or three digit numeric. */
+	Params  []string
+}
+
+var ErrEmptyMessage = errors.New("empty IRC message")
+var ErrNoCommand = errors.New("IRC message has no command")
+
+/* Parse one line, with or without the trailing CRLF. */
+func ParseIRCMessage(line string) (*IRCMessage, error) {
+	line = strings.TrimRight(line, "\r\n")
+	msg := &IRCMessage{}
+	if len(strings.TrimSpace(line)) < 1 {
+		return nil, ErrEmptyMessage
+	}
+
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line, _ = strings.Cut(line[1:], " ")
+		msg.Tags = parseTags(tags)
+		line = strings.TrimLeft(line, " ")
+	}
+
+	if strings.HasPrefix(line, ":") {
+		msg.Prefix, line, _ = strings.Cut(line[1:], " ")
+		line = strings.TrimLeft(line, " ")
+	}
+
+	var command string
+	command, line, _ = strings.Cut(line, " ")
+	if command == "" {
+		return nil, ErrNoCommand
+	}
+	msg.Command = strings.ToUpper(command)
+
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		if len(line) < 1 {
+			break
+		}
+		if strings.HasPrefix(line, ":") {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		msg.Params = append(msg.Params, param)
+	}
+	return msg, nil
+}
+
+func parseTags(tags string) map[string]string {
+	parsed := make(map[string]string)
+	for _, tag := range strings.Split(tags, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(tag, "=")
+		parsed[key] = unescapeTagValue(value)
+	}
+	return parsed
+}
+
+/* Undo IRCv3 tag value escaping; unknown escapes drop the backslash, as does a lone trailing one. */
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i >= len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			unescaped.WriteByte(';')
+		case 's':
+			unescaped.WriteByte(' ')
+		case 'r':
+			unescaped.WriteByte('\r')
+		case 'n':
+			unescaped.WriteByte('\n')
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+	return unescaped.String()
+}
+
+/* The i-th parameter, or "" if there aren't that many. */
+func (msg *IRCMessage) Param(i int) string {
+	if i < 0 || i >= len(msg.Params) {
+		return ""
+	}
+	return msg.Params[i]
+}
+
+/* The last parameter, which is where the text of PRIVMSG, NOTICE, etc. ends up. */
+func (msg *IRCMessage) Trailing() string {
+	if len(msg.Params) < 1 {
+		return ""
+	}
+	return msg.Params[len(msg.Params)-1]
+}
+
+/* The nick part of the prefix, or the whole prefix for server messages. */
+func (msg *IRCMessage) Nick() string {
+	nick, _, _ := strings.Cut(msg.Prefix, "!")
+	nick, _, _ = strings.Cut(nick, "@")
+	return nick
+}
+
+/* The user@host part of the prefix, if any. */
+func (msg *IRCMessage) Hostmask() string {
+	if _, mask, ok := strings.Cut(msg.Prefix, "!"); ok {
+		return mask
+	}
+	if _, host, ok := strings.Cut(msg.Prefix, "@"); ok {
+		return "@" + host
+	}
+	return ""
+}
+
+func (msg *IRCMessage) Tag(key string) (string, bool) {
+	value, ok := msg.Tags[key]
+	return value, ok
+}
+
+/* Three digit numeric replies. */
+func (msg *IRCMessage) IsNumeric() bool {
+	if len(msg.Command) != 3 {
+		return false
+	}
+	for _, c := range msg.Command {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+/* Maximum accepted line: 8191 bytes of tags plus a 512 byte message. */
+const maxIRCLine = 8191 + 512
+
+/*
+ * Splits the connection's byte stream into lines. Partial lines are kept
+ * across read timeouts instead of being dropped, and oversized lines are discarded.
+ */
+type IRCReader struct {
+	reader     *bufio.Reader
+	partial    []byte
+	discarding bool
+}
+
+func NewIRCReader(r io.Reader) *IRCReader {
+	return &IRCReader{reader: bufio.NewReaderSize(r, 4096)}
+}
+
+/* The next complete line without CRLF. Timeouts are returned as-is and the read may be retried. */
+func (r *IRCReader) ReadLine() (string, error) {
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if !r.discarding {
+			r.partial = append(r.partial, chunk...)
+		}
+		if len(r.partial) > maxIRCLine {
+			r.partial = r.partial[:0]
+			r.discarding = true
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				r.partial = r.partial[:0]
+				r.discarding = false
+			}
+			return "", err
+		}
+		if r.discarding {
+			r.discarding = false
+			continue
+		}
+		line := string(bytes.TrimRight(r.partial, "\r\n"))
+		r.partial = r.partial[:0]
+		return strings.ToValidUTF8(line, "\uFFFD"), nil
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	deepseek "github.com/cohesion-org/deepseek-go"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* A chat-completion backend: takes the conversation, returns the reply text. */
+type LLMProvider interface {
+	ChatCompletion(ctx context.Context, messages []deepseek.ChatCompletionMessage) (string, error)
+}
+
+/* Build the provider for an entry of the `llms:` config block. */
+func NewLLMProvider(settings *ServerConfig, llm LLM) (LLMProvider, error) {
+	switch strings.ToLower(llm.Type) {
+	case "deepseek":
+		return NewDeepseekProvider(settings, llm)
+	case "openai", "openai-compatible":
+		return NewOpenAIProvider(llm)
+	case "ollama":
+		return NewOllamaProvider(llm), nil
+	}
+	return nil, fmt.Errorf("unsupported LLM type '%s' for %s", llm.Type, llm.Name)
+}
+
+/* Find an LLM entry by name, as referenced by ChannelConfig.LLM. */
+func (settings *ServerConfig) FindLLM(name string) *LLM {
+	for i := range settings.LLMS {
+		if strings.EqualFold(settings.LLMS[i].Name, name) {
+			return &settings.LLMS[i]
+		}
+	}
+	return nil
+}
+
+/* The LLM name configured for a channel, or the first configured LLM if the channel has none. */
+func ChannelLLM(settings *ServerConfig, channel string) string {
+	for _, ch := range settings.Channels {
+		if strings.EqualFold(ch.Name, channel) && ch.LLM != "" {
+			return ch.LLM
+		}
+	}
+	if len(settings.LLMS) > 0 {
+		return settings.LLMS[0].Name
+	}
+	return ""
+}
+
+type DeepseekProvider struct {
+	client *deepseek.Client
+	model  string
+}
+
+func NewDeepseekProvider(settings *ServerConfig, llm LLM) (*DeepseekProvider, error) {
+	model := llm.Model
+	switch llm.Model {
+	case "deepseekchat":
+		model = deepseek.DeepSeekChat
+	case "deepseekreasoner":
+		model = deepseek.DeepSeekReasoner
+	}
+	key := llm.APIKey
+	if key == "" {
+		key = settings.DeepseekAPIKey
+	}
+	opts := []deepseek.Option{}
+	if llm.URL != "" {
+		opts = append(opts, deepseek.WithBaseURL(llm.URL))
+	}
+	client, err := deepseek.NewClientWithOptions(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DeepseekProvider{client, model}, nil
+}
+
+func (p *DeepseekProvider) ChatCompletion(ctx context.Context, messages []deepseek.ChatCompletionMessage) (string, error) {
+	request := &deepseek.ChatCompletionRequest{
+		Model:    p.model,
+		Messages: messages,
+	}
+	response, err := p.client.CreateChatCompletion(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	if len(response.Choices) < 1 {
+		return "", fmt.Errorf("empty chat completion response")
+	}
+	return response.Choices[0].Message.Content, nil
+}
+
+/*
+ * OpenAI-compatible endpoints speak the same chat/completions protocol as Deepseek,
+ * so the Deepseek client is reused with a different base URL.
+ */
+type OpenAIProvider struct {
+	DeepseekProvider
+}
+
+func NewOpenAIProvider(llm LLM) (*OpenAIProvider, error) {
+	url := llm.URL
+	if url == "" {
+		url = "https://api.openai.com/v1/"
+	}
+	if !strings.HasSuffix(url, "/") {
+		url = url + "/"
+	}
+	/* Local servers often don't check the key, but the client refuses an empty one. */
+	key := llm.APIKey
+	if key == "" {
+		key = "none"
+	}
+	client, err := deepseek.NewClientWithOptions(key, deepseek.WithBaseURL(url))
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAIProvider{DeepseekProvider{client, llm.Model}}, nil
+}
+
+type OllamaProvider struct {
+	url    string
+	model  string
+	client *http.Client
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+}
+
+type ollamaChatResponse struct {
+	Message ollamaMessage `json:"message"`
+	Error   string        `json:"error,omitempty"`
+}
+
+func NewOllamaProvider(llm LLM) *OllamaProvider {
+	url := llm.URL
+	if url == "" {
+		url = "http://localhost:11434"
+	}
+	return &OllamaProvider{
+		url:    strings.TrimSuffix(url, "/"),
+		model:  llm.Model,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (p *OllamaProvider) ChatCompletion(ctx context.Context, messages []deepseek.ChatCompletionMessage) (string, error) {
+	request := ollamaChatRequest{Model: p.model, Stream: false}
+	for _, m := range messages {
+		request.Messages = append(request.Messages, ollamaMessage{m.Role, m.Content})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	response, err := p.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	var chat ollamaChatResponse
+	if err := json.Unmarshal(data, &chat); err != nil {
+		return "", fmt.Errorf("bad ollama response (%s): %w", response.Status, err)
+	}
+	if response.StatusCode != http.StatusOK || chat.Error != "" {
+		return "", fmt.Errorf("ollama returned %s: %s", response.Status, chat.Error)
+	}
+	return chat.Message.Content, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModKick    = "kick"
+	ModBan     = "ban"
+	ModUnban   = "unban"
+	ModQuiet   = "quiet"
+	ModUnquiet = "unquiet"
+	ModVoice   = "voice"
+	ModDevoice = "devoice"
+)
+
+/* Timed bans and quiets are never longer than this. */
+var maxModDuration = 90 * 24 * time.Hour
+
+/* A timed ban or quiet waiting to be lifted. */
+type ModExpiry struct {
+	ID      int
+	Server  string
+	Channel string
+	Mask    string
+	Action  string /* ModBan or ModQuiet. */
+	EndTime time.Time
+}
+
+var (
+	ModExpiryMutex = sync.Mutex{}
+	modTimers      = make(map[int]*time.Timer)
+)
+
+/*
+ * Parse a moderation duration such as 30m, 2h, 1d or 1w (Go durations also work).
+ * Returns false if s doesn't look like a duration, so it can be taken as the reason.
+ */
+func ParseModDuration(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	unit := s[len(s)-1]
+	if n, err := strconv.Atoi(s[:len(s)-1]); err == nil && n > 0 {
+		switch unit {
+		case 'd':
+			return time.Duration(n) * 24 * time.Hour, true
+		case 'w':
+			return time.Duration(n) * 7 * 24 * time.Hour, true
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+/*
+ * The mask to ban or quiet for target. Masks and extbans are used as they are,
+ * a nick we can see becomes *!*@host, anything else nick!*@*.
+ */
+func BanMask(server, target string) string {
+	if strings.ContainsAny(target, "!@*?$") {
+		return target
+	}
+	if user, ok := LookupUser(server, target); ok && user.Host != "" {
+		return "*!*@" + user.Host
+	}
+	return target + "!*@*"
+}
+
+/* Whether to use MODE/KICK ourselves instead of asking ChanServ. */
+func directModes(settings *ServerConfig, channel string) bool {
+	ch := settings.FindChannel(channel)
+	if ch == nil || !strings.EqualFold(ch.Moderation, "mode") {
+		return false
+	}
+	if !IsChannelOp(settings.Name, channel, settings.Nick) {
+		log.Printf("[Moderate] Not opped in %s/%s, falling back to ChanServ\n", settings.Name, channel)
+		return false
+	}
+	return true
+}
+
+/*
+ * Carry out a moderation action in channel on behalf of actor and log it.
+ * Bans and quiets with a duration are lifted automatically when it runs out.
+ * Returns a message for the actor.
+ */
+func Moderate(settings *ServerConfig, channel, actor, action, target string, duration time.Duration, reason string) string {
+	server := settings.Name
+	ConnectionsMutex.RLock()
+	conn, ok := Connections[server]
+	ConnectionsMutex.RUnlock()
+	if !ok {
+		return "Not connected to " + server + "."
+	}
+	if duration > maxModDuration {
+		duration = maxModDuration
+	}
+	mode := directModes(settings, channel)
+	mask := target
+	switch action {
+	case ModBan, ModUnban, ModQuiet, ModUnquiet:
+		mask = BanMask(server, target)
+	}
+	if reason == "" {
+		reason = "Requested by " + actor
+	}
+
+	switch action {
+	case ModKick:
+		if mode {
+			send_irc_raw(conn, fmt.Sprintf("KICK %s %s :%s\r\n", channel, target, reason))
+		} else {
+			send_irc(server, "ChanServ", fmt.Sprintf("KICK %s %s %s", channel, target, reason))
+		}
+	case ModBan, ModUnban, ModQuiet, ModUnquiet, ModVoice, ModDevoice:
+		if mode {
+			send_irc_raw(conn, fmt.Sprintf("MODE %s %s %s\r\n", channel, modeChange(action), mask))
+		} else {
+			send_irc(server, "ChanServ", fmt.Sprintf("%s %s %s", strings.ToUpper(action), channel, mask))
+		}
+	default:
+		return "Unknown moderation action " + action + "."
+	}
+
+	switch action {
+	case ModBan, ModQuiet:
+		if duration > 0 {
+			AddModExpiry(settings, &ModExpiry{Server: server, Channel: channel, Mask: mask, Action: action,
+				EndTime: time.Now().Add(duration)})
+		}
+	case ModUnban:
+		CancelModExpiries(server, channel, mask, ModBan)
+	case ModUnquiet:
+		CancelModExpiries(server, channel, mask, ModQuiet)
+	}
+	LogModeration(server, channel, actor, action, target, mask, reason, duration)
+
+	done := fmt.Sprintf("%s: %s %s in %s", actor, action, mask, channel)
+	if duration > 0 {
+		done += " for " + formatDuration(duration)
+	}
+	return done + "."
+}
+
+func modeChange(action string) string {
+	switch action {
+	case ModBan:
+		return "+b"
+	case ModUnban:
+		return "-b"
+	case ModQuiet:
+		return "+q"
+	case ModUnquiet:
+		return "-q"
+	case ModVoice:
+		return "+v"
+	case ModDevoice:
+		return "-v"
+	}
+	return ""
+}
+
+func LogModeration(server, channel, actor, action, target, mask, reason string, duration time.Duration) {
+	_, err := DB.Exec("INSERT INTO moderation_log (server, channel, actor, action, target, mask, reason, duration, created) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", strings.ToLower(server), strings.ToLower(channel), actor, action, target,
+		mask, reason, int64(duration.Seconds()), time.Now().Unix())
+	if err != nil {
+		log.Printf("[LogModeration] Error logging %s of %s in %s/%s: %v\n", action, target, server, channel, err)
+	}
+}
+
+/* The last count moderation log entries for channel, newest first. */
+func ModerationLog(server, channel string, count int) []string {
+	rows, err := DB.Query("SELECT actor, action, target, mask, reason, duration, created FROM moderation_log "+
+		"WHERE server = ? AND channel = ? ORDER BY id DESC LIMIT ?", strings.ToLower(server), strings.ToLower(channel), count)
+	if err != nil {
+		log.Printf("[ModerationLog] Error reading the log for %s/%s: %v\n", server, channel, err)
+		return nil
+	}
+	defer rows.Close()
+	var entries []string
+	for rows.Next() {
+		var actor, action, target, mask, reason string
+		var duration, created int64
+		if err := rows.Scan(&actor, &action, &target, &mask, &reason, &duration, &created); err != nil {
+			log.Printf("[ModerationLog] Error scanning row: %v\n", err)
+			continue
+		}
+		entry := fmt.Sprintf("%s %s: %s %s (%s)", time.Unix(created, 0).UTC().Format("2006-01-02 15:04"), actor, action, mask, reason)
+		if duration > 0 {
+			entry += " for " + formatDuration(time.Duration(duration)*time.Second)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+/* Store a timed ban or quiet and schedule lifting it. */
+func AddModExpiry(settings *ServerConfig, e *ModExpiry) {
+	ModExpiryMutex.Lock()
+	defer ModExpiryMutex.Unlock()
+	result, err := DB.Exec("INSERT INTO mod_expiries (server, channel, mask, action, end_time) VALUES (?, ?, ?, ?, ?)",
+		e.Server, e.Channel, e.Mask, e.Action, e.EndTime.Unix())
+	if err != nil {
+		log.Printf("[AddModExpiry] Error storing the expiry of %s %s: %v\n", e.Action, e.Mask, err)
+		return
+	}
+	id, _ := result.LastInsertId()
+	e.ID = int(id)
+	scheduleModExpiry(settings, e)
+}
+
+/* Forget pending expiries for a mask that was lifted by hand. */
+func CancelModExpiries(server, channel, mask, action string) {
+	ModExpiryMutex.Lock()
+	defer ModExpiryMutex.Unlock()
+	rows, err := DB.Query("SELECT id FROM mod_expiries WHERE server = ? AND channel = ? COLLATE NOCASE AND mask = ? AND action = ?",
+		server, channel, mask, action)
+	if err != nil {
+		log.Printf("[CancelModExpiries] Error: %v\n", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		removeModExpiry(id)
+	}
+}
+
+/* Called with ModExpiryMutex held. */
+func scheduleModExpiry(settings *ServerConfig, e *ModExpiry) {
+	if timer, ok := modTimers[e.ID]; ok {
+		timer.Stop()
+	}
+	modTimers[e.ID] = time.AfterFunc(time.Until(e.EndTime), func() {
+		fireModExpiry(settings, e)
+	})
+}
+
+/* Called with ModExpiryMutex held. */
+func removeModExpiry(id int) {
+	if timer, ok := modTimers[id]; ok {
+		timer.Stop()
+		delete(modTimers, id)
+	}
+	if _, err := DB.Exec("DELETE FROM mod_expiries WHERE id = ?", id); err != nil {
+		log.Printf("[removeModExpiry] Error deleting expiry %d: %v\n", id, err)
+	}
+}
+
+/* Lift an expired ban or quiet, or try again later while we're not connected. */
+func fireModExpiry(settings *ServerConfig, e *ModExpiry) {
+	if sup := FindSupervisor(e.Server); sup == nil || sup.State() != StateConnected {
+		ModExpiryMutex.Lock()
+		e.EndTime = time.Now().Add(time.Minute)
+		scheduleModExpiry(settings, e)
+		ModExpiryMutex.Unlock()
+		return
+	}
+	ModExpiryMutex.Lock()
+	removeModExpiry(e.ID)
+	ModExpiryMutex.Unlock()
+
+	lift := ModUnban
+	if e.Action == ModQuiet {
+		lift = ModUnquiet
+	}
+	log.Printf("[fireModExpiry] %s of %s in %s/%s expired\n", e.Action, e.Mask, e.Server, e.Channel)
+	Moderate(settings, e.Channel, settings.Nick, lift, e.Mask, 0, "Expired")
+}
+
+/* Schedule the timed bans and quiets stored for a server. Ones already due are lifted once connected. */
+func LoadModExpiries(settings *ServerConfig) error {
+	rows, err := DB.Query("SELECT id, server, channel, mask, action, end_time FROM mod_expiries WHERE server = ?", settings.Name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to query moderation expiries: %w", err)
+	}
+	defer rows.Close()
+	ModExpiryMutex.Lock()
+	defer ModExpiryMutex.Unlock()
+	for rows.Next() {
+		var e ModExpiry
+		var endTimeUnix int64
+		if err := rows.Scan(&e.ID, &e.Server, &e.Channel, &e.Mask, &e.Action, &endTimeUnix); err != nil {
+			log.Printf("[LoadModExpiries] Error scanning row: %v\n", err)
+			continue
+		}
+		e.EndTime = time.Unix(endTimeUnix, 0)
+		log.Printf("[LoadModExpiries] %s of %s in %s expires in %v\n", e.Action, e.Mask, e.Channel, time.Until(e.EndTime).Round(time.Second))
+		scheduleModExpiry(settings, &e)
+	}
+	return nil
+}
+
+/* Handler for the moderation commands taking <nick|mask> [duration] [reason]. */
+func moderationCommand(action string, timed bool) func(ctx *CommandContext) {
+	return func(ctx *CommandContext) {
+		var duration time.Duration
+		rest := 1
+		if timed && len(ctx.Args) > 1 {
+			if d, ok := ParseModDuration(ctx.Args[1]); ok {
+				duration = d
+				rest = 2
+			}
+		}
+		reason := ctx.Rest(rest)
+		target := ctx.Args[0]
+		if strings.EqualFold(target, ctx.Settings.Nick) {
+			ctx.Reply("Nice try, " + ctx.User + ".")
+			return
+		}
+		if action == "kickban" {
+			ctx.Reply(Moderate(ctx.Settings, ctx.Channel, ctx.User, ModBan, target, duration, reason))
+			Moderate(ctx.Settings, ctx.Channel, ctx.User, ModKick, target, 0, reason)
+			return
+		}
+		ctx.Reply(Moderate(ctx.Settings, ctx.Channel, ctx.User, action, target, duration, reason))
+	}
+}
+
+func init() {
+	for _, c := range []struct {
+		action, syntax, description string
+		role                        Role
+		timed                       bool
+	}{
+		{ModQuiet, "<nick|mask> [duration] [reason]", "Quiet a user/mask, optionally for a while (e.g. 30m, 2h, 1d)", RoleTrusted, true},
+		{ModUnquiet, "<nick|mask>", "Remove a quiet", RoleTrusted, false},
+		{ModKick, "<nick> [reason]", "Kick a user", RoleOp, false},
+		{ModBan, "<nick|mask> [duration] [reason]", "Ban a user/mask, optionally for a while", RoleOp, true},
+		{"kickban", "<nick> [duration] [reason]", "Ban a user by host and kick them", RoleOp, true},
+		{ModUnban, "<nick|mask>", "Remove a ban", RoleOp, false},
+		{ModVoice, "<nick>", "Give a user voice", RoleOp, false},
+		{ModDevoice, "<nick>", "Take voice from a user", RoleOp, false},
+	} {
+		RegisterCommand(&Command{
+			Name:        c.action,
+			Syntax:      c.syntax,
+			Description: c.description,
+			Category:    "Moderation",
+			Channel:     true,
+			Role:        c.role,
+			MinArgs:     1,
+			Handler:     moderationCommand(c.action, c.timed),
+		})
+	}
+	RegisterCommand(&Command{
+		Name:        "modlog",
+		Syntax:      "[count]",
+		Description: "Show the latest moderation actions in the channel (sent privately)",
+		Category:    "Moderation",
+		Channel:     true,
+		Role:        RoleOp,
+		Handler: func(ctx *CommandContext) {
+			count := 5
+			if n, err := strconv.Atoi(ctx.Rest(0)); err == nil && n > 0 && n <= 50 {
+				count = n
+			}
+			entries := ModerationLog(ctx.Settings.Name, ctx.Channel, count)
+			if len(entries) == 0 {
+				entries = []string{"Nothing logged for " + ctx.Channel + "."}
+			}
+			for _, entry := range entries {
+				send_irc_priority(ctx.Settings.Name, ctx.User, entry, PriorityLow)
+			}
+		},
+	})
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+ * Onboarding into the community after solving the topic challenge. Solving
+ * one of the onboarding challenges queues the player for review and tells
+ * the ops in the staff channel. Once an op approves, the player is voiced,
+ * added to the channels' access lists, a cloak is requested for them and
+ * they can be granted a role. Every step is recorded with its time.
+ */
+type OnboardingConfig struct {
+	Challenges   []string `yaml:"challenges"`             /* Solving one of these queues the player for review. */
+	StaffChannel string   `yaml:"staff_channel"`          /* Where ops are told about new players to review. */
+	Channels     []string `yaml:"channels"`               /* Where approved players are voiced and added to the access list. */
+	AccessFlags  string   `yaml:"access_flags,omitempty"` /* ChanServ FLAGS given to their account, default +V. */
+	Cloak        string   `yaml:"cloak,omitempty"`        /* e.g. about/hackers/{account}, empty to not request one. */
+	CloakTarget  string   `yaml:"cloak_target,omitempty"` /* Nick or channel the cloak request is sent to. */
+	Role         string   `yaml:"role,omitempty"`         /* Role granted server-wide to their account, e.g. trusted. */
+	Welcome      string   `yaml:"welcome,omitempty"`      /* Sent to them once approved. */
+}
+
+const (
+	OnboardPending  = "pending"
+	OnboardApproved = "approved"
+	OnboardRejected = "rejected"
+)
+
+const defaultAccessFlags = "+V"
+
+/* A player's way through onboarding, times are 0 for the steps not taken. */
+type Onboarding struct {
+	ID             int64
+	User           string
+	Account        string
+	Challenge      string
+	Status         string
+	Reviewer       string
+	Note           string
+	Queued         int64
+	Notified       int64
+	Reviewed       int64
+	Voiced         int64
+	AccessAdded    int64
+	CloakRequested int64
+	RoleGranted    int64
+}
+
+/* Check the settings, so mistakes show up when the config is loaded. */
+func (onboarding *OnboardingConfig) Validate() error {
+	if len(onboarding.Challenges) == 0 {
+		return fmt.Errorf("no challenges")
+	}
+	if !strings.HasPrefix(onboarding.StaffChannel, "#") {
+		return fmt.Errorf("no staff_channel")
+	}
+	if onboarding.Role != "" {
+		if _, err := ParseRole(onboarding.Role); err != nil {
+			return err
+		}
+	}
+	if onboarding.Cloak != "" && onboarding.CloakTarget == "" {
+		return fmt.Errorf("cloak without a cloak_target")
+	}
+	return nil
+}
+
+func (onboarding *OnboardingConfig) accessFlags() string {
+	if onboarding.AccessFlags != "" {
+		return onboarding.AccessFlags
+	}
+	return defaultAccessFlags
+}
+
+const onboardingColumns = "id, user, account, challenge, status, reviewer, note, queued, notified, reviewed, " +
+	"voiced, access_added, cloak_requested, role_granted"
+
+func scanOnboarding(row interface{ Scan(...any) error }) (Onboarding, error) {
+	var o Onboarding
+	err := row.Scan(&o.ID, &o.User, &o.Account, &o.Challenge, &o.Status, &o.Reviewer, &o.Note, &o.Queued, &o.Notified,
+		&o.Reviewed, &o.Voiced, &o.AccessAdded, &o.CloakRequested, &o.RoleGranted)
+	return o, err
+}
+
+func FindOnboarding(server, user string) (Onboarding, error) {
+	o, err := scanOnboarding(DB.QueryRow("SELECT "+onboardingColumns+" FROM onboarding WHERE server = ? AND user = ?",
+		strings.ToLower(server), strings.ToLower(user)))
+	if err == sql.ErrNoRows {
+		return o, fmt.Errorf("%s isn't in onboarding", user)
+	}
+	return o, err
+}
+
+/* Players waiting for review, oldest first. */
+func PendingOnboarding(server string) []Onboarding {
+	rows, err := DB.Query("SELECT "+onboardingColumns+" FROM onboarding WHERE server = ? AND status = ? ORDER BY queued",
+		strings.ToLower(server), OnboardPending)
+	if err != nil {
+		log.Printf("[PendingOnboarding] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var pending []Onboarding
+	for rows.Next() {
+		if o, err := scanOnboarding(rows); err == nil {
+			pending = append(pending, o)
+		}
+	}
+	return pending
+}
+
+/* Record when a step was taken. */
+func markOnboarding(id int64, step string) {
+	if _, err := DB.Exec("UPDATE onboarding SET "+step+" = ? WHERE id = ?", time.Now().Unix(), id); err != nil {
+		log.Printf("[markOnboarding] Error recording %s: %v\n", step, err)
+	}
+}
+
+/* Whether user is already part of the community: voiced in its channels or trusted. */
+func onboarded(settings *ServerConfig, onboarding *OnboardingConfig, user, account string) bool {
+	if UserRole(settings, "", user, account) >= RoleTrusted {
+		return true
+	}
+	for _, channel := range onboarding.Channels {
+		if member, ok := FindChannelMember(settings.Name, channel, user); ok && member.IsVoiced() {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Called for every solve: queue user for review if ctfname is an onboarding
+ * challenge. Approval goes to the account, so players must be identified to
+ * services when they solve; those who weren't can send the flag again once they are.
+ */
+func QueueOnboarding(settings *ServerConfig, config *CTFConfig, ctfname, user, account string) {
+	onboarding := config.Onboarding
+	if onboarding == nil || !slices.ContainsFunc(onboarding.Challenges, func(c string) bool { return strings.EqualFold(c, ctfname) }) {
+		return
+	}
+	server := strings.ToLower(settings.Name)
+	user = strings.ToLower(user)
+	if onboarded(settings, onboarding, user, account) {
+		log.Printf("[QueueOnboarding] %s is already in the community\n", user)
+		return
+	}
+	if account == "" {
+		send_irc(settings.Name, user, "To be reviewed for the community, identify to services and send the flag again.")
+		return
+	}
+	/* Pending players queued without an account get the one they have now. */
+	result, err := DB.Exec("INSERT INTO onboarding (server, user, account, challenge, status, queued) VALUES (?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT(server, user) DO UPDATE SET account = excluded.account WHERE account = '' AND status = ?",
+		server, user, account, ctfname, OnboardPending, time.Now().Unix(), OnboardPending)
+	if err != nil {
+		log.Printf("[QueueOnboarding] Error queueing %s: %v\n", user, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		/* Queued before, reviewed or not. */
+		return
+	}
+	log.Printf("[QueueOnboarding] Queued %s for review after %s\n", user, ctfname)
+	o, err := FindOnboarding(server, user)
+	if err != nil {
+		return
+	}
+	notifyStaff(settings, onboarding, o)
+	send_irc(settings.Name, user, "An op will review your solution with you, and once they approve you'll be added to the community.")
+}
+
+/* Tell the staff channel, highlighting the ops in it. */
+func notifyStaff(settings *ServerConfig, onboarding *OnboardingConfig, o Onboarding) {
+	var ops []string
+	for _, member := range ChannelMembers(settings.Name, onboarding.StaffChannel) {
+		if member.IsOp() && !member.Away && !strings.EqualFold(member.Nick, settings.Nick) {
+			ops = append(ops, member.Nick)
+		}
+	}
+	who := o.User
+	if o.Account != "" && !strings.EqualFold(o.Account, o.User) {
+		who += " (" + o.Account + ")"
+	}
+	message := fmt.Sprintf("🆕 %s solved %s and is waiting for review: !onboard approve %s, or !onboard reject %s <reason>",
+		who, o.Challenge, o.User, o.User)
+	if len(ops) > 0 {
+		message = strings.Join(ops, ", ") + ": " + message
+	}
+	send_irc_priority(settings.Name, onboarding.StaffChannel, message, PriorityHigh)
+	markOnboarding(o.ID, "notified")
+}
+
+/*
+ * Approve user: add the account they solved with to the access lists, request
+ * their cloak, grant the role and voice them if they're on that account now.
+ */
+/*
+ * Approve a pending player. Someone already approved or rejected is only
+ * approved again with reapprove, which voices and welcomes them again.
+ */
+func ApproveOnboarding(settings *ServerConfig, onboarding *OnboardingConfig, user, reviewer, note string, reapprove bool) (Onboarding, []string, error) {
+	server := settings.Name
+	o, err := FindOnboarding(server, user)
+	if err != nil {
+		return o, nil, err
+	}
+	if o.Account == "" {
+		/* Queued before accounts were required, whoever has the nick now may not be who solved. */
+		return o, nil, fmt.Errorf("%s solved without a services account, they need to identify and send the flag again", o.User)
+	}
+	if o.Status != OnboardPending && !reapprove {
+		return o, nil, fmt.Errorf("%s was already %s, use onboard reapprove %s to approve them again", o.User, o.Status, o.User)
+	}
+	if _, err := DB.Exec("UPDATE onboarding SET status = ?, reviewer = ?, note = ?, reviewed = ? WHERE id = ?",
+		OnboardApproved, reviewer, note, time.Now().Unix(), o.ID); err != nil {
+		return o, nil, err
+	}
+
+	var steps []string
+	if len(onboarding.Channels) > 0 {
+		if tracked, ok := LookupUser(server, o.User); ok && strings.EqualFold(tracked.Account, o.Account) {
+			for _, channel := range onboarding.Channels {
+				Moderate(settings, channel, reviewer, ModVoice, o.User, 0, "Onboarded")
+			}
+			markOnboarding(o.ID, "voiced")
+			steps = append(steps, "voiced in "+strings.Join(onboarding.Channels, ", "))
+		} else {
+			steps = append(steps, "not voiced, "+o.User+" isn't logged in as "+o.Account+" now")
+		}
+	}
+	if o.AccessAdded == 0 && len(onboarding.Channels) > 0 {
+		for _, channel := range onboarding.Channels {
+			send_irc(server, "ChanServ", fmt.Sprintf("FLAGS %s %s %s", channel, o.Account, onboarding.accessFlags()))
+		}
+		markOnboarding(o.ID, "access_added")
+		steps = append(steps, onboarding.accessFlags()+" on the access lists")
+	}
+	if o.CloakRequested == 0 && onboarding.Cloak != "" {
+		cloak := strings.ReplaceAll(onboarding.Cloak, "{account}", o.Account)
+		send_irc(server, onboarding.CloakTarget, fmt.Sprintf("Cloak request: please set %s for the account %s", cloak, o.Account))
+		markOnboarding(o.ID, "cloak_requested")
+		steps = append(steps, "cloak "+cloak+" requested")
+	}
+	if o.RoleGranted == 0 && onboarding.Role != "" {
+		role, _ := ParseRole(onboarding.Role)
+		if err := SetGrant(server, AnyChannel, accountMask+o.Account, role, reviewer); err != nil {
+			log.Printf("[ApproveOnboarding] Error granting %s to %s: %v\n", role, o.Account, err)
+		} else {
+			markOnboarding(o.ID, "role_granted")
+			steps = append(steps, "granted "+role.String())
+		}
+	}
+	welcome := onboarding.Welcome
+	if welcome == "" {
+		welcome = "Welcome to the community! You've been approved by " + reviewer + "."
+	}
+	send_irc(server, o.User, welcome)
+	if reapprove {
+		log.Printf("[ApproveOnboarding] %s reapproved %s (was %s): %s\n", reviewer, o.User, o.Status, strings.Join(steps, ", "))
+	} else {
+		log.Printf("[ApproveOnboarding] %s approved %s: %s\n", reviewer, o.User, strings.Join(steps, ", "))
+	}
+	o, _ = FindOnboarding(server, o.User)
+	return o, steps, nil
+}
+
+func RejectOnboarding(server, user, reviewer, note string) error {
+	o, err := FindOnboarding(server, user)
+	if err != nil {
+		return err
+	}
+	if o.Status != OnboardPending {
+		return fmt.Errorf("%s was already %s", o.User, o.Status)
+	}
+	_, err = DB.Exec("UPDATE onboarding SET status = ?, reviewer = ?, note = ?, reviewed = ? WHERE id = ?",
+		OnboardRejected, reviewer, note, time.Now().Unix(), o.ID)
+	if err == nil {
+		log.Printf("[RejectOnboarding] %s rejected %s: %s\n", reviewer, o.User, note)
+	}
+	return err
+}
+
+/* The steps a player went through, with their times. */
+func (o Onboarding) Pipeline() string {
+	var steps []string
+	step := func(name string, at int64) {
+		if at > 0 {
+			steps = append(steps, name+" "+time.Unix(at, 0).UTC().Format("2006-01-02 15:04"))
+		}
+	}
+	step("queued", o.Queued)
+	step("notified", o.Notified)
+	step(o.Status, o.Reviewed)
+	step("voiced", o.Voiced)
+	step("access", o.AccessAdded)
+	step("cloak", o.CloakRequested)
+	step("role", o.RoleGranted)
+	line := fmt.Sprintf("%s [%s] after %s: %s", o.User, o.Status, o.Challenge, strings.Join(steps, ", "))
+	if o.Reviewer != "" {
+		line += " (by " + o.Reviewer
+		if o.Note != "" {
+			line += ": " + o.Note
+		}
+		line += ")"
+	}
+	return line
+}
+
+/*
+ * Whether the sender of !onboard may review players: an op of the staff
+ * channel or of every onboarding channel, or an admin. Being an op of some
+ * other channel isn't enough.
+ */
+func onboardingReviewer(ctx *CommandContext, onboarding *OnboardingConfig) bool {
+	if ctx.Relayed {
+		return false
+	}
+	if UserRole(ctx.Settings, "", ctx.User, ctx.Account) >= RoleAdmin ||
+		UserRole(ctx.Settings, onboarding.StaffChannel, ctx.User, ctx.Account) >= RoleOp {
+		return true
+	}
+	if len(onboarding.Channels) == 0 {
+		return false
+	}
+	for _, channel := range onboarding.Channels {
+		if UserRole(ctx.Settings, channel, ctx.User, ctx.Account) < RoleOp {
+			return false
+		}
+	}
+	return true
+}
+
+/* Run an onboard subcommand for reviewer, the lines to answer with. */
+func OnboardingReview(settings *ServerConfig, reviewer string, args []string) []string {
+	ctfconfig := ServerCTF(settings.Name)
+	if ctfconfig == nil || ctfconfig.Onboarding == nil {
+		return []string{"Onboarding isn't configured on " + settings.Name}
+	}
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand = strings.ToLower(args[0])
+	}
+	if subcommand != "list" && len(args) < 2 {
+		return []string{"Usage: onboard [list|show <nick>|approve <nick> [note]|reapprove <nick> [note]|reject <nick> [reason]]"}
+	}
+	switch subcommand {
+	case "list":
+		var lines []string
+		for _, o := range PendingOnboarding(settings.Name) {
+			lines = append(lines, fmt.Sprintf("%s solved %s, waiting %s", o.User, o.Challenge,
+				formatDuration(time.Since(time.Unix(o.Queued, 0)).Round(time.Minute))))
+		}
+		if len(lines) == 0 {
+			lines = []string{"Nobody is waiting for review."}
+		}
+		return lines
+	case "show":
+		o, err := FindOnboarding(settings.Name, args[1])
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return []string{o.Pipeline()}
+	case "approve", "reapprove":
+		previous, _ := FindOnboarding(settings.Name, args[1])
+		o, steps, err := ApproveOnboarding(settings, ctfconfig.Onboarding, args[1], reviewer, strings.Join(args[2:], " "), subcommand == "reapprove")
+		if err != nil {
+			return []string{"Unable to approve: " + err.Error()}
+		}
+		if previous.Status != OnboardPending {
+			return []string{fmt.Sprintf("Approved %s again (was %s): %s", o.User, previous.Status, strings.Join(steps, ", "))}
+		}
+		return []string{fmt.Sprintf("Approved %s: %s", o.User, strings.Join(steps, ", "))}
+	case "reject":
+		if err := RejectOnboarding(settings.Name, args[1], reviewer, strings.Join(args[2:], " ")); err != nil {
+			return []string{"Unable to reject: " + err.Error()}
+		}
+		return []string{"Rejected " + args[1] + "."}
+	}
+	return []string{"Usage: onboard [list|show <nick>|approve <nick> [note]|reapprove <nick> [note]|reject <nick> [reason]]"}
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "onboard",
+		Syntax:      "[list|show <nick>|approve <nick> [note]|reapprove <nick> [note]|reject <nick> [reason]]",
+		Description: "Review the players waiting to join the community after solving the topic challenge",
+		Category:    "CTF Challenge",
+		Channel:     true,
+		Private:     true,
+		Role:        RoleOp,
+		Handler: func(ctx *CommandContext) {
+			if ctfconfig := ServerCTF(ctx.Settings.Name); ctfconfig != nil && ctfconfig.Onboarding != nil &&
+				!onboardingReviewer(ctx, ctfconfig.Onboarding) {
+				ctx.Reply("Only ops of " + ctfconfig.Onboarding.StaffChannel + " can review onboarding.")
+				return
+			}
+			for _, line := range OnboardingReview(ctx.Settings, ctx.User, ctx.Args) {
+				ctx.Reply(line)
+			}
+		},
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Outgoing line priority, lower values are sent first. */
+type Priority int
+
+const (
+	PriorityUrgent Priority = iota /* PONG and authentication, never held back by the rate limit. */
+	PriorityHigh                   /* Registration, joins, modes and services. */
+	PriorityNormal                 /* Replies to users. */
+	PriorityLow                    /* Chatter: help text, continuation lines of long replies. */
+	priorityLevels
+)
+
+/* Lines queued for a single target at low priority before the oldest are dropped. */
+var maxQueuedPerTarget = 20
+
+/* Low priority lines older than this are dropped instead of being sent late. */
+var maxQueuedAge = 2 * time.Minute
+
+type outLine struct {
+	line     string
+	target   string
+	priority Priority
+	secret   bool
+	queued   time.Time
+}
+
+/*
+ * Per-connection outbound queue. Lines are sent by a single writer goroutine
+ * through a token bucket (Burst lines at once, then Rate lines per second),
+ * highest priority first and round-robin between targets within a priority,
+ * so one long reply can't starve other channels or trip the server's flood limits.
+ */
+type OutQueue struct {
+	mutex   sync.Mutex
+	wake    chan struct{}
+	cx      net.Conn
+	name    string
+	targets [priorityLevels]map[string][]outLine
+	order   [priorityLevels][]string /* Round-robin order of targets with queued lines. */
+	tokens  float64
+	burst   float64
+	rate    float64
+	last    time.Time
+	closed  bool
+}
+
+func NewOutQueue(name string, cx net.Conn, burst int, rate float64) *OutQueue {
+	if burst < 1 {
+		burst = 5
+	}
+	if rate <= 0 {
+		rate = 1
+	}
+	q := &OutQueue{
+		wake:   make(chan struct{}, 1),
+		cx:     cx,
+		name:   name,
+		tokens: float64(burst),
+		burst:  float64(burst),
+		rate:   rate,
+		last:   time.Now(),
+	}
+	for i := range q.targets {
+		q.targets[i] = make(map[string][]outLine)
+	}
+	go q.writer()
+	return q
+}
+
+/* Queue a raw line (with CRLF). */
+func (q *OutQueue) Push(line string, priority Priority, secret bool) {
+	if len(line) < 1 {
+		return
+	}
+	target := lineTarget(line)
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return
+	}
+	queue := q.targets[priority][target]
+	/* Coalesce: an identical line already waiting doesn't need sending twice. */
+	for _, queued := range queue {
+		if queued.line == line {
+			q.mutex.Unlock()
+			return
+		}
+	}
+	if priority >= PriorityLow && len(queue) >= maxQueuedPerTarget {
+		log.Printf("[OutQueue] %s: dropping %d queued line(s) for %s\n", q.name, len(queue)-maxQueuedPerTarget+1, target)
+		queue = queue[len(queue)-maxQueuedPerTarget+1:]
+	}
+	if len(queue) == 0 {
+		q.order[priority] = append(q.order[priority], target)
+	}
+	q.targets[priority][target] = append(queue, outLine{line, target, priority, secret, time.Now()})
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+/* Stop the writer; anything still queued is discarded. */
+func (q *OutQueue) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+/* Number of lines waiting to be sent. */
+func (q *OutQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	n := 0
+	for _, targets := range q.targets {
+		for _, queue := range targets {
+			n += len(queue)
+		}
+	}
+	return n
+}
+
+/* Take the next line to send, or false if nothing is queued. */
+func (q *OutQueue) next() (outLine, bool) {
+	for priority := range q.order {
+		for len(q.order[priority]) > 0 {
+			target := q.order[priority][0]
+			q.order[priority] = q.order[priority][1:]
+			queue := q.targets[priority][target]
+			if len(queue) == 0 {
+				continue
+			}
+			line := queue[0]
+			queue = queue[1:]
+			if len(queue) > 0 {
+				q.targets[priority][target] = queue
+				q.order[priority] = append(q.order[priority], target)
+			} else {
+				delete(q.targets[priority], target)
+			}
+			if Priority(priority) >= PriorityLow && time.Since(line.queued) > maxQueuedAge {
+				log.Printf("[OutQueue] %s: dropping stale line for %s\n", q.name, target)
+				continue
+			}
+			return line, true
+		}
+	}
+	return outLine{}, false
+}
+
+func (q *OutQueue) refill() {
+	now := time.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	q.last = now
+}
+
+func (q *OutQueue) writer() {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return
+		}
+		q.refill()
+		line, ok := q.next()
+		if !ok {
+			q.mutex.Unlock()
+			<-q.wake
+			continue
+		}
+		if line.priority != PriorityUrgent && q.tokens < 1 {
+			/* Put it back at the front and wait for a token. */
+			q.targets[line.priority][line.target] = append([]outLine{line}, q.targets[line.priority][line.target]...)
+			if len(q.targets[line.priority][line.target]) == 1 {
+				q.order[line.priority] = append([]string{line.target}, q.order[line.priority]...)
+			}
+			wait := time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+			q.mutex.Unlock()
+			select {
+			case <-time.After(wait):
+			case <-q.wake:
+			}
+			continue
+		}
+		q.tokens--
+		if q.tokens < -q.burst {
+			q.tokens = -q.burst
+		}
+		q.mutex.Unlock()
+
+		_, err := q.cx.Write([]byte(line.line))
+		if err != nil {
+			if line.secret {
+				log.Printf("Failed to send IRC message containing a secret:\nError:%v\n", err)
+			} else {
+				log.Printf("Failed to send IRC message:%v\nError:%v\n", line.line, err)
+			}
+			continue
+		}
+		if !line.secret {
+			fmt.Printf("< %v", line.line)
+		}
+	}
+}
+
+/* PRIVMSG/NOTICE target used for fairness, "" for everything else. */
+func lineTarget(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && (strings.EqualFold(fields[0], "PRIVMSG") || strings.EqualFold(fields[0], "NOTICE")) {
+		return strings.ToLower(fields[1])
+	}
+	return ""
+}
+
+/* Default priority of a raw line, from its command and target. */
+func linePriority(line string) Priority {
+	fields := strings.Fields(line)
+	if len(fields) < 1 {
+		return PriorityNormal
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PONG", "AUTHENTICATE", "PASS", "QUIT":
+		return PriorityUrgent
+	case "CAP", "NICK", "USER", "JOIN", "PART", "MODE", "PING", "WHO", "NAMES", "KICK":
+		return PriorityHigh
+	case "PRIVMSG", "NOTICE":
+		if len(fields) >= 2 && (strings.EqualFold(fields[1], "NickServ") || strings.EqualFold(fields[1], "ChanServ")) {
+			return PriorityHigh
+		}
+	}
+	return PriorityNormal
+}
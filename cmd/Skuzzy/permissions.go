@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleTrusted
+	RoleOp
+	RoleAdmin
+	RoleOwner
+)
+
+var roleNames = []string{"user", "trusted", "op", "admin", "owner"}
+
+func (r Role) String() string {
+	if r < RoleUser || r > RoleOwner {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if strings.EqualFold(n, name) {
+			return Role(i), nil
+		}
+	}
+	return RoleUser, fmt.Errorf("unknown role '%s', expected one of %s", name, strings.Join(roleNames, ", "))
+}
+
+/* Grants stored with this channel apply in every channel of the server. */
+const AnyChannel = "*"
+
+/* Prefix of masks that match a NickServ account instead of a hostmask, as in Libera's extbans. */
+const accountMask = "$a:"
+
+/*
+ * A role granted to a mask: either "$a:account" or a nick!user@host glob
+ * where '*' and '?' are wildcards.
+ */
+type Grant struct {
+	ID      int
+	Server  string
+	Channel string
+	Mask    string
+	Role    Role
+	AddedBy string
+	Created time.Time
+}
+
+/* Case-insensitive glob match, '*' matches any run of characters and '?' a single one. */
+func MatchMask(mask, s string) bool {
+	mask = strings.ToLower(mask)
+	s = strings.ToLower(s)
+	/* Classic backtracking over the last '*'. */
+	m, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		if m < len(mask) && (mask[m] == '?' || mask[m] == s[i]) {
+			m++
+			i++
+		} else if m < len(mask) && mask[m] == '*' {
+			star = m
+			mark = i
+			m++
+		} else if star >= 0 {
+			m = star + 1
+			mark++
+			i = mark
+		} else {
+			return false
+		}
+	}
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+	return m == len(mask)
+}
+
+/* Whether mask matches a user with the given nick!user@host and account. */
+func grantMatches(mask, hostmask, account string) bool {
+	if strings.HasPrefix(strings.ToLower(mask), accountMask) {
+		return account != "" && strings.EqualFold(mask[len(accountMask):], account)
+	}
+	return hostmask != "" && MatchMask(mask, hostmask)
+}
+
+/*
+ * The role of a user in a channel ("" for server-wide grants only): the highest
+ * of the configured owners, stored grants and being opped in the channel.
+ * account may be "" if unknown, the tracked one is used then.
+ */
+func UserRole(settings *ServerConfig, channel, nick, account string) Role {
+	hostmask := ""
+	if user, ok := LookupUser(settings.Name, nick); ok {
+		hostmask = user.Hostmask()
+		if account == "" {
+			account = user.Account
+		}
+	}
+	for _, mask := range settings.Owners {
+		if grantMatches(mask, hostmask, account) {
+			return RoleOwner
+		}
+	}
+	role := RoleUser
+	if channel != "" && IsChannelOp(settings.Name, channel, nick) {
+		role = RoleOp
+	}
+	for _, grant := range ListGrants(settings.Name, channel) {
+		if grant.Role > role && grantMatches(grant.Mask, hostmask, account) {
+			role = grant.Role
+		}
+	}
+	return role
+}
+
+/*
+ * Grants that apply in channel: the channel's own and the server-wide ones.
+ * channel "" lists server-wide grants only, AnyChannel lists every grant.
+ */
+func ListGrants(server, channel string) []Grant {
+	query := "SELECT id, server, channel, mask, role, added_by, created FROM permissions WHERE server = ?"
+	args := []any{strings.ToLower(server)}
+	switch channel {
+	case AnyChannel:
+	case "":
+		query += " AND channel = ?"
+		args = append(args, AnyChannel)
+	default:
+		query += " AND (channel = ? OR channel = ?)"
+		args = append(args, strings.ToLower(channel), AnyChannel)
+	}
+	rows, err := DB.Query(query+" ORDER BY channel, role DESC", args...)
+	if err != nil {
+		log.Printf("[ListGrants] Error reading permissions for %s/%s: %v\n", server, channel, err)
+		return nil
+	}
+	defer rows.Close()
+	var grants []Grant
+	for rows.Next() {
+		var g Grant
+		var created int64
+		if err := rows.Scan(&g.ID, &g.Server, &g.Channel, &g.Mask, &g.Role, &g.AddedBy, &created); err != nil {
+			log.Printf("[ListGrants] Error scanning permission row: %v\n", err)
+			continue
+		}
+		g.Created = time.Unix(created, 0)
+		grants = append(grants, g)
+	}
+	return grants
+}
+
+/* Grant role to mask in channel (AnyChannel for the whole server), replacing an earlier grant. */
+func SetGrant(server, channel, mask string, role Role, addedBy string) error {
+	server = strings.ToLower(server)
+	channel = strings.ToLower(channel)
+	if _, err := DB.Exec("DELETE FROM permissions WHERE server = ? AND channel = ? AND mask = ? COLLATE NOCASE",
+		server, channel, mask); err != nil {
+		return fmt.Errorf("failed to replace permission: %w", err)
+	}
+	if role == RoleUser {
+		/* Plain users need no grant. */
+		return nil
+	}
+	_, err := DB.Exec("INSERT INTO permissions (server, channel, mask, role, added_by, created) VALUES (?, ?, ?, ?, ?, ?)",
+		server, channel, mask, int(role), addedBy, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store permission: %w", err)
+	}
+	log.Printf("[SetGrant] %s granted %s to %s in %s/%s\n", addedBy, role, mask, server, channel)
+	return nil
+}
+
+/* Remove the grant for mask in channel, returning whether there was one. */
+func RemoveGrant(server, channel, mask string) (bool, error) {
+	result, err := DB.Exec("DELETE FROM permissions WHERE server = ? AND channel = ? AND mask = ? COLLATE NOCASE",
+		strings.ToLower(server), strings.ToLower(channel), mask)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove permission: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+/* Record a use of a privileged command, allowed or not. */
+func AuditCommand(ctx *CommandContext, allowed bool) {
+	_, err := DB.Exec("INSERT INTO command_audit (server, channel, user, account, command, args, allowed, created) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?)", strings.ToLower(ctx.Settings.Name), strings.ToLower(ctx.Channel),
+		ctx.User, ctx.Account, ctx.Command.Name, strings.Join(ctx.Args, " "), allowed, time.Now().Unix())
+	if err != nil {
+		log.Printf("[AuditCommand] Error recording !%s by %s: %v\n", ctx.Command.Name, ctx.User, err)
+	}
+}
+
+/*
+ * Turn a nick we can see into a mask for a grant: their account if they are
+ * logged in, otherwise *!*@host. Anything that already looks like a mask is kept.
+ */
+func MaskFor(server, target string) string {
+	if strings.HasPrefix(strings.ToLower(target), accountMask) || strings.ContainsAny(target, "!@*?") {
+		return target
+	}
+	if user, ok := LookupUser(server, target); ok {
+		if user.Account != "" {
+			return accountMask + user.Account
+		}
+		if user.Host != "" {
+			return "*!*@" + user.Host
+		}
+	}
+	return target + "!*@*"
+}
+
+/* Parse the optional channel argument of the role commands: a channel, '*' or the current channel. */
+func grantChannel(ctx *CommandContext, arg string) string {
+	if arg == AnyChannel || strings.HasPrefix(arg, "#") {
+		return arg
+	}
+	if ctx.Channel != "" {
+		return ctx.Channel
+	}
+	return AnyChannel
+}
+
+func formatGrants(grants []Grant) string {
+	if len(grants) == 0 {
+		return "No roles granted."
+	}
+	var lines []string
+	for _, g := range grants {
+		lines = append(lines, fmt.Sprintf("%s: %s is %s (by %s, %s)", g.Channel, g.Mask, g.Role, g.AddedBy,
+			g.Created.Format("2006-01-02")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+/* Managing roles needs admin, and only owners can hand out admin or owner. Never for relayed users. */
+func canGrant(ctx *CommandContext, channel string, role Role) bool {
+	if ctx.Relayed {
+		return false
+	}
+	own := UserRole(ctx.Settings, strings.TrimPrefix(channel, AnyChannel), ctx.User, ctx.Account)
+	return own >= RoleAdmin && (role < RoleAdmin || own == RoleOwner)
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "whoami",
+		Description: "Show your role here",
+		Category:    "Permissions",
+		Channel:     true,
+		Private:     true,
+		Cooldown:    10 * time.Second,
+		PerUser:     true,
+		Handler: func(ctx *CommandContext) {
+			ctx.Reply(fmt.Sprintf("%s, you are %s here.", ctx.User, ctx.Role()))
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "roles",
+		Syntax:      "[#channel|*]",
+		Description: "List granted roles",
+		Category:    "Permissions",
+		Channel:     true,
+		Private:     true,
+		Role:        RoleOp,
+		Handler: func(ctx *CommandContext) {
+			channel := grantChannel(ctx, ctx.Rest(0))
+			if channel == AnyChannel {
+				channel = ""
+			}
+			for _, line := range strings.Split(formatGrants(ListGrants(ctx.Settings.Name, channel)), "\n") {
+				send_irc_priority(ctx.Settings.Name, ctx.User, line, PriorityLow)
+			}
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "grant",
+		Syntax:      "<nick|mask|$a:account> <role> [#channel|*]",
+		Description: "Give a role (user, trusted, op, admin, owner) in a channel or server-wide",
+		Category:    "Permissions",
+		Channel:     true,
+		Private:     true,
+		Role:        RoleAdmin,
+		MinArgs:     2,
+		Handler: func(ctx *CommandContext) {
+			role, err := ParseRole(ctx.Args[1])
+			if err != nil {
+				ctx.Reply(err.Error())
+				return
+			}
+			channel := grantChannel(ctx, ctx.Rest(2))
+			if !canGrant(ctx, channel, role) {
+				ctx.Reply(fmt.Sprintf("%s, you can't grant %s in %s.", ctx.User, role, channel))
+				return
+			}
+			mask := MaskFor(ctx.Settings.Name, ctx.Args[0])
+			if err := SetGrant(ctx.Settings.Name, channel, mask, role, ctx.User); err != nil {
+				log.Printf("[grant] %v\n", err)
+				ctx.Reply("Failed to store the role.")
+				return
+			}
+			ctx.Reply(fmt.Sprintf("%s is now %s in %s.", mask, role, channel))
+		},
+	})
+	RegisterCommand(&Command{
+		Name:        "revoke",
+		Syntax:      "<nick|mask|$a:account> [#channel|*]",
+		Description: "Remove a granted role",
+		Category:    "Permissions",
+		Channel:     true,
+		Private:     true,
+		Role:        RoleAdmin,
+		MinArgs:     1,
+		Handler: func(ctx *CommandContext) {
+			channel := grantChannel(ctx, ctx.Rest(1))
+			mask := MaskFor(ctx.Settings.Name, ctx.Args[0])
+			for _, g := range ListGrants(ctx.Settings.Name, AnyChannel) {
+				if strings.EqualFold(g.Channel, channel) && strings.EqualFold(g.Mask, mask) && !canGrant(ctx, channel, g.Role) {
+					ctx.Reply(fmt.Sprintf("%s, you can't revoke %s in %s.", ctx.User, g.Role, channel))
+					return
+				}
+			}
+			removed, err := RemoveGrant(ctx.Settings.Name, channel, mask)
+			if err != nil {
+				log.Printf("[revoke] %v\n", err)
+				ctx.Reply("Failed to remove the role.")
+				return
+			}
+			if !removed {
+				ctx.Reply(fmt.Sprintf("%s has no role in %s.", mask, channel))
+				return
+			}
+			ctx.Reply(fmt.Sprintf("%s no longer has a role in %s.", mask, channel))
+		},
+	})
+}
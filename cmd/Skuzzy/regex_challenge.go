@@ -25,6 +25,13 @@ type RegexChallenge struct {
 	RegexText string
 	Active    bool
 	SleepTime time.Duration
+
+	Tier       string /* Of the current challenge. */
+	Difficulty int
+	Round      int64  /* In regex_challenge_rounds. */
+	NextTier   string /* Asked of the LLM for the next challenge. */
+	Retries    int    /* Regexes from the LLM outside NextTier so far. */
+	Failures   int    /* Faulty answers from the LLM in a row. */
 }
 
 var RegexChallengeMutex = sync.RWMutex{}
@@ -33,8 +40,79 @@ var RegexChallengeChannels = make(map[string]RegexChallenge)
 
 var maxSleep = (3600 * 6)
 
-func challengePrompt(previous string) string {
-	return fmt.Sprintf(`Respond with a regular expression that is difficult and complex. The regular expression should be very different compared to:%s`, previous)
+func challengePrompt(previous string, tier RegexTier) string {
+	return fmt.Sprintf(`Respond with a regular expression that is %s. The regular expression should be very different compared to:%s`, tier.Description, previous)
+}
+
+/* The prompt for the next challenge, at the tier the channel is due. */
+func (challenge *RegexChallenge) nextPrompt() string {
+	config := regexChallengeConfig(challenge.settings, challenge.Channel)
+	tier := NextRegexTier(challenge.settings.Name, challenge.Channel, config)
+	challenge.NextTier = tier.Name
+	challenge.Retries = 0
+	challenge.Failures = 0
+	return challengePrompt(challenge.RegexText, tier)
+}
+
+/*
+ * Ask for the next challenge of a channel: from the LLM, or from the generator
+ * if the channel uses it, there is no LLM or the LLM keeps giving faulty
+ * regexes. Called with RegexChallengeMutex held, once challenge is stored.
+ */
+func queueRegexChallenge(challenge RegexChallenge, sysprompt, request string) {
+	config := regexChallengeConfig(challenge.settings, challenge.Channel)
+	if config.Source == RegexSourceGenerator || len(challenge.settings.LLMS) == 0 || challenge.Failures >= config.FallbackAfter {
+		go GeneratedRegexChallenge(challenge.settings.Name, challenge.Channel)
+		return
+	}
+	DeepseekQueue(challenge.settings.Name) <- DeepseekRequest{
+		Channel:       challenge.Channel,
+		Server:        challenge.settings.Name,
+		sysprompt:     sysprompt,
+		request:       request,
+		reload:        false,
+		reset:         false,
+		OriginalQuery: "regex\nchallenge",
+		User:          "",
+	}
+}
+
+/* Post a new challenge from the generator, at the tier the channel is due. */
+func GeneratedRegexChallenge(server, channel string) {
+	RegexChallengeMutex.Lock()
+	defer RegexChallengeMutex.Unlock()
+	challenge, ok := RegexChallengeChannels[server+"/"+channel]
+	if !ok {
+		return
+	}
+	tier := regexChallengeConfig(challenge.settings, channel).tier(challenge.NextTier)
+	generated, compiled := GenerateRegex(tier)
+	if compiled == nil {
+		log.Printf("[GeneratedRegexChallenge] Unable to generate a %s regex for [%s/%s]\n", tier.Name, server, channel)
+		return
+	}
+	log.Printf("[GeneratedRegexChallenge] Generated %s, matching %q\n", generated.Regex, generated.Sample)
+	startRegexChallenge(challenge, generated.Regex, compiled)
+}
+
+/* Post regex as the channel's challenge once its sleep time is over. Called with RegexChallengeMutex held. */
+func startRegexChallenge(challenge RegexChallenge, regex string, compiled *regexp.Regexp) {
+	server, channel := challenge.settings.Name, challenge.Channel
+	challenge.Regex = compiled
+	challenge.Tier = regexChallengeConfig(challenge.settings, channel).tier(challenge.NextTier).Name
+	challenge.Difficulty = RegexDifficultyOf(regex).Score
+	challenge.Retries = 0
+	challenge.Failures = 0
+	RegexChallengeChannels[server+"/"+channel] = challenge
+	log.Printf("[startRegexChallenge] New %s regex challenge (%d) for [%s/%s], sleeping for %v:%s\n", challenge.Tier, challenge.Difficulty,
+		server, channel, challenge.SleepTime, regex)
+	time.Sleep(challenge.SleepTime * time.Second)
+	send_irc(server, channel, fmt.Sprintf("Regex Challenge [%s, difficulty %d]:`%s`", challenge.Tier, challenge.Difficulty, regex))
+	challenge.Round = StartRegexRound(server, channel, regex, challenge.Tier, challenge.Difficulty)
+	challenge.Active = true
+	challenge.RegexText = regex
+	challenge.SleepTime = 0
+	RegexChallengeChannels[server+"/"+channel] = challenge
 }
 func RegexChallengeWorker() {
 	time.Sleep(30 * time.Second) // Initial sleep while things get set up
@@ -42,20 +120,12 @@ func RegexChallengeWorker() {
 		RegexChallengeMutex.Lock()
 		for k, v := range RegexChallengeChannels {
 			log.Printf("[RegexChallengeWorker] Processing RegexChallenge for %s\n", k)
-			prompt, text := FindPrompt(v.settings, "deepseek", v.Channel, "", "regex\nchallenge")
+			prompt, text := FindPrompt(v.settings, ChannelLLM(v.settings, v.Channel), v.Channel, "", "regex\nchallenge")
 			if strings.HasSuffix(prompt, "/regex_challenge") { // && (v.Timer == 0 || ((time.Now().Unix() - v.Timer) > (3600*2))) {
 				v.Timer = time.Now().Unix()
-				req := DeepseekRequest{
-					Channel:       v.Channel,
-					Server:        v.settings.Name,
-					sysprompt:     text,
-					request:       challengePrompt(v.RegexText),
-					reload:        false,
-					reset:         false,
-					OriginalQuery: "regex\nchallenge",
-					User:          "",
-				}
-				DeepseekQueue <- req
+				prompt := v.nextPrompt()
+				RegexChallengeChannels[k] = v
+				queueRegexChallenge(v, text, prompt)
 				log.Printf("[RegexChallengeWorker] New challenge request queued")
 			} else {
 				log.Printf("[RegexChallengeWorker] Bad prompt or timer not ready. Prompt:%s,Timer:%d\n", prompt, v.Timer)
@@ -74,6 +144,7 @@ func NewRegexChallenge(req DeepseekRequest, response string) {
 	var newRegex *regexp.Regexp
 	if challenge, ok := RegexChallengeChannels[req.Server+"/"+req.Channel]; ok {
 		goodResponse := false
+		tierMiss := false
 		issue := ""
 		response = strings.Replace(response, "```json", "", -1)
 		response = strings.Replace(response, "```", "", -1)
@@ -94,10 +165,18 @@ func NewRegexChallenge(req DeepseekRequest, response string) {
 			newRegex, err = regexp.Compile(jsonResponse.Regex)
 			if err != nil {
 				issue = fmt.Sprintf("Bad PCRE regular expression, unable to compile `%s`", response)
-			} else if newRegex.MatchString(jsonResponse.Sample) {
-				goodResponse = true
-			} else {
+			} else if !newRegex.MatchString(jsonResponse.Sample) {
 				issue = fmt.Sprintf("Bad JSON response, regex doesn't match sample:\n```\n%s\n```\n", response)
+			} else if tier, difficulty := regexChallengeConfig(challenge.settings, req.Channel).tier(challenge.NextTier),
+				RegexDifficultyOf(jsonResponse.Regex).Score; !tier.Contains(difficulty) && challenge.Retries < maxTierRetries {
+				challenge.Retries++
+				tierMiss = true
+				issue = fmt.Sprintf("it is too complex for a %s regular expression, make it simpler", tier.Name)
+				if difficulty < tier.Min {
+					issue = fmt.Sprintf("it is too simple for a %s regular expression, make it harder", tier.Name)
+				}
+			} else {
+				goodResponse = true
 			}
 		}
 		if !goodResponse {
@@ -105,32 +184,18 @@ func NewRegexChallenge(req DeepseekRequest, response string) {
 			RegexChallengeMutex.Unlock()
 			time.Sleep(5 * time.Second)
 			RegexChallengeMutex.Lock()
-			_, text := FindPrompt(challenge.settings, "deepseek", req.Channel, "", "regex\nchallenge")
+			_, text := FindPrompt(challenge.settings, ChannelLLM(challenge.settings, req.Channel), req.Channel, "", "regex\nchallenge")
 			challenge.Timer = time.Now().Unix()
+			if !tierMiss {
+				challenge.Failures++
+			}
 			RegexChallengeChannels[req.Server+"/"+req.Channel] = challenge
 			issue = "\nYour previous response was invalid because, " + issue
-			req := DeepseekRequest{
-				Channel:       req.Channel,
-				Server:        req.Server,
-				sysprompt:     text,
-				request:       challengePrompt(challenge.RegexText) + issue,
-				reload:        false,
-				reset:         false,
-				OriginalQuery: "regex\nchallenge",
-				User:          "",
-			}
-			DeepseekQueue <- req
+			tier := regexChallengeConfig(challenge.settings, req.Channel).tier(challenge.NextTier)
+			queueRegexChallenge(challenge, text, challengePrompt(challenge.RegexText, tier)+issue)
 			log.Printf("[NewRegexChallenge] New challenge request queued because of a faulty regex.\n")
 		} else {
-			challenge.Regex = newRegex
-			RegexChallengeChannels[req.Server+"/"+req.Channel] = challenge
-			log.Printf("[NewRegexChallenge] New regex challenge for [%s/%s], sleeping for %v:%s\n", req.Server, req.Channel, challenge.SleepTime, jsonResponse.Regex)
-			time.Sleep(challenge.SleepTime * time.Second)
-			send_irc(req.Server, req.Channel, "Regex Challenge:`"+jsonResponse.Regex+"`")
-			challenge.Active = true
-			challenge.RegexText = jsonResponse.Regex
-			challenge.SleepTime = 0
-			RegexChallengeChannels[req.Server+"/"+req.Channel] = challenge
+			startRegexChallenge(challenge, jsonResponse.Regex, newRegex)
 			RegexChallengeMutex.Unlock()
 			return
 		}
@@ -169,6 +234,7 @@ func CheckRegexChallenge(server string, channel string, user string, query strin
 				points = 50
 			}
 			points += 1
+			regexRoundSolved(challenge.Round, user)
 			RegexSolved(server, channel, user, points)
 			regex_scores := RegexScores(server, channel, 86400*30)
 
@@ -181,27 +247,18 @@ func CheckRegexChallenge(server string, channel string, user string, query strin
 			} else {
 				log.Printf("[CheckRegexChallenge] Warning, updated user score but updated score was not found!!\n")
 			}
-			_, text := FindPrompt(challenge.settings, "deepseek", channel, "", "regex\nchallenge")
+			_, text := FindPrompt(challenge.settings, ChannelLLM(challenge.settings, channel), channel, "", "regex\nchallenge")
 			challenge.Timer = time.Now().Unix()
 			sleep_time := time.Duration(90 + rand.Intn(900))
 			challenge.SleepTime = sleep_time
+			prompt := challenge.nextPrompt()
 			RegexChallengeChannels[server+"/"+channel] = challenge
-			req := DeepseekRequest{
-				Channel:       channel,
-				Server:        server,
-				sysprompt:     text,
-				request:       challengePrompt(challenge.RegexText),
-				reload:        false,
-				reset:         false,
-				OriginalQuery: "regex\nchallenge",
-				User:          "",
-			}
-
-			DeepseekQueue <- req
+			queueRegexChallenge(challenge, text, prompt)
 			log.Printf("[CheckRegexChallenge] New challenge request queued because the previous one was solved.\n")
 
 		} else {
 			log.Printf("[CheckRegexChallenge] Non-matching regex:%s\n", query)
+			regexRoundMissed(challenge.Round)
 			points := maxSleep - int(int(time.Now().Unix())-int(challenge.Timer))
 			if points == 0 {
 				points = 0 - maxSleep
@@ -267,7 +324,8 @@ func LastRegexChallenge(Server string, Channel string, user string) {
 		if !challenge.Active {
 			send_irc(Server, Channel, user+", there is currently no active regex challenge.")
 		} else {
-			send_irc(Server, Channel, user+", the current regex challenge is:`"+challenge.RegexText+"`")
+			send_irc(Server, Channel, fmt.Sprintf("%s, the current regex challenge [%s, difficulty %d] is:`%s`", user, challenge.Tier,
+				challenge.Difficulty, challenge.RegexText))
 		}
 	}
 }
@@ -276,22 +334,16 @@ func NextRegexChallenge(Server string, Channel string, user string) {
 	user = strings.ToLower(user)
 	if challenge, ok := RegexChallengeChannels[Server+"/"+Channel]; ok {
 
-		_, text := FindPrompt(challenge.settings, "deepseek", Channel, "", "regex\nchallenge")
+		_, text := FindPrompt(challenge.settings, ChannelLLM(challenge.settings, Channel), Channel, "", "regex\nchallenge")
+		if challenge.Active {
+			regexRoundSkipped(challenge.Round)
+		}
 		challenge.Timer = time.Now().Unix()
 		challenge.Active = false
 		sleep_time := time.Duration(30 + rand.Intn(90))
 		challenge.SleepTime = sleep_time
+		prompt := challenge.nextPrompt()
 		RegexChallengeChannels[Server+"/"+Channel] = challenge
-		req := DeepseekRequest{
-			Channel:       Channel,
-			Server:        Server,
-			sysprompt:     text,
-			request:       challengePrompt(challenge.RegexText),
-			reload:        false,
-			reset:         false,
-			OriginalQuery: "regex\nchallenge",
-			User:          "",
-		}
 		RegexSolved(Server, Channel, user, -50)
 		regex_scores := RegexScores(Server, Channel, 86400*30)
 
@@ -302,7 +354,7 @@ func NextRegexChallenge(Server string, Channel string, user string) {
 			log.Printf("[NextRegexChallenge] Warning, updated user score but updated score was not found!!\n")
 		}
 
-		DeepseekQueue <- req
+		queueRegexChallenge(challenge, text, prompt)
 		log.Printf("[NextRegexChallenge] New challenge request queued because user requested it.\n")
 
 	}
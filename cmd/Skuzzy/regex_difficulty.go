@@ -0,0 +1,316 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+ * How hard a regex challenge is, measured on the pattern itself, and the
+ * tiers channels pick challenges from. With adaptive tiers each channel
+ * moves up when its recent challenges were solved quickly and down when
+ * they were missed, skipped or left unsolved.
+ */
+
+/* What makes a pattern hard, counted by RegexDifficultyOf. */
+type RegexDifficulty struct {
+	Score        int
+	Alternations int
+	Lookarounds  int
+	Backrefs     int
+	Quantifiers  int
+	Nesting      int /* Quantifiers applied to groups that are quantified inside, weighted by depth. */
+	Classes      int
+	ClassItems   int /* Members of all character classes, a range counting as one. */
+	Negated      int
+	Atomic       int /* Atomic groups and conditionals. */
+}
+
+type RegexTier struct {
+	Name        string `yaml:"name"`
+	Min         int    `yaml:"min"`
+	Max         int    `yaml:"max,omitempty"`         /* 0 for no upper bound. */
+	Description string `yaml:"description,omitempty"` /* How the regex is described to the LLM. */
+}
+
+/* Per channel, under regex_challenge: in the channel's settings. */
+type RegexChallengeConfig struct {
+	Tiers     []RegexTier `yaml:"tiers,omitempty"`      /* From the easiest, default easy, medium and hard. */
+	Tier      string      `yaml:"tier,omitempty"`       /* To start at, or stay at unless adaptive. Default the hardest. */
+	Adaptive  bool        `yaml:"adaptive,omitempty"`   /* Follow how recent challenges went. */
+	Window    int         `yaml:"window,omitempty"`     /* Recent challenges looked at, default 5. */
+	FastSolve int         `yaml:"fast_solve,omitempty"` /* Minutes, a median solve faster than this moves up, default 15. */
+	SlowSolve int         `yaml:"slow_solve,omitempty"` /* Minutes, a median solve slower than this moves down, default 120. */
+
+	Source        string `yaml:"source,omitempty"`         /* "llm" (default) or "generator" to never ask the LLM. */
+	FallbackAfter int    `yaml:"fallback_after,omitempty"` /* Faulty LLM answers in a row before using the generator, default 3. */
+}
+
+const (
+	RegexSourceLLM       = "llm"
+	RegexSourceGenerator = "generator"
+)
+
+var defaultRegexTiers = []RegexTier{
+	{Name: "easy", Min: 0, Max: 24, Description: "simple, with a few character classes and quantifiers"},
+	{Name: "medium", Min: 25, Max: 54, Description: "moderately complex, with groups, alternations and anchors"},
+	{Name: "hard", Min: 55, Description: "difficult and complex"},
+}
+
+/* Tries at getting a regex within the tier from the LLM before taking what it gives. */
+const maxTierRetries = 3
+
+var rRegexRepeat = regexp.MustCompile(`^\{\d+(,\d*)?\}`)
+
+func (tier RegexTier) Contains(score int) bool {
+	return score >= tier.Min && (tier.Max == 0 || score <= tier.Max)
+}
+
+/* The regex challenge settings of a channel, with the defaults filled in. */
+func regexChallengeConfig(settings *ServerConfig, channel string) RegexChallengeConfig {
+	var config RegexChallengeConfig
+	if ch := settings.FindChannel(channel); ch != nil && ch.RegexChallenge != nil {
+		config = *ch.RegexChallenge
+	}
+	if len(config.Tiers) == 0 {
+		config.Tiers = defaultRegexTiers
+	}
+	if config.Window <= 0 {
+		config.Window = 5
+	}
+	if config.FastSolve <= 0 {
+		config.FastSolve = 15
+	}
+	if config.SlowSolve <= 0 {
+		config.SlowSolve = 120
+	}
+	if config.Source == "" {
+		config.Source = RegexSourceLLM
+	}
+	if config.FallbackAfter <= 0 {
+		config.FallbackAfter = 3
+	}
+	return config
+}
+
+/* The index of the tier called name, or of the starting tier. */
+func (config RegexChallengeConfig) tierIndex(name string) int {
+	if name == "" {
+		name = config.Tier
+	}
+	for i, tier := range config.Tiers {
+		if strings.EqualFold(tier.Name, name) {
+			return i
+		}
+	}
+	return len(config.Tiers) - 1
+}
+
+func (config RegexChallengeConfig) tier(name string) RegexTier {
+	return config.Tiers[config.tierIndex(name)]
+}
+
+/*
+ * Measure a PCRE pattern. Lookarounds, backreferences, nested quantifiers and
+ * conditionals weigh the most, then alternations, character classes (more so
+ * when negated or large) and plain quantifiers, and a little the length.
+ */
+func RegexDifficultyOf(pattern string) RegexDifficulty {
+	var d RegexDifficulty
+	type frame struct {
+		depth int /* Deepest nesting of quantifiers inside the group. */
+	}
+	stack := []frame{{}}
+	last := -1 /* Quantifier depth of the atom a quantifier would apply to, -1 for none. */
+	p := []rune(pattern)
+	for i := 0; i < len(p); i++ {
+		atom := -1
+		switch c := p[i]; {
+		case c == '\\' && i+1 < len(p):
+			i++
+			switch next := p[i]; {
+			case next >= '1' && next <= '9':
+				d.Backrefs++
+			case next == 'k' || next == 'g':
+				d.Backrefs++
+				if i+1 < len(p) && strings.ContainsRune("<{'", p[i+1]) {
+					closing := map[rune]rune{'<': '>', '{': '}', '\'': '\''}[p[i+1]]
+					for i++; i+1 < len(p) && p[i] != closing; i++ {
+					}
+				}
+			case next == 'Q':
+				for i++; i+1 < len(p) && !(p[i] == '\\' && p[i+1] == 'E'); i++ {
+				}
+				i++
+			}
+			atom = 0
+		case c == '[':
+			d.Classes++
+			i++
+			if i < len(p) && p[i] == '^' {
+				d.Negated++
+				i++
+			}
+			items := 0
+			for first := true; i < len(p) && (p[i] != ']' || first); i++ {
+				first = false
+				switch {
+				case p[i] == '[' && i+1 < len(p) && p[i+1] == ':':
+					for i++; i+1 < len(p) && !(p[i] == ':' && p[i+1] == ']'); i++ {
+					}
+					i++
+				case p[i] == '\\' && i+1 < len(p):
+					i++
+				}
+				if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+					i += 2
+					if p[i] == '\\' && i+1 < len(p) {
+						i++
+					}
+				}
+				items++
+			}
+			d.ClassItems += items
+			atom = 0
+		case c == '(':
+			rest := string(p[i+1:])
+			switch {
+			case strings.HasPrefix(rest, "?=") || strings.HasPrefix(rest, "?!") ||
+				strings.HasPrefix(rest, "?<=") || strings.HasPrefix(rest, "?<!"):
+				d.Lookarounds++
+			case strings.HasPrefix(rest, "?>") || strings.HasPrefix(rest, "?("):
+				d.Atomic++
+			}
+			stack = append(stack, frame{})
+		case c == ')':
+			if len(stack) > 1 {
+				group := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				top := &stack[len(stack)-1]
+				top.depth = max(top.depth, group.depth)
+				atom = group.depth
+			}
+		case c == '|':
+			d.Alternations++
+		case c == '*' || c == '+' || c == '?' || (c == '{' && rRegexRepeat.MatchString(string(p[i:]))):
+			if c == '{' {
+				i += len(rRegexRepeat.FindString(string(p[i:]))) - 1
+			}
+			if last >= 0 {
+				d.Quantifiers++
+				if last > 0 {
+					d.Nesting += last
+				}
+				top := &stack[len(stack)-1]
+				top.depth = max(top.depth, last+1)
+			}
+			/* Lazy and possessive quantifiers. */
+			if i+1 < len(p) && (p[i+1] == '?' || p[i+1] == '+') {
+				i++
+			}
+		case c == '^' || c == '$':
+		default:
+			atom = 0
+		}
+		last = atom
+	}
+
+	d.Score = len(p)/8 + 3*d.Alternations + 8*d.Lookarounds + 8*d.Backrefs + d.Quantifiers + 6*d.Nesting +
+		2*d.Classes + d.ClassItems/2 + 3*d.Negated + 6*d.Atomic
+	return d
+}
+
+/* Record a new challenge posted in channel, returns its round for the rest of its stats. */
+func StartRegexRound(server, channel, regex, tier string, difficulty int) int64 {
+	result, err := DB.Exec("INSERT INTO regex_challenge_rounds (server, channel, regex, tier, difficulty, posted) VALUES (?, ?, ?, ?, ?, ?)",
+		strings.ToLower(server), strings.ToLower(channel), regex, tier, difficulty, time.Now().Unix())
+	if err != nil {
+		log.Printf("[StartRegexRound] Error: %v\n", err)
+		return 0
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+func regexRoundMissed(round int64) {
+	if _, err := DB.Exec("UPDATE regex_challenge_rounds SET misses = misses + 1 WHERE id = ?", round); err != nil {
+		log.Printf("[regexRoundMissed] Error: %v\n", err)
+	}
+}
+
+func regexRoundSolved(round int64, user string) {
+	if _, err := DB.Exec("UPDATE regex_challenge_rounds SET solved = ?, solver = ? WHERE id = ?", time.Now().Unix(), user, round); err != nil {
+		log.Printf("[regexRoundSolved] Error: %v\n", err)
+	}
+}
+
+func regexRoundSkipped(round int64) {
+	if _, err := DB.Exec("UPDATE regex_challenge_rounds SET skipped = 1 WHERE id = ?", round); err != nil {
+		log.Printf("[regexRoundSkipped] Error: %v\n", err)
+	}
+}
+
+/*
+ * The tier of the next challenge of channel. Without adaptive tiers that's
+ * the configured one. Otherwise it's the tier of the last challenge, one up
+ * if most recent challenges were solved fast with few misses, one down if
+ * most weren't solved, were solved slowly or mostly missed.
+ */
+func NextRegexTier(server, channel string, config RegexChallengeConfig) RegexTier {
+	if !config.Adaptive {
+		return config.tier("")
+	}
+	rows, err := DB.Query("SELECT tier, posted, solved, misses FROM regex_challenge_rounds WHERE server = ? AND channel = ? "+
+		"ORDER BY id DESC LIMIT ?", strings.ToLower(server), strings.ToLower(channel), config.Window)
+	if err != nil {
+		log.Printf("[NextRegexTier] Error: %v\n", err)
+		return config.tier("")
+	}
+	defer rows.Close()
+	current := ""
+	rounds, solves, misses := 0, 0, 0
+	var times []int64
+	for rows.Next() {
+		var tier string
+		var posted, solved int64
+		var missed int
+		if rows.Scan(&tier, &posted, &solved, &missed) != nil {
+			continue
+		}
+		if current == "" {
+			current = tier
+		}
+		rounds++
+		misses += missed
+		if solved > 0 {
+			solves++
+			times = append(times, solved-posted)
+		}
+	}
+	i := config.tierIndex(current)
+	if rounds < 2 {
+		return config.Tiers[i]
+	}
+	median := time.Duration(0)
+	if len(times) > 0 {
+		slices.Sort(times)
+		median = time.Duration(times[len(times)/2]) * time.Second
+	}
+	missRate := 0.0
+	if misses+solves > 0 {
+		missRate = float64(misses) / float64(misses+solves)
+	}
+	solveRate := float64(solves) / float64(rounds)
+	switch {
+	case solveRate >= 0.8 && median <= time.Duration(config.FastSolve)*time.Minute && missRate < 0.5:
+		i = min(i+1, len(config.Tiers)-1)
+	case solveRate < 0.4 || median > time.Duration(config.SlowSolve)*time.Minute || missRate > 0.8:
+		i = max(i-1, 0)
+	}
+	log.Printf("[NextRegexTier] %s/%s: %d/%d solved, median %v, %.0f%% misses, next tier %s\n", server, channel, solves, rounds,
+		median, missRate*100, config.Tiers[i].Name)
+	return config.Tiers[i]
+}
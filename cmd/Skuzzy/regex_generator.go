@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	regexp "github.com/ando-masaki/go-pcre"
+	"log"
+	"math/rand"
+	"strings"
+)
+
+/*
+ * Regex challenges without the LLM. Patterns are composed from building
+ * blocks (IP addresses, dates, times, hex, quoted strings, identifiers,
+ * function calls...) joined by separators, and made harder with optional
+ * parts, repetitions, alternations, backreferences and lookaheads. Every
+ * piece builds a string it matches along with its pattern, so each regex
+ * comes with a sample that is checked against it before it's used.
+ */
+
+/* A piece of pattern and a string it matches. */
+type regexPart struct {
+	pattern string
+	sample  string
+}
+
+type regexGenerator struct {
+	groups int /* Named groups so far, to keep their names unique. */
+}
+
+/* Regex generator levels, from a single plain block to everything at once. */
+const maxRegexLevel = 8
+
+const (
+	lowerChars = "abcdefghijklmnopqrstuvwxyz"
+	upperChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars = "0123456789"
+	hexChars   = "0123456789abcdef"
+)
+
+var regexKeywords = []string{"func", "var", "let", "const", "return", "if", "else", "for", "while", "import", "null", "true", "false"}
+
+func pick[T any](choices ...T) T {
+	return choices[rand.Intn(len(choices))]
+}
+
+func randomString(charset string, n int) string {
+	var s strings.Builder
+	for range n {
+		s.WriteByte(charset[rand.Intn(len(charset))])
+	}
+	return s.String()
+}
+
+/* A chance of level out of maxRegexLevel, so harder levels use a feature more often. */
+func chance(level int) bool {
+	return rand.Intn(maxRegexLevel+1) < level
+}
+
+func (g *regexGenerator) ipv4(level int) regexPart {
+	octets := make([]string, 4)
+	for i := range octets {
+		octets[i] = fmt.Sprint(rand.Intn(256))
+	}
+	octet := `\d{1,3}`
+	if level >= 2 {
+		octet = `(?:25[0-5]|2[0-4]\d|1?\d?\d)`
+	}
+	return regexPart{octet + `(?:\.` + octet + `){3}`, strings.Join(octets, ".")}
+}
+
+func (g *regexGenerator) date(level int) regexPart {
+	sample := fmt.Sprintf("%04d-%02d-%02d", 1970+rand.Intn(130), 1+rand.Intn(12), 1+rand.Intn(28))
+	if level < 2 {
+		return regexPart{`\d{4}-\d{2}-\d{2}`, sample}
+	}
+	return regexPart{`(?:19|20)\d{2}-(?:0[1-9]|1[0-2])-(?:0[1-9]|[12]\d|3[01])`, sample}
+}
+
+func (g *regexGenerator) clock(level int) regexPart {
+	part := regexPart{`(?:[01]\d|2[0-3]):[0-5]\d`, fmt.Sprintf("%02d:%02d", rand.Intn(24), rand.Intn(60))}
+	if level >= 3 {
+		part.pattern += `(?::[0-5]\d)?`
+		if chance(4) {
+			part.sample += fmt.Sprintf(":%02d", rand.Intn(60))
+		}
+	}
+	return part
+}
+
+func (g *regexGenerator) hex(level int) regexPart {
+	n := pick(2, 4, 6, 8)
+	digits := randomString(hexChars, n)
+	if level >= 2 {
+		return regexPart{fmt.Sprintf(`0[xX][0-9a-fA-F]{%d}`, n), "0x" + strings.ToUpper(digits)}
+	}
+	return regexPart{fmt.Sprintf(`0x[0-9a-f]{%d}`, n), "0x" + digits}
+}
+
+func (g *regexGenerator) mac(level int) regexPart {
+	bytes := make([]string, 6)
+	for i := range bytes {
+		bytes[i] = randomString(hexChars, 2)
+	}
+	return regexPart{`[0-9a-f]{2}(?::[0-9a-f]{2}){5}`, strings.Join(bytes, ":")}
+}
+
+func (g *regexGenerator) identifier(level int) regexPart {
+	sample := randomString(lowerChars+upperChars+"_", 1) + randomString(lowerChars+digitChars+"_", rand.Intn(7))
+	if level >= 3 {
+		return regexPart{`[a-zA-Z_][a-zA-Z0-9_]{0,15}`, sample}
+	}
+	return regexPart{`[a-zA-Z_]\w*`, sample}
+}
+
+func (g *regexGenerator) number(level int) regexPart {
+	sample := fmt.Sprint(rand.Intn(10000))
+	if rand.Intn(2) == 0 {
+		sample = "-" + sample
+	}
+	if level < 2 {
+		return regexPart{`-?\d+`, sample}
+	}
+	if rand.Intn(2) == 0 {
+		sample += "." + randomString(digitChars, 1+rand.Intn(3))
+	}
+	return regexPart{`-?\d+(?:\.\d+)?`, sample}
+}
+
+func (g *regexGenerator) keyword(level int) regexPart {
+	words := append([]string{}, regexKeywords...)
+	rand.Shuffle(len(words), func(i, j int) { words[i], words[j] = words[j], words[i] })
+	words = words[:2+min(level, 3)]
+	return regexPart{"(?:" + strings.Join(words, "|") + ")", pick(words...)}
+}
+
+/* A quoted string, with the same quote at both ends through a backreference at higher levels. */
+func (g *regexGenerator) quoted(level int) regexPart {
+	text := randomString(lowerChars+" ", 1+rand.Intn(8))
+	if level >= 4 {
+		g.groups++
+		name := fmt.Sprintf("q%d", g.groups)
+		quote := pick(`"`, `'`)
+		return regexPart{`(?<` + name + `>["'])[^"'\n]*\k<` + name + `>`, quote + text + quote}
+	}
+	return regexPart{`"[^"\n]*"`, `"` + text + `"`}
+}
+
+/* name(arg, arg...) with numbers or strings as arguments. */
+func (g *regexGenerator) call(level int) regexPart {
+	name := g.identifier(level)
+	arg := g.alternation(level, g.number, g.quoted)
+	args := g.repeat(arg, regexPart{`,\s*`, ", "}, 0, 1+level/2, level)
+	return regexPart{name.pattern + `\(` + "(?:" + args.pattern + ")?" + `\)`, name.sample + "(" + args.sample + ")"}
+}
+
+/* One of the blocks, the last ones only at higher levels. */
+func (g *regexGenerator) block(level int) regexPart {
+	blocks := []func(int) regexPart{g.ipv4, g.date, g.clock, g.hex, g.mac, g.identifier, g.number, g.keyword}
+	if level >= 2 {
+		blocks = append(blocks, g.quoted, g.call)
+	}
+	return pick(blocks...)(level)
+}
+
+/* Either of two blocks. */
+func (g *regexGenerator) alternation(level int, a, b func(int) regexPart) regexPart {
+	first, second := a(level), b(level)
+	sample := first.sample
+	if rand.Intn(2) == 0 {
+		sample = second.sample
+	}
+	return regexPart{"(?:" + first.pattern + "|" + second.pattern + ")", sample}
+}
+
+/* part repeated between least and most times, separated by separator, each with its own sample. */
+func (g *regexGenerator) repeat(part, separator regexPart, least, most, level int) regexPart {
+	if strings.Contains(part.pattern, "(?<") {
+		/* Named groups can't be repeated in the pattern. */
+		return part
+	}
+	samples := []string{part.sample}
+	for range least + rand.Intn(most-least+1) {
+		samples = append(samples, part.sample)
+	}
+	return regexPart{fmt.Sprintf("%s(?:%s%s){%d,%d}", part.pattern, separator.pattern, part.pattern, least, most),
+		strings.Join(samples, separator.sample)}
+}
+
+func (g *regexGenerator) separator() regexPart {
+	return pick(
+		regexPart{" ", " "},
+		regexPart{`\s+`, " "},
+		regexPart{",", ","},
+		regexPart{";", ";"},
+		regexPart{`\s*=\s*`, " = "},
+		regexPart{`:\s*`, ": "},
+		regexPart{" -> ", " -> "},
+		regexPart{`\|`, "|"},
+	)
+}
+
+/*
+ * A whole regex at level: a few blocks with separators between them, some
+ * optional, repeated or alternatives, and lookaheads the sample satisfies.
+ */
+func (g *regexGenerator) regex(level int) NewRegex {
+	var pattern, sample strings.Builder
+	count := 1 + rand.Intn(1+level/2)
+	for i := range count {
+		part := g.block(level)
+		switch {
+		case level >= 2 && chance(level-1):
+			part = g.alternation(level, func(int) regexPart { return part }, g.block)
+		case level >= 3 && chance(level-2):
+			part = g.repeat(part, g.separator(), 1, 1+level/3, level)
+		}
+		separator := regexPart{}
+		if i > 0 {
+			separator = g.separator()
+		}
+		if i > 0 && level >= 2 && chance(level/2) {
+			pattern.WriteString("(?:" + separator.pattern + part.pattern + ")?")
+			if rand.Intn(2) == 0 {
+				continue
+			}
+		} else {
+			pattern.WriteString(separator.pattern + part.pattern)
+		}
+		sample.WriteString(separator.sample + part.sample)
+	}
+
+	var lookaheads string
+	if level >= 5 {
+		s := sample.String()
+		if strings.ContainsAny(s, digitChars) {
+			lookaheads += `(?=.*\d)`
+		}
+		if strings.ContainsAny(s, upperChars) && chance(level-4) {
+			lookaheads += `(?=.*[A-Z])`
+		}
+		for _, absent := range []regexPart{{"--", "--"}, {`\.\.`, ".."}, {" {2}", "  "}, {"__", "__"}, {"::", "::"}} {
+			if !strings.Contains(s, absent.sample) && chance(level-5) {
+				lookaheads += `(?!.*` + absent.pattern + `)`
+				break
+			}
+		}
+	}
+	return NewRegex{Regex: "^" + lookaheads + pattern.String() + "$", Sample: sample.String()}
+}
+
+/*
+ * A regex challenge within tier, with a sample it matches. Regexes are made
+ * at a level raised or lowered until the difficulty falls in the tier; if
+ * none does, the closest is returned.
+ */
+func GenerateRegex(tier RegexTier) (NewRegex, *regexp.Regexp) {
+	var best NewRegex
+	var bestRegex *regexp.Regexp
+	bestDistance := -1
+	level := min(tier.Min/10, maxRegexLevel)
+	for range 60 {
+		candidate := (&regexGenerator{}).regex(level)
+		compiled, err := regexp.Compile(candidate.Regex)
+		if err != nil || !compiled.MatchString(candidate.Sample) {
+			log.Printf("[GenerateRegex] Warning, generated a bad regex %q for %q: %v\n", candidate.Regex, candidate.Sample, err)
+			continue
+		}
+		score := RegexDifficultyOf(candidate.Regex).Score
+		distance := 0
+		if score < tier.Min {
+			distance = tier.Min - score
+			level = min(level+1, maxRegexLevel)
+		} else if !tier.Contains(score) {
+			distance = score - tier.Max
+			level = max(level-1, 0)
+		}
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestRegex, bestDistance = candidate, compiled, distance
+		}
+		if distance == 0 {
+			break
+		}
+	}
+	return best, bestRegex
+}
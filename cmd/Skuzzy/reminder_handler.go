@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,16 +23,32 @@ type ReminderChangeParseResult struct {
 	NewReminderMessage string `json:"new_reminder_message"`
 }
 
-/* Channel for receiving parsed reminder data from the LLM. */
-var ReminderParseQueue = make(chan struct {
+/* Raw LLM output for a reminder request, along with the request that produced it. */
+type ReminderParse struct {
 	Result      string
 	OriginalReq DeepseekRequest
-})
+}
+
+/* Channels for receiving parsed reminder data from the LLM, one per server. */
+var ReminderParseQueues = make(map[string]chan ReminderParse)
+var ReminderParseQueuesMutex = sync.Mutex{}
+
+/* The reminder parse queue for a server, created on first use. */
+func ReminderParseQueue(server string) chan ReminderParse {
+	ReminderParseQueuesMutex.Lock()
+	defer ReminderParseQueuesMutex.Unlock()
+	queue, ok := ReminderParseQueues[server]
+	if !ok {
+		queue = make(chan ReminderParse)
+		ReminderParseQueues[server] = queue
+	}
+	return queue
+}
 
 /* Processes the parsed reminder data from the LLM. */
 func ReminderHandler(settings *ServerConfig) {
 	for {
-		parsedData := <-ReminderParseQueue
+		parsedData := <-ReminderParseQueue(settings.Name)
 		var result ReminderParseResult
 		err := json.Unmarshal([]byte(parsedData.Result), &result)
 		if err != nil {
@@ -68,7 +85,7 @@ func ReminderHandler(settings *ServerConfig) {
 					PromptName: "reminder_confirm",
 					User:       parsedData.OriginalReq.User,
 				}
-				DeepseekQueue <- req
+				DeepseekQueue(req.Server) <- req
 			} else {
 				/* Not a reminder, so re-queue as regular chat message. */
 				requeueAsChat(settings, parsedData.OriginalReq)
@@ -100,7 +117,7 @@ func requeueAsChat(settings *ServerConfig, originalReq DeepseekRequest) {
 	log.Printf("LLM determined this was not a reminder, reqeueing as chat: %s",
 		originalReq.OriginalQuery)
 
-	_, text := FindPrompt(settings, "deepseek", originalReq.Channel, "", originalReq.OriginalQuery)
+	_, text := FindPrompt(settings, ChannelLLM(settings, originalReq.Channel), originalReq.Channel, "", originalReq.OriginalQuery)
 
 	/* Can't get backlog available here. Do we care? */
 	text = strings.Replace(text, "{NICK}", settings.Nick, -1)
@@ -115,5 +132,5 @@ func requeueAsChat(settings *ServerConfig, originalReq DeepseekRequest) {
 		request:   originalReq.OriginalQuery,
 		User:      originalReq.User,
 	}
-	DeepseekQueue <- req
+	DeepseekQueue(req.Server) <- req
 }
@@ -235,7 +235,7 @@ func fireReminder(r *Reminder, settings *ServerConfig) {
 		request:   "The reminder is now due. Please generate the notification.",
 		sysprompt: sysPrompt,
 	}
-	DeepseekQueue <- req
+	DeepseekQueue(req.Server) <- req
 
 	/* Clean the reminder from db and active timers after it's sent. */
 	RemoveReminder(r)
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+ * Challenges are worth points, optionally decaying as more people solve them
+ * (the same curve CTFd uses), and can require other challenges to be solved
+ * first. Solves are kept in ctf_solves and summed into the scoreboard.
+ */
+
+const defaultCTFPoints = 100
+
+/* Points taken off for each hint. */
+const ctfHintPenalty = 10
+
+var ErrAlreadySolved = errors.New("already solved")
+
+/* What a solve was worth when it happened. */
+type CTFSolve struct {
+	Points     int
+	FirstBlood int /* Bonus, 0 unless nobody had solved it before. */
+	Solves     int /* Solves before this one. */
+}
+
+type CTFStanding struct {
+	User        string
+	Points      int
+	Solves      int
+	FirstBloods int
+	Hints       int
+	LastSolve   int64
+}
+
+/* Points for a challenge that has been solved solves times. */
+func (ctf CTF) Value(solves int) int {
+	points := ctf.Points
+	if points <= 0 {
+		points = defaultCTFPoints
+	}
+	if ctf.Decay <= 0 || solves <= 0 {
+		return points
+	}
+	minimum := ctf.MinPoints
+	if minimum <= 0 || minimum > points {
+		minimum = points / 4
+	}
+	decayed := float64(points) - float64(points-minimum)*float64(solves*solves)/float64(ctf.Decay*ctf.Decay)
+	return max(int(math.Ceil(decayed)), minimum)
+}
+
+func (config *CTFConfig) FirstBloodFor(ctf CTF) int {
+	if ctf.FirstBlood > 0 {
+		return ctf.FirstBlood
+	}
+	return config.FirstBlood
+}
+
+/*
+ * The challenges to solve before name. Without requires, that's the challenges
+ * one level below in the same channel, like the old strictly linear levels.
+ * Disabled challenges can't be solved anymore, so their own prerequisites
+ * are required instead.
+ */
+func (config *CTFConfig) Prerequisites(name string) []string {
+	return config.prerequisites(name, map[string]bool{name: true})
+}
+
+func (config *CTFConfig) prerequisites(name string, seen map[string]bool) []string {
+	ctf, ok := config.CTFFlags[name]
+	if !ok {
+		return nil
+	}
+	direct := ctf.Requires
+	if len(direct) == 0 {
+		for k, other := range config.CTFFlags {
+			if other.Level > 0 && other.Level == ctf.Level-1 && strings.EqualFold(other.Channel, ctf.Channel) {
+				direct = append(direct, k)
+			}
+		}
+	}
+	var previous []string
+	for _, required := range direct {
+		if other, ok := config.CTFFlags[required]; ok && other.Disabled {
+			if !seen[required] {
+				seen[required] = true
+				previous = append(previous, config.prerequisites(required, seen)...)
+			}
+			continue
+		}
+		previous = append(previous, required)
+	}
+	if len(ctf.Requires) == 0 || len(previous) != len(direct) {
+		slices.Sort(previous)
+		previous = slices.Compact(previous)
+	}
+	return previous
+}
+
+/* Whether start can be reached again from current by following prerequisites. */
+func (config *CTFConfig) requiresItself(start, current string, seen map[string]bool) bool {
+	for _, name := range config.Prerequisites(current) {
+		if name == start {
+			return true
+		}
+		if !seen[name] {
+			seen[name] = true
+			if config.requiresItself(start, name, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Disable challenges that require unknown challenges or themselves, so nobody is stuck. */
+func (config *CTFConfig) checkPrerequisites() {
+	for changed := true; changed; {
+		changed = false
+		for name := range config.CTFFlags {
+			for _, required := range config.Prerequisites(name) {
+				if _, ok := config.CTFFlags[required]; !ok {
+					log.Printf("[LoadCTFConfig] Disabling challenge %s: requires unknown challenge %s\n", name, required)
+					delete(config.CTFFlags, name)
+					changed = true
+					break
+				}
+			}
+		}
+		if changed {
+			continue
+		}
+		for name := range config.CTFFlags {
+			if config.requiresItself(name, name, map[string]bool{}) {
+				log.Printf("[LoadCTFConfig] Disabling challenge %s: its prerequisites require it\n", name)
+				delete(config.CTFFlags, name)
+				changed = true
+			}
+		}
+	}
+}
+
+/* The challenges user has solved on server. */
+func CTFUserSolves(server, user string) map[string]bool {
+	solved := make(map[string]bool)
+	rows, err := DB.Query("SELECT challenge FROM ctf_solves WHERE server = ? AND user = ?", strings.ToLower(server), strings.ToLower(user))
+	if err != nil {
+		log.Printf("[CTFUserSolves] Error: %v\n", err)
+		return solved
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var challenge string
+		if rows.Scan(&challenge) == nil {
+			solved[challenge] = true
+		}
+	}
+	return solved
+}
+
+/* How many times each challenge has been solved on server. */
+func CTFSolveCounts(server string) map[string]int {
+	return ctfSolveCountsUntil(server, 0)
+}
+
+/* Solve counts up to a time, 0 for all of them. */
+func ctfSolveCountsUntil(server string, until int64) map[string]int {
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	counts := make(map[string]int)
+	rows, err := DB.Query("SELECT challenge, COUNT(*) FROM ctf_solves WHERE server = ? AND solved <= ? GROUP BY challenge",
+		strings.ToLower(server), until)
+	if err != nil {
+		log.Printf("[CTFSolveCounts] Error: %v\n", err)
+		return counts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var challenge string
+		var count int
+		if rows.Scan(&challenge, &count) == nil {
+			counts[challenge] = count
+		}
+	}
+	return counts
+}
+
+/* Most points first, ties go to whoever got there first. */
+func SortStandings(standings map[string]*CTFStanding) []CTFStanding {
+	var sorted []CTFStanding
+	for _, s := range standings {
+		sorted = append(sorted, *s)
+	}
+	slices.SortFunc(sorted, func(a, b CTFStanding) int {
+		if a.Points != b.Points {
+			return b.Points - a.Points
+		}
+		if a.LastSolve != b.LastSolve {
+			return cmp.Compare(a.LastSolve, b.LastSolve)
+		}
+		return strings.Compare(a.User, b.User)
+	})
+	return sorted
+}
+
+/* The top count standings on one line. */
+func FormatStandings(standings []CTFStanding, count int) string {
+	var response strings.Builder
+	for i, s := range standings[:min(len(standings), count)] {
+		response.WriteString(fmt.Sprintf(" | %d. %s: %d (%d solves", i+1, s.User, s.Points, s.Solves))
+		if s.FirstBloods > 0 {
+			response.WriteString(fmt.Sprintf(", %d 🩸", s.FirstBloods))
+		}
+		response.WriteString(") |")
+	}
+	return response.String()
+}
+
+/*
+ * Give users who only have a level in ctf_scores, from before ctf_solves
+ * existed, a solve for every challenge of their channel up to that level.
+ */
+func MigrateCTFLevels(server string, config *CTFConfig) {
+	server = strings.ToLower(server)
+	rows, err := DB.Query("SELECT id, user, level, last_attempt FROM ctf_scores WHERE id LIKE ? AND level > 0 "+
+		"AND user NOT IN (SELECT user FROM ctf_solves WHERE server = ?)", server+"/%", server)
+	if err != nil {
+		log.Printf("[MigrateCTFLevels] Error: %v\n", err)
+		return
+	}
+	type legacyLevel struct {
+		channel, user string
+		level         int
+		solved        int64
+	}
+	var legacy []legacyLevel
+	for rows.Next() {
+		var id, user string
+		var level int
+		var solved int64
+		if err := rows.Scan(&id, &user, &level, &solved); err != nil {
+			continue
+		}
+		parts := strings.SplitN(id, "/", 3)
+		if len(parts) == 3 {
+			legacy = append(legacy, legacyLevel{parts[1], user, level, solved})
+		}
+	}
+	rows.Close()
+	for _, l := range legacy {
+		for name, ctf := range config.CTFFlags {
+			if ctf.Level < 1 || ctf.Level > l.level || !strings.EqualFold(ctf.Channel, l.channel) {
+				continue
+			}
+			_, err := DB.Exec("INSERT OR IGNORE INTO ctf_solves (server, channel, challenge, user, account, first_blood, solved) "+
+				"VALUES (?, ?, ?, ?, '', 0, ?)", server, l.channel, name, l.user, l.solved)
+			if err != nil {
+				log.Printf("[MigrateCTFLevels] Error migrating %s: %v\n", l.user, err)
+			}
+		}
+		log.Printf("[MigrateCTFLevels] Migrated %s's level %d in %s\n", l.user, l.level, l.channel)
+	}
+}
+
+/*
+ * One line per challenge, for `!challenges`. Challenges of channel only, unless
+ * it's empty. While the event is frozen solve counts and values are as they were at the freeze.
+ */
+func ChallengeList(server, channel, user string, config *CTFConfig) []string {
+	solved := CTFUserSolves(server, user)
+	if team, err := CTFUserTeam(server, user); err == nil {
+		for name := range CTFTeamSolves(server, team) {
+			solved[name] = true
+		}
+	}
+	counts := ctfSolveCountsUntil(server, config.Event.FrozenAt(time.Now()))
+	var names []string
+	for name, ctf := range config.CTFFlags {
+		if !ctf.Disabled && (channel == "" || strings.EqualFold(ctf.Channel, channel)) {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		ca, cb := config.CTFFlags[a], config.CTFFlags[b]
+		return cmp.Or(strings.Compare(ca.Category, cb.Category), cmp.Compare(ca.Level, cb.Level), strings.Compare(a, b))
+	})
+	var lines []string
+	for _, name := range names {
+		ctf := config.CTFFlags[name]
+		status := ""
+		if solved[name] {
+			status = " ✓ solved"
+		} else {
+			var missing []string
+			for _, required := range config.Prerequisites(name) {
+				if !solved[required] {
+					missing = append(missing, required)
+				}
+			}
+			if len(missing) > 0 {
+				status = " 🔒 solve " + strings.Join(missing, ", ") + " first"
+			}
+		}
+		category := ""
+		if ctf.Category != "" {
+			category = " [" + ctf.Category + "]"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %s: %d points, %d solves%s", name, category, ctf.Channel,
+			ctf.Value(counts[name]), counts[name], status))
+	}
+	if len(lines) == 0 {
+		lines = []string{"No challenges."}
+	}
+	return lines
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "challenges",
+		Description: "List the CTF challenges with their points and what you've solved",
+		Category:    "CTF Challenge",
+		Channel:     true,
+		Private:     true,
+		Cooldown:    10 * time.Second,
+		PerUser:     true,
+		Handler: func(ctx *CommandContext) {
+			ctfconfig := ServerCTF(ctx.Settings.Name)
+			if ctfconfig == nil {
+				ctx.Reply("There is no CTF running here.")
+				return
+			}
+			for _, line := range ChallengeList(ctx.Settings.Name, ctx.Channel, ctx.User, ctfconfig) {
+				send_irc_priority(ctx.Settings.Name, ctx.User, line, PriorityLow)
+			}
+		},
+	})
+}
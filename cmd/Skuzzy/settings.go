@@ -4,27 +4,48 @@ import (
 	"gopkg.in/yaml.v3"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 type ChannelConfig struct {
-	Name              string   `yaml:"name"`
-	LLM               string   `yaml:"llm,omitempty"`
-	SysPromptsEnabled []string `yaml:"sys_prompts_enabled"`
+	Name              string                `yaml:"name"`
+	LLM               string                `yaml:"llm,omitempty"`
+	SysPromptsEnabled []string              `yaml:"sys_prompts_enabled"`
+	Commands          []string              `yaml:"commands,omitempty"`          /* Only these commands are enabled, all if empty. */
+	DisabledCommands  []string              `yaml:"disabled_commands,omitempty"` /* Commands turned off in this channel. */
+	Moderation        string                `yaml:"moderation,omitempty"`        /* "chanserv" (default) or "mode" to set modes ourselves when opped. */
+	AntiSpam          *AntiSpamConfig       `yaml:"antispam,omitempty"`
+	Classifier        *ClassifierConfig     `yaml:"llm_moderation,omitempty"`
+	RegexChallenge    *RegexChallengeConfig `yaml:"regex_challenge,omitempty"` /* Difficulty tiers of the regex challenge. */
 	Backlog           []string
 }
 
 type LLM struct {
-	Name  string `yaml:"name"`
-	Type  string `yaml:"type"`
-	Model string `yaml:"model"`
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"` /* deepseek, openai or ollama */
+	Model  string `yaml:"model"`
+	URL    string `yaml:"url,omitempty"`
+	APIKey string `yaml:"api_key,omitempty"`
 }
 
 type CTF struct {
-	Channel     string            `yaml:"channel"`
-	Flag        string            `yaml:"flag"`
-	Level       int               `yaml:"level"`
-	Hints       map[string]string `yaml:"hints"`
-	Description string            `yaml:"description,omitempty"`
+	Channel       string   `yaml:"channel"`
+	Flag          string   `yaml:"flag,omitempty"`           /* Plaintext, prefer flag_hash. */
+	FlagHash      string   `yaml:"flag_hash,omitempty"`      /* From 'Skuzzy hashflag'. */
+	FlagRegex     string   `yaml:"flag_regex,omitempty"`     /* For answers that vary, matched against the whole answer. */
+	CaseSensitive bool     `yaml:"case_sensitive,omitempty"` /* Flags are case-insensitive by default. */
+	FlagFormat    string   `yaml:"flag_format,omitempty"`    /* Overrides the config's flag_format. */
+	Level         int      `yaml:"level"`
+	Hints         Hints    `yaml:"hints,omitempty"`
+	Description   string   `yaml:"description,omitempty"`
+	Category      string   `yaml:"category,omitempty"`
+	Points        int      `yaml:"points,omitempty"`      /* Value before anyone solves it, default 100. */
+	MinPoints     int      `yaml:"min_points,omitempty"`  /* The least it decays to, default a quarter of points. */
+	Decay         int      `yaml:"decay,omitempty"`       /* Solves until it's worth min_points, 0 for a fixed value. */
+	FirstBlood    int      `yaml:"first_blood,omitempty"` /* Bonus for the first solve, overrides the config's. */
+	Requires      []string `yaml:"requires,omitempty"`    /* Challenges to solve first, by default those a level below in the channel. */
+	Disabled      bool     `yaml:"disabled,omitempty"`    /* Kept in the file, but not playable. */
 }
 
 type ServerConfig struct {
@@ -41,13 +62,38 @@ type ServerConfig struct {
 	SysPromptGlobalPrefix string            `yaml:"sys_prompt_global_suffix"`
 	DeepseekAPIKey        string            `yaml:"deepseek_api_key"`
 	MaxRemindersPerUser   int               `yaml:"max_reminders_per_user"`
+	ConversationBudget    int               `yaml:"conversation_token_budget,omitempty"`
 	ServerLogFile         string            `yaml:"server_log_file"`
 	RelayBots             []string          `yaml:"relay_bots,omitempty"`
+	Owners                []string          `yaml:"owners,omitempty"` /* $a:account or nick!user@host masks with the owner role everywhere. */
 	CtfConfigPath         string            `yaml:"ctf_config_path,omitempty"`
+	SubmissionKey         string            `yaml:"submission_key,omitempty"`  /* Secret for the hashes of recorded flag submissions. */
+	MaxReplyLines         int               `yaml:"max_reply_lines,omitempty"` /* Lines of a channel reply before truncating, default 4, -1 for no limit. */
+	MaxPMLines            int               `yaml:"max_pm_lines,omitempty"`    /* Same for private messages, default 20. */
+	FloodBurst            int               `yaml:"flood_burst,omitempty"`     /* Lines sent back to back before throttling, default 5. */
+	FloodRate             float64           `yaml:"flood_rate,omitempty"`      /* Lines per second after the burst, default 1. */
+}
+
+/* The configuration of one of our channels, or nil. */
+func (settings *ServerConfig) FindChannel(name string) *ChannelConfig {
+	for i := range settings.Channels {
+		if strings.EqualFold(settings.Channels[i].Name, name) {
+			return &settings.Channels[i]
+		}
+	}
+	return nil
 }
 
 type CTFConfig struct {
-	CTFFlags map[string]CTF `yaml:"ctf_flags"`
+	FlagFormat string            `yaml:"flag_format,omitempty"` /* e.g. hackers{...}, only the part inside is compared. */
+	CTFFlags   map[string]CTF    `yaml:"ctf_flags"`
+	Throttle   ThrottleConfig    `yaml:"throttle,omitempty"`
+	FirstBlood int               `yaml:"first_blood,omitempty"` /* Bonus points for the first solve of a challenge. */
+	Event      *CTFEvent         `yaml:"event,omitempty"`       /* Without one, the CTF is always open. */
+	TeamSize   int               `yaml:"team_size,omitempty"`   /* Most members in a team, default 4. */
+	Onboarding *OnboardingConfig `yaml:"onboarding,omitempty"`  /* Review and welcome of those who solve the topic challenge. */
+
+	modified time.Time /* Of the file when it was loaded. */
 }
 
 func LoadServerConfig(path string) (*ServerConfig, error) {
@@ -71,6 +117,9 @@ func LoadServerConfig(path string) (*ServerConfig, error) {
 func LoadCTFConfig(path string) (*CTFConfig, error) {
 	var config CTFConfig
 
+	if info, err := os.Stat(path); err == nil {
+		config.modified = info.ModTime()
+	}
 	file_contents, err := os.ReadFile(path)
 	if err != nil {
 		log.Printf("[LoadCTFConfig] Error loading settings from %v: %v", path, err)
@@ -81,6 +130,29 @@ func LoadCTFConfig(path string) (*CTFConfig, error) {
 		log.Printf("[LoadCTFConfig] Error loading settings from %v: %v", path, err)
 		return &config, err
 	}
+	for name, ctf := range config.CTFFlags {
+		if ctf.Disabled {
+			/* Kept, so its solves still score and it still counts as a prerequisite. */
+			log.Printf("[LoadCTFConfig] Challenge %s is disabled\n", name)
+		}
+		if err := ctf.Validate(); err != nil {
+			log.Printf("[LoadCTFConfig] Disabling challenge %s: %v\n", name, err)
+			delete(config.CTFFlags, name)
+		}
+	}
+	config.checkPrerequisites()
+	if config.Event != nil {
+		if err := config.Event.Validate(); err != nil {
+			log.Printf("[LoadCTFConfig] Error in the event: %v\n", err)
+			return &config, err
+		}
+	}
+	if config.Onboarding != nil {
+		if err := config.Onboarding.Validate(); err != nil {
+			log.Printf("[LoadCTFConfig] Disabling onboarding: %v\n", err)
+			config.Onboarding = nil
+		}
+	}
 	log.Printf("[LoadCTFConfig] Loaded configuration from %s\n", path)
 	return &config, nil
 }
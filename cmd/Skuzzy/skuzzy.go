@@ -9,27 +9,14 @@ import (
 	"time"
 )
 
-var Help = `
-Help about the commands I support is organized in the format of 'Command - Description'
-General commands:
-!help - Send this help message
-!topic, !topic_challenge - Send help message about solving the topic
-!doors_and_corners - Send a help message about solving the "doors and corners" (level 2) challenge
-CTF Challenge:
-!ctf_scores - Display the CTF score stats for the channel
-!<hintname> - Display CTF hints (will be sent to your pirvate messages)
-Regex Challenge
-"solution" - A message in a regex challenge enabled channel beginning and ending with a double quote will be evaluated for ap possible solution.
-!next regex - Take a -50 point hint and generate a new challenge
-!reges scores - Display regex challenge score stats
-!quiet user - Allows authorized users to quiet a user/mask via ChanServ
-!unquiet user - Allows authorized users to unquiet a user/mask via ChanServ
-LLM commands:
+/* Usage of the LLM, appended to the help generated from the registered commands. */
+var LLMHelp = `LLM commands:
 To talk to the bot, either mention it and append a comma, or begin your message with '~~'
 ~~|<botname>, - A message starting with the bot's nick and a separator (such as a comma or a colon) will initiate a chat-completion session.
 ~~|<botname>, @@sysprompt=default - An LLM query containing this will cause the bot to load the prompt after '=' and remember that prompt for the user.
 ~~|<botname>, remind me ... - have the LLM remind you of something after some time.
 ~~|<botname>, @reload ... - if '@reload' is mentioned in the LLM query, the sys prompt is reloaded (before evaluation)
+~~|<botname>, @reset ... - if '@reset' is mentioned in the LLM query, the bot forgets its earlier conversation with you
 ~~|<botname>, what's your version? - If the default prompt is enabled, asking it its version will display the current version.
 `
 
@@ -38,9 +25,9 @@ Figure out what the topic is to the fullest extent possible.
 DO NOT use AI or LLM tools to solve the topic.
 Be ready to explain your solution and thinking process.
 When you figure out the whole thing, send your response to me directly, I will check if that matches the expected answer and post a message congartulating you in the channel.
-When an OP is around, they will ask you questions about your solution and add you to the #hackers libera community.
+An OP will then be asked to review your solution with you. Once they approve it, you are voiced and added to the #hackers libera community automatically.
 You can request hints by typing the hint name such as '!hint1', '!hint2' and '!hint3', directly to me or in the channel.
-Each attempt to get a hint will cost you 10 points out of a maximum of 100 points for the topic challenge (level 1). So messaging '!hint1' twice will cost you 20 points, and your final point will be 80 points.
+Each hint costs 10 points out of a maximum of 100 points for the topic challenge (level 1), once: asking for the same hint again is free.
 Being part of the #hackers libera community means:
 - You get +V privileges (cosmetic, unless we enable moderation in times of spam)
 - You can send OPs your Github id to get an invite to our Github community (commit access to repos, access to create your own repos,etc..)
@@ -66,29 +53,36 @@ func setupLogging(LogFile string) {
 	log.Println("Logging started")
 }
 
-func ServerRun(settings *ServerConfig) {
+/* One connection attempt, returns when the connection ends. */
+func ServerRun(settings *ServerConfig, sup *Supervisor) error {
 	log.Printf("Connecting to %s (%s)\n", settings.Name, settings.Host)
 	err := irc_connect(settings)
 	if err != nil {
-		log.Printf("Error connecting to %s (%s):%v\nReconnecting in 5 seconds...", settings.Name, settings.Host, err)
-		return
+		log.Printf("Error connecting to %s (%s):%v\n", settings.Name, settings.Host, err)
+		return err
 	}
+	sup.setState(StateRegistering)
 
 	LoadSysPrompts(settings)
 
-	err = LoadReminders(settings)
-	if err != nil {
-		log.Printf("Error loading reminders for %s: %v", settings.Name, err)
-	}
-
-	for _, llm := range settings.LLMS {
-		if strings.EqualFold(llm.Type, "deepseek") {
-			log.Printf("Starting LLM go routine for %s\n", llm.Name)
-			go Deepseek(settings, llm)
+	sup.loadOnce.Do(func() {
+		err := LoadReminders(settings)
+		if err != nil {
+			log.Printf("Error loading reminders for %s: %v", settings.Name, err)
 		}
-	}
-	//go Ping(settings)
-	irc_loop(settings)
+		err = LoadModExpiries(settings)
+		if err != nil {
+			log.Printf("Error loading moderation expiries for %s: %v", settings.Name, err)
+		}
+		if ctfconfig := ServerCTF(settings.Name); ctfconfig != nil {
+			MigrateCTFLevels(settings.Name, ctfconfig)
+		}
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go sup.pinger(done)
+	return irc_loop(settings)
 }
 func server(configuration string) {
 	log.Printf("Loading %v\n", configuration)
@@ -97,14 +91,27 @@ func server(configuration string) {
 		return
 	}
 	go ReminderHandler(settings) /* Start reminder handler goroutine for this server. */
-	log.Printf("Loaded settings for %v\n", settings.Name)
-	for {
-		ServerRun(settings)
-		time.Sleep(5 * time.Second)
+	go SubmissionWorker(settings)
+	if len(settings.LLMS) > 0 {
+		/* Started once per server rather than on every reconnect. */
+		log.Printf("Starting LLM go routine for %s\n", settings.Name)
+		go LLMWorker(settings)
 	}
+	log.Printf("Loaded settings for %v\n", settings.Name)
+	NewSupervisor(settings).Run()
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hashflag":
+			os.Exit(hashFlagCommand(os.Args[2:]))
+		case "importctfd":
+			os.Exit(importCTFdCommand(os.Args[2:]))
+		case "exportctfd":
+			os.Exit(exportCTFdCommand(os.Args[2:]))
+		}
+	}
 	log.Println("[Main] Starting up.")
 
 	var servers []string
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* Maximum IRC line length including CRLF. */
+const maxIRCMessage = 512
+
+/*
+ * Length assumed for our own ":nick!user@host " prefix until the server shows us
+ * the real one: 32 byte nick, 10 byte user, 63 byte host.
+ */
+const defaultPrefixLen = 1 + 32 + 1 + 10 + 1 + 63 + 1
+
+/* Bytes available for the text of a PRIVMSG to target, given our prefix length. */
+func PayloadLimit(prefixLen int, target string) int {
+	if prefixLen <= 0 {
+		prefixLen = defaultPrefixLen
+	}
+	return maxIRCMessage - len("\r\n") - prefixLen - len("PRIVMSG ") - len(target) - len(" :")
+}
+
+/*
+ * Split message into chunks of at most limit bytes, breaking on spaces where
+ * possible and never inside a UTF-8 sequence, grapheme cluster or colour code.
+ * Formatting that is active at the end of a chunk is re-applied at the start of the next.
+ * If there would be more than maxLines chunks, the last kept one ends with marker
+ * and truncated is true. maxLines < 1 means no limit.
+ */
+func SplitIRCMessage(message string, limit int, maxLines int, marker string) (chunks []string, truncated bool) {
+	if limit < 32 {
+		limit = 32
+	}
+	var format ircFormat
+	message = strings.TrimSpace(message)
+	for len(message) > 0 {
+		prefix := format.codes()
+		avail := limit - len(prefix)
+		last := maxLines > 0 && len(chunks) == maxLines-1
+		if len(message) <= avail {
+			chunks = append(chunks, prefix+message)
+			break
+		}
+		if last {
+			cut := splitPoint(message, avail-len(marker))
+			chunks = append(chunks, prefix+strings.TrimRight(message[:cut], " ")+marker)
+			return chunks, true
+		}
+		cut := splitPoint(message, avail)
+		chunk := strings.TrimRight(message[:cut], " ")
+		format.scan(message[:cut])
+		chunks = append(chunks, prefix+chunk)
+		message = strings.TrimLeft(message[cut:], " ")
+	}
+	return chunks, false
+}
+
+/* Where to cut s so that s[:cut] fits in avail bytes. */
+func splitPoint(s string, avail int) int {
+	if avail >= len(s) {
+		return len(s)
+	}
+	if avail < 1 {
+		avail = 1
+	}
+	cut := avail
+	/* Back up to the start of a rune. */
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	/* Don't separate a base character from its combining marks, joiners or modifiers. */
+	for cut > 0 {
+		r, _ := utf8.DecodeRuneInString(s[cut:])
+		prev, _ := utf8.DecodeLastRuneInString(s[:cut])
+		if !extendsGrapheme(r) && prev != '\u200d' {
+			break
+		}
+		cut -= utf8.RuneLen(prev)
+		if cut < 0 {
+			cut = 0
+		}
+	}
+	/* Don't cut a colour code (\x03NN,NN) in half. */
+	if i := strings.LastIndexByte(s[:cut], '\x03'); i >= 0 && cut-i <= 5 {
+		cut = i
+	}
+	/* Prefer the last space, unless that would waste more than half the line. */
+	if i := strings.LastIndexByte(s[:cut], ' '); i > avail/2 {
+		cut = i + 1
+	}
+	if cut < 1 {
+		/* Nothing sensible to cut at, take one whole rune. */
+		_, size := utf8.DecodeRuneInString(s)
+		cut = size
+	}
+	return cut
+}
+
+func extendsGrapheme(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me) ||
+		r == '\u200d' || /* Zero width joiner. */
+		(r >= '\ufe00' && r <= '\ufe0f') || /* Variation selectors. */
+		(r >= 0x1f3fb && r <= 0x1f3ff) /* Skin tone modifiers. */
+}
+
+/* IRC formatting state, as toggled by the mIRC control codes. */
+type ircFormat struct {
+	bold, italic, underline, strike, mono, reverse bool
+	fg, bg                                         string
+}
+
+func (f *ircFormat) scan(s string) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02':
+			f.bold = !f.bold
+		case '\x1d':
+			f.italic = !f.italic
+		case '\x1f':
+			f.underline = !f.underline
+		case '\x1e':
+			f.strike = !f.strike
+		case '\x11':
+			f.mono = !f.mono
+		case '\x16':
+			f.reverse = !f.reverse
+		case '\x0f':
+			*f = ircFormat{}
+		case '\x03':
+			fg := colourDigits(s[i+1:])
+			if fg == "" {
+				f.fg, f.bg = "", ""
+				continue
+			}
+			i += len(fg)
+			f.fg = fg
+			if i+1 < len(s) && s[i+1] == ',' {
+				if bg := colourDigits(s[i+2:]); bg != "" {
+					f.bg = bg
+					i += 1 + len(bg)
+				}
+			}
+		}
+	}
+}
+
+/* Up to two leading digits of s. */
+func colourDigits(s string) string {
+	n := 0
+	for n < len(s) && n < 2 && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return s[:n]
+}
+
+/* Control codes that switch on the current state from a clean slate. */
+func (f ircFormat) codes() string {
+	var codes strings.Builder
+	if f.bold {
+		codes.WriteByte('\x02')
+	}
+	if f.italic {
+		codes.WriteByte('\x1d')
+	}
+	if f.underline {
+		codes.WriteByte('\x1f')
+	}
+	if f.strike {
+		codes.WriteByte('\x1e')
+	}
+	if f.mono {
+		codes.WriteByte('\x11')
+	}
+	if f.reverse {
+		codes.WriteByte('\x16')
+	}
+	if f.fg != "" {
+		/* Always two digits, so text starting with a digit isn't read as part of the colour. */
+		codes.WriteByte('\x03')
+		codes.WriteString(fmt.Sprintf("%02s", f.fg))
+		if f.bg != "" {
+			codes.WriteString(fmt.Sprintf(",%02s", f.bg))
+		}
+	}
+	return codes.String()
+}
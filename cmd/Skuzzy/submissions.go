@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Limits on flag submissions, from ctf.yaml. */
+type ThrottleConfig struct {
+	UserAttempts      int `yaml:"user_attempts,omitempty"`      /* Submissions per user per window, default 10. */
+	ChallengeAttempts int `yaml:"challenge_attempts,omitempty"` /* Submissions per user per challenge per window, default 5. */
+	Window            int `yaml:"window,omitempty"`             /* Seconds, default 60. */
+	Lockout           int `yaml:"lockout,omitempty"`            /* Seconds locked out after going over, default 300. */
+}
+
+const (
+	SubmissionCorrect = "correct"
+	SubmissionWrong   = "wrong"
+	SubmissionLocked  = "locked"
+)
+
+/* Challenge recorded for submissions that didn't name one. */
+const anyChallenge = "*"
+
+/* A private message to check as a flag, waiting in the server's SubmissionQueue. */
+type FlagSubmission struct {
+	Msg        *IRCMessage
+	User       string
+	Account    string
+	Submission string
+}
+
+/*
+ * One submission queue per server. Checking hashed flags is slow on purpose,
+ * so it's done by SubmissionWorker instead of the IRC read loop, one
+ * submission at a time so throttling and solves see each other.
+ */
+var SubmissionQueues = make(map[string]chan FlagSubmission)
+var SubmissionQueuesMutex = sync.Mutex{}
+
+/* Submissions waiting before new ones are turned away. */
+const submissionQueueSize = 32
+
+func (t ThrottleConfig) withDefaults() ThrottleConfig {
+	if t.UserAttempts <= 0 {
+		t.UserAttempts = 10
+	}
+	if t.ChallengeAttempts <= 0 {
+		t.ChallengeAttempts = 5
+	}
+	if t.Window <= 0 {
+		t.Window = 60
+	}
+	if t.Lockout <= 0 {
+		t.Lockout = 300
+	}
+	return t
+}
+
+/*
+ * Who is submitting, for throttling: the services account if logged in,
+ * otherwise the host, so changing nicks doesn't reset the limits.
+ */
+func submitter(msg *IRCMessage, account string) string {
+	if account != "" {
+		return accountMask + strings.ToLower(account)
+	}
+	if _, host, ok := strings.Cut(msg.Hostmask(), "@"); ok && host != "" {
+		return "host:" + strings.ToLower(host)
+	}
+	return "nick:" + strings.ToLower(msg.Nick())
+}
+
+/* Key for guess hashes when the server config has no submission_key, good until the bot restarts. */
+var submissionKeyFallback []byte
+var submissionKeyOnce sync.Once
+
+func submissionKey(settings *ServerConfig) []byte {
+	if settings.SubmissionKey != "" {
+		return []byte(settings.SubmissionKey)
+	}
+	submissionKeyOnce.Do(func() {
+		log.Printf("[submissionKey] Warning, no submission_key configured, shared answers are only spotted until a restart\n")
+		submissionKeyFallback = make([]byte, 32)
+		if _, err := rand.Read(submissionKeyFallback); err != nil {
+			log.Printf("[submissionKey] Error: %v\n", err)
+		}
+	})
+	return submissionKeyFallback
+}
+
+/*
+ * A keyed hash of a guess, to spot the same wrong or shared answer from
+ * different users without storing flags. Keyed so the flags can't be brute
+ * forced from the database alone.
+ */
+func guessHash(settings *ServerConfig, guess string) string {
+	mac := hmac.New(sha256.New, submissionKey(settings))
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(guess))))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func RecordSubmission(settings *ServerConfig, actor, user, account, challenge, guess, result string) {
+	_, err := DB.Exec("INSERT INTO ctf_submissions (server, actor, user, account, challenge, guess_hash, result, submitted) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?)", strings.ToLower(settings.Name), actor, user, account, challenge,
+		guessHash(settings, guess), result, time.Now().Unix())
+	if err != nil {
+		log.Printf("[RecordSubmission] Error recording a submission by %s: %v\n", user, err)
+	}
+}
+
+/* Until when actor is locked out of challenge (anyChallenge for all of them), zero if not. */
+func submissionLockout(server, actor, challenge string) time.Time {
+	var until int64
+	err := DB.QueryRow("SELECT MAX(until) FROM ctf_lockouts WHERE server = ? AND actor = ? AND (challenge = ? OR challenge = ?)",
+		strings.ToLower(server), actor, challenge, anyChallenge).Scan(&until)
+	if err != nil || until <= time.Now().Unix() {
+		return time.Time{}
+	}
+	return time.Unix(until, 0)
+}
+
+/* Submissions by actor within the last window seconds, for one challenge or anyChallenge for all. */
+func recentSubmissions(server, actor, challenge string, window int) int {
+	query := "SELECT COUNT(*) FROM ctf_submissions WHERE server = ? AND actor = ? AND submitted > ? AND result != ?"
+	args := []any{strings.ToLower(server), actor, time.Now().Unix() - int64(window), SubmissionLocked}
+	if challenge != anyChallenge {
+		query += " AND challenge = ?"
+		args = append(args, challenge)
+	}
+	var count int
+	if err := DB.QueryRow(query, args...).Scan(&count); err != nil {
+		log.Printf("[recentSubmissions] Error: %v\n", err)
+	}
+	return count
+}
+
+func lockOut(server, actor, challenge string, duration time.Duration) {
+	_, err := DB.Exec("INSERT OR REPLACE INTO ctf_lockouts (server, actor, challenge, until) VALUES (?, ?, ?, ?)",
+		strings.ToLower(server), actor, challenge, time.Now().Add(duration).Unix())
+	if err != nil {
+		log.Printf("[lockOut] Error locking out %s: %v\n", actor, err)
+	}
+}
+
+/*
+ * Check whether another submission is allowed and lock the submitter out if it
+ * goes over a limit. Returns a message for the user if it isn't.
+ */
+func throttleSubmission(server string, t ThrottleConfig, actor, challenge string) string {
+	if until := submissionLockout(server, actor, challenge); !until.IsZero() {
+		return fmt.Sprintf("Too many attempts, try again in %s.", formatDuration(time.Until(until)))
+	}
+	lockout := time.Duration(t.Lockout) * time.Second
+	if recentSubmissions(server, actor, anyChallenge, t.Window) >= t.UserAttempts {
+		lockOut(server, actor, anyChallenge, lockout)
+		log.Printf("[throttleSubmission] %s locked out of all challenges on %s\n", actor, server)
+		return fmt.Sprintf("Too many attempts, try again in %s.", formatDuration(lockout))
+	}
+	if challenge != anyChallenge && recentSubmissions(server, actor, challenge, t.Window) >= t.ChallengeAttempts {
+		lockOut(server, actor, challenge, lockout)
+		log.Printf("[throttleSubmission] %s locked out of %s on %s\n", actor, challenge, server)
+		return fmt.Sprintf("Too many attempts at %s, try again in %s.", challenge, formatDuration(lockout))
+	}
+	return ""
+}
+
+/* The flag submission queue for a server, created on first use. */
+func SubmissionQueue(server string) chan FlagSubmission {
+	SubmissionQueuesMutex.Lock()
+	defer SubmissionQueuesMutex.Unlock()
+	queue, ok := SubmissionQueues[server]
+	if !ok {
+		queue = make(chan FlagSubmission, submissionQueueSize)
+		SubmissionQueues[server] = queue
+	}
+	return queue
+}
+
+/* Queue a flag submitted in private without waiting for it to be checked. */
+func QueueFlagSubmission(settings *ServerConfig, msg *IRCMessage, user, account, submission string) {
+	select {
+	case SubmissionQueue(settings.Name) <- FlagSubmission{Msg: msg, User: user, Account: account, Submission: submission}:
+	default:
+		log.Printf("[QueueFlagSubmission] Queue for %s full, dropping a submission by %s\n", settings.Name, user)
+		send_irc(settings.Name, user, "Too many flags being checked right now, try again in a moment.")
+	}
+}
+
+/* Consumes the server's SubmissionQueue. */
+func SubmissionWorker(settings *ServerConfig) {
+	for {
+		s := <-SubmissionQueue(settings.Name)
+		SubmitFlag(settings, s.Msg, s.User, s.Account, s.Submission)
+	}
+}
+
+/*
+ * Handle a flag submitted in private: "<flag>" checks every challenge,
+ * "<challenge> <flag>" only the named one. Submissions naming a challenge or
+ * in a configured flag format are recorded and throttled. Anything else may
+ * just be chatter, so it's only checked quietly and recorded if it's a flag.
+ */
+func SubmitFlag(settings *ServerConfig, msg *IRCMessage, user, account, submission string) {
+	ctfconfig := ServerCTF(settings.Name)
+	if ctfconfig == nil {
+		return
+	}
+	if MalformedFlag(ctfconfig.FlagFormat, submission) {
+		send_irc(settings.Name, user, fmt.Sprintf("That doesn't look like a flag, flags look like %s", ctfconfig.FlagFormat))
+		return
+	}
+	challenges := make(map[string]CTF)
+	for k, ctf := range ctfconfig.CTFFlags {
+		if !ctf.Disabled {
+			challenges[k] = ctf
+		}
+	}
+	challenge := anyChallenge
+	guess := submission
+	if name, rest, ok := strings.Cut(strings.TrimSpace(submission), " "); ok {
+		for k, ctf := range ctfconfig.CTFFlags {
+			if strings.EqualFold(k, name) {
+				if ctf.Disabled {
+					send_irc(settings.Name, user, k+" is disabled.")
+					return
+				}
+				challenge = k
+				guess = strings.TrimSpace(rest)
+				challenges = map[string]CTF{k: ctf}
+				break
+			}
+		}
+	}
+	shaped := challenge != anyChallenge
+	for _, ctf := range challenges {
+		if format := ctfconfig.FlagFormatFor(ctf); format != "" {
+			if _, ok := FlagContent(format, guess); ok {
+				shaped = true
+				break
+			}
+		}
+	}
+	actor := submitter(msg, account)
+	if open, why := ctfconfig.Event.Open(time.Now()); !open {
+		if shaped {
+			send_irc(settings.Name, user, why)
+		}
+		return
+	}
+	if !shaped {
+		if !submissionLockout(settings.Name, actor, anyChallenge).IsZero() {
+			return
+		}
+	} else if refusal := throttleSubmission(settings.Name, ctfconfig.Throttle.withDefaults(), actor, challenge); refusal != "" {
+		RecordSubmission(settings, actor, user, account, challenge, guess, SubmissionLocked)
+		send_irc(settings.Name, user, refusal)
+		return
+	}
+	for k, ctf := range challenges {
+		if ctfconfig.FlagMatches(ctf, guess) {
+			RecordSubmission(settings, actor, user, account, k, guess, SubmissionCorrect)
+			solve, err := CTFSolved(settings, ctfconfig, k, ctf, user, account)
+			if errors.Is(err, ErrAlreadySolved) {
+				send_irc(settings.Name, user, "You or your team already solved "+k+".")
+				if CTFUserSolves(settings.Name, user)[k] {
+					/* For those who solved before identifying to services. */
+					QueueOnboarding(settings, ctfconfig, k, user, account)
+				}
+				return
+			} else if err != nil {
+				send_irc(settings.Name, user, fmt.Sprintf("That's the flag for %s, but %v.", k, err))
+				return
+			}
+			points := fmt.Sprintf("+%d points", solve.Points)
+			if solve.FirstBlood > 0 {
+				points += fmt.Sprintf(", and +%d for first blood 🩸", solve.FirstBlood)
+			}
+			if ctfconfig.Event.FrozenAt(time.Now()) > 0 {
+				/* Points would give away the standings the freeze hides, only the solver hears them. */
+				send_irc(settings.Name, ctf.Channel, fmt.Sprintf("Congrats to %s on finding the flag for '%s'!! 🎉🎉🎉", user, k))
+				send_irc(settings.Name, user, "That's the flag for "+k+": "+points)
+				return
+			}
+			send_irc(settings.Name, ctf.Channel, fmt.Sprintf("Congrats to %s on finding the flag for '%s'!! 🎉🎉🎉 %s", user, k, points))
+			return
+		}
+	}
+	if !shaped {
+		return
+	}
+	RecordSubmission(settings, actor, user, account, challenge, guess, SubmissionWrong)
+	if challenge != anyChallenge {
+		send_irc(settings.Name, user, "That's not the flag for "+challenge+".")
+	}
+}
+
+/* The latest submissions, optionally only by a user/account or for a challenge. */
+func SubmissionHistory(server, filter string, count int) []string {
+	query := "SELECT user, account, actor, challenge, guess_hash, result, submitted FROM ctf_submissions WHERE server = ?"
+	args := []any{strings.ToLower(server)}
+	if filter != "" {
+		query += " AND (user = ? COLLATE NOCASE OR account = ? COLLATE NOCASE OR challenge = ? COLLATE NOCASE)"
+		args = append(args, filter, filter, filter)
+	}
+	rows, err := DB.Query(query+" ORDER BY id DESC LIMIT ?", append(args, count)...)
+	if err != nil {
+		log.Printf("[SubmissionHistory] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var history []string
+	for rows.Next() {
+		var user, account, actor, challenge, hash, result string
+		var submitted int64
+		if err := rows.Scan(&user, &account, &actor, &challenge, &hash, &result, &submitted); err != nil {
+			continue
+		}
+		history = append(history, fmt.Sprintf("%s %s (%s) %s: %s [%s]", time.Unix(submitted, 0).UTC().Format("01-02 15:04:05"),
+			user, actor, challenge, result, hash))
+	}
+	return history
+}
+
+/* Correct answers submitted by more than one submitter, a hint that flags are being shared. */
+func SharedFlags(server string) []string {
+	rows, err := DB.Query("SELECT challenge, guess_hash, COUNT(DISTINCT actor), GROUP_CONCAT(DISTINCT user) FROM ctf_submissions "+
+		"WHERE server = ? AND result = ? AND guess_hash != '' GROUP BY challenge, guess_hash HAVING COUNT(DISTINCT actor) > 1",
+		strings.ToLower(server), SubmissionCorrect)
+	if err != nil {
+		log.Printf("[SharedFlags] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var shared []string
+	for rows.Next() {
+		var challenge, hash, users string
+		var count int
+		if err := rows.Scan(&challenge, &hash, &count, &users); err != nil {
+			continue
+		}
+		shared = append(shared, fmt.Sprintf("%s [%s]: %d submitters: %s", challenge, hash, count, users))
+	}
+	return shared
+}
+
+/* Submitters with the most wrong answers in the last day, to spot brute forcing. */
+func TopGuessers(server string, count int) []string {
+	rows, err := DB.Query("SELECT actor, GROUP_CONCAT(DISTINCT user), COUNT(*) FROM ctf_submissions "+
+		"WHERE server = ? AND result != ? AND submitted > ? GROUP BY actor ORDER BY COUNT(*) DESC LIMIT ?",
+		strings.ToLower(server), SubmissionCorrect, time.Now().Unix()-86400, count)
+	if err != nil {
+		log.Printf("[TopGuessers] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var top []string
+	for rows.Next() {
+		var actor, users string
+		var n int
+		if err := rows.Scan(&actor, &users, &n); err != nil {
+			continue
+		}
+		top = append(top, fmt.Sprintf("%s (%s): %d wrong or locked in 24h", actor, users, n))
+	}
+	return top
+}
+
+/* Lines for `!attempts`/`/admin ctf attempts`: history, "shared" or "top". */
+func AttemptsReport(server string, args []string) []string {
+	filter := ""
+	if len(args) > 0 {
+		filter = args[0]
+	}
+	var lines []string
+	switch strings.ToLower(filter) {
+	case "shared":
+		lines = SharedFlags(server)
+	case "top":
+		lines = TopGuessers(server, 10)
+	default:
+		lines = SubmissionHistory(server, filter, 20)
+	}
+	if len(lines) == 0 {
+		lines = []string{"Nothing recorded."}
+	}
+	return lines
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "attempts",
+		Syntax:      "[nick|account|challenge|shared|top]",
+		Description: "Show recent flag submissions, answers shared between users or the most active guessers",
+		Category:    "CTF Challenge",
+		Private:     true,
+		Role:        RoleAdmin,
+		Handler: func(ctx *CommandContext) {
+			for _, line := range AttemptsReport(ctx.Settings.Name, ctx.Args) {
+				send_irc_priority(ctx.Settings.Name, ctx.User, line, PriorityLow)
+			}
+		},
+	})
+}
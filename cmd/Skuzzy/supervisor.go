@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting             /* Dialing the server. */
+	StateRegistering            /* Socket up, CAP/SASL/NICK in progress. */
+	StateConnected              /* Welcome (001) received. */
+	StateBackoff                /* Waiting before the next attempt. */
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateRegistering:
+		return "registering"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	}
+	return "unknown"
+}
+
+var (
+	minBackoff   = 5 * time.Second
+	maxBackoff   = 10 * time.Minute
+	pingInterval = 90 * time.Second
+	pingTimeout  = 240 * time.Second /* No PONG for this long and the connection is torn down. */
+)
+
+/*
+ * Owns a server's connection lifecycle: connects, watches liveness with
+ * PING/PONG, tears the old connection down completely and reconnects with
+ * exponential backoff and jitter.
+ */
+type Supervisor struct {
+	mutex    sync.Mutex
+	settings *ServerConfig
+	state    ConnState
+	since    time.Time
+	attempts int           /* Consecutive reconnects, reset after a long-lived connection. */
+	lag      time.Duration /* Round trip of the last PING/PONG. */
+	pingSent time.Time
+	lastPong time.Time
+	lastErr  string
+	loadOnce sync.Once /* Reminders are scheduled on the first connection only. */
+}
+
+var Supervisors = make(map[string]*Supervisor)
+var SupervisorsMutex = sync.RWMutex{}
+
+func NewSupervisor(settings *ServerConfig) *Supervisor {
+	sup := &Supervisor{settings: settings, state: StateDisconnected, since: time.Now()}
+	SupervisorsMutex.Lock()
+	Supervisors[settings.Name] = sup
+	SupervisorsMutex.Unlock()
+	return sup
+}
+
+func FindSupervisor(server string) *Supervisor {
+	SupervisorsMutex.RLock()
+	defer SupervisorsMutex.RUnlock()
+	return Supervisors[server]
+}
+
+func (sup *Supervisor) setState(state ConnState) {
+	sup.mutex.Lock()
+	if sup.state == state {
+		sup.mutex.Unlock()
+		return
+	}
+	old := sup.state
+	sup.state = state
+	sup.since = time.Now()
+	sup.mutex.Unlock()
+
+	transition := fmt.Sprintf("[Supervisor] %s: %s -> %s\n", sup.settings.Name, old, state)
+	log.Print(transition)
+	select {
+	case InteractQueue <- transition:
+	default:
+	}
+}
+
+func (sup *Supervisor) State() ConnState {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+	return sup.state
+}
+
+/* Called by the dispatcher when the server has welcomed us. */
+func (sup *Supervisor) Registered() {
+	sup.setState(StateConnected)
+}
+
+/* Called by the dispatcher for PONGs answering our PINGs. */
+func (sup *Supervisor) Pong() {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+	sup.lastPong = time.Now()
+	if !sup.pingSent.IsZero() {
+		sup.lag = sup.lastPong.Sub(sup.pingSent)
+		sup.pingSent = time.Time{}
+	}
+}
+
+/* Connect and reconnect forever. */
+func (sup *Supervisor) Run() {
+	for {
+		started := time.Now()
+		sup.runOnce()
+		sup.mutex.Lock()
+		/* A connection that held up for a while resets the backoff. */
+		if time.Since(started) > maxBackoff {
+			sup.attempts = 0
+		}
+		sup.attempts++
+		delay := backoff(sup.attempts)
+		sup.mutex.Unlock()
+
+		sup.setState(StateBackoff)
+		log.Printf("[Supervisor] %s: reconnecting in %v\n", sup.settings.Name, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+}
+
+/* Exponential backoff with +/-25% jitter. */
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2)) - delay/4
+	return delay + jitter
+}
+
+/* One connection: connect, run the message loop until it ends, then tear everything down. */
+func (sup *Supervisor) runOnce() {
+	settings := sup.settings
+	sup.setState(StateConnecting)
+	if err := ServerRun(settings, sup); err != nil {
+		sup.mutex.Lock()
+		sup.lastErr = err.Error()
+		sup.mutex.Unlock()
+	}
+	teardown(settings.Name)
+	ResetServerState(settings.Name)
+	sup.setState(StateDisconnected)
+}
+
+/* Close the socket and outbound queue and forget the connection. */
+func teardown(server string) {
+	ConnectionsMutex.Lock()
+	defer ConnectionsMutex.Unlock()
+	conn, ok := Connections[server]
+	if !ok {
+		return
+	}
+	if conn.out != nil {
+		conn.out.Close()
+	}
+	if conn.cx != nil {
+		conn.cx.Close()
+	}
+	delete(Connections, server)
+}
+
+/* PING the server regularly and close the connection if it stops answering. */
+func (sup *Supervisor) pinger(done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	sup.mutex.Lock()
+	sup.lastPong = time.Now()
+	sup.pingSent = time.Time{}
+	sup.mutex.Unlock()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		sup.mutex.Lock()
+		silent := time.Since(sup.lastPong)
+		if sup.pingSent.IsZero() {
+			sup.pingSent = time.Now()
+		}
+		sup.mutex.Unlock()
+
+		ConnectionsMutex.RLock()
+		conn, ok := Connections[sup.settings.Name]
+		ConnectionsMutex.RUnlock()
+		if !ok {
+			return
+		}
+		if silent > pingTimeout {
+			log.Printf("[Supervisor] %s: no PONG for %v, closing the connection\n", sup.settings.Name, silent.Round(time.Second))
+			/* Closing the socket ends irc_loop, runOnce then tears down the rest. */
+			conn.cx.Close()
+			return
+		}
+		send_irc_raw(conn, "PING :HACK THE PLANET\r\n")
+	}
+}
+
+func (sup *Supervisor) Status() string {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+	status := fmt.Sprintf("%s (%s): %s for %v", sup.settings.Name, sup.settings.Host, sup.state,
+		time.Since(sup.since).Round(time.Second))
+	if sup.state == StateConnected {
+		status += fmt.Sprintf(", lag %v", sup.lag.Round(time.Millisecond))
+	}
+	if sup.attempts > 0 {
+		status += fmt.Sprintf(", %d reconnect(s)", sup.attempts)
+	}
+	if sup.lastErr != "" {
+		status += ", last error: " + sup.lastErr
+	}
+	return status
+}
+
+/* One status line per server, for the interact socket. */
+func SupervisorStatus() string {
+	SupervisorsMutex.RLock()
+	defer SupervisorsMutex.RUnlock()
+	if len(Supervisors) == 0 {
+		return "No servers."
+	}
+	var lines []string
+	for _, sup := range Supervisors {
+		lines = append(lines, sup.Status())
+	}
+	return strings.Join(lines, "\n")
+}
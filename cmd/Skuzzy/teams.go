@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+ * CTF teams. Members are nicks, like everywhere else in the CTF. A team's
+ * solves are the solves its members made while in it, every challenge counts
+ * once per team, and hints taken by members are charged to the team.
+ */
+
+const defaultTeamSize = 4
+
+type CTFTeam struct {
+	ID         int64
+	Name       string
+	InviteCode string
+}
+
+var rTeamName = regexp.MustCompile(`^[\w\-\.]{2,32}$`)
+
+var ErrNoTeam = errors.New("you're not in a team")
+
+func (config *CTFConfig) MaxTeamSize() int {
+	if config.TeamSize > 0 {
+		return config.TeamSize
+	}
+	return defaultTeamSize
+}
+
+func newInviteCode() (string, error) {
+	code := make([]byte, 5)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(code)), nil
+}
+
+/* The team user is in on server. */
+func CTFUserTeam(server, user string) (CTFTeam, error) {
+	var team CTFTeam
+	err := DB.QueryRow("SELECT t.id, t.name, t.invite_code FROM ctf_teams t JOIN ctf_team_members m ON m.team_id = t.id "+
+		"WHERE m.server = ? AND m.user = ?", strings.ToLower(server), strings.ToLower(user)).Scan(&team.ID, &team.Name, &team.InviteCode)
+	if err == sql.ErrNoRows {
+		return team, ErrNoTeam
+	}
+	return team, err
+}
+
+func TeamMembers(server string, team CTFTeam) []string {
+	rows, err := DB.Query("SELECT user FROM ctf_team_members WHERE server = ? AND team_id = ? ORDER BY joined",
+		strings.ToLower(server), team.ID)
+	if err != nil {
+		log.Printf("[TeamMembers] Error: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var user string
+		if rows.Scan(&user) == nil {
+			members = append(members, user)
+		}
+	}
+	return members
+}
+
+func CreateTeam(server, user, name string) (CTFTeam, error) {
+	server = strings.ToLower(server)
+	if !rTeamName.MatchString(name) {
+		return CTFTeam{}, fmt.Errorf("team names are 2 to 32 letters, digits, '-', '_' or '.'")
+	}
+	if team, err := CTFUserTeam(server, user); err == nil {
+		return CTFTeam{}, fmt.Errorf("you're already in %s, leave it first", team.Name)
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return CTFTeam{}, err
+	}
+	result, err := DB.Exec("INSERT INTO ctf_teams (server, name, invite_code, created_by, created) VALUES (?, ?, ?, ?, ?)",
+		server, name, code, strings.ToLower(user), time.Now().Unix())
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return CTFTeam{}, fmt.Errorf("there's already a team called %s", name)
+		}
+		return CTFTeam{}, err
+	}
+	team := CTFTeam{Name: name, InviteCode: code}
+	team.ID, _ = result.LastInsertId()
+	if _, err := DB.Exec("INSERT INTO ctf_team_members (server, user, team_id, joined) VALUES (?, ?, ?, ?)",
+		server, strings.ToLower(user), team.ID, time.Now().Unix()); err != nil {
+		return CTFTeam{}, err
+	}
+	log.Printf("[CreateTeam] %s created team %s on %s\n", user, name, server)
+	return team, nil
+}
+
+func JoinTeam(server, user, code string, maxSize int) (CTFTeam, error) {
+	server = strings.ToLower(server)
+	if team, err := CTFUserTeam(server, user); err == nil {
+		return CTFTeam{}, fmt.Errorf("you're already in %s, leave it first", team.Name)
+	}
+	var team CTFTeam
+	err := DB.QueryRow("SELECT id, name, invite_code FROM ctf_teams WHERE server = ? AND invite_code = ?",
+		server, strings.ToLower(code)).Scan(&team.ID, &team.Name, &team.InviteCode)
+	if err != nil {
+		return CTFTeam{}, fmt.Errorf("no team has that invite code")
+	}
+	if len(TeamMembers(server, team)) >= maxSize {
+		return CTFTeam{}, fmt.Errorf("%s is full, teams have at most %d members", team.Name, maxSize)
+	}
+	if _, err := DB.Exec("INSERT INTO ctf_team_members (server, user, team_id, joined) VALUES (?, ?, ?, ?)",
+		server, strings.ToLower(user), team.ID, time.Now().Unix()); err != nil {
+		return CTFTeam{}, err
+	}
+	log.Printf("[JoinTeam] %s joined team %s on %s\n", user, team.Name, server)
+	return team, nil
+}
+
+/* Leave the team, it's kept with its solves even once empty, but can't be joined by code any more. */
+func LeaveTeam(server, user string) (CTFTeam, error) {
+	server = strings.ToLower(server)
+	team, err := CTFUserTeam(server, user)
+	if err != nil {
+		return team, err
+	}
+	if _, err := DB.Exec("DELETE FROM ctf_team_members WHERE server = ? AND user = ?", server, strings.ToLower(user)); err != nil {
+		return team, err
+	}
+	if len(TeamMembers(server, team)) == 0 {
+		DB.Exec("UPDATE ctf_teams SET invite_code = '' WHERE id = ?", team.ID)
+	}
+	log.Printf("[LeaveTeam] %s left team %s on %s\n", user, team.Name, server)
+	return team, nil
+}
+
+/* The challenges a team has solved. */
+func CTFTeamSolves(server string, team CTFTeam) map[string]bool {
+	solved := make(map[string]bool)
+	if team.ID == 0 {
+		/* Not a team, solves outside teams have team_id 0. */
+		return solved
+	}
+	rows, err := DB.Query("SELECT challenge FROM ctf_solves WHERE server = ? AND team_id = ?", strings.ToLower(server), team.ID)
+	if err != nil {
+		log.Printf("[CTFTeamSolves] Error: %v\n", err)
+		return solved
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var challenge string
+		if rows.Scan(&challenge) == nil {
+			solved[challenge] = true
+		}
+	}
+	return solved
+}
+
+/* Like CTFScores, for teams. Each challenge counts once per team. */
+func CTFTeamScores(server, channel string, config *CTFConfig, until int64) []CTFStanding {
+	server = strings.ToLower(server)
+	channel = strings.ToLower(channel)
+	counts := ctfSolveCountsUntil(server, until)
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	standings := make(map[string]*CTFStanding)
+	rows, err := DB.Query("SELECT t.name, s.challenge, s.first_blood, s.solved FROM ctf_solves s JOIN ctf_teams t ON t.id = s.team_id "+
+		"WHERE s.server = ? AND s.channel = ? AND s.solved <= ?", server, channel, until)
+	if err != nil {
+		log.Printf("[CTFTeamScores] Error: %v\n", err)
+		return nil
+	}
+	for rows.Next() {
+		var name, challenge string
+		var firstBlood int
+		var solved int64
+		if err := rows.Scan(&name, &challenge, &firstBlood, &solved); err != nil {
+			break
+		}
+		ctf, ok := config.CTFFlags[challenge]
+		if !ok {
+			continue
+		}
+		if _, ok := standings[name]; !ok {
+			standings[name] = &CTFStanding{User: name}
+		}
+		s := standings[name]
+		s.Points += ctf.Value(counts[challenge]-1) + firstBlood
+		s.Solves++
+		s.FirstBloods += min(firstBlood, 1)
+		s.LastSolve = max(s.LastSolve, solved)
+	}
+	rows.Close()
+
+	rows, err = DB.Query("SELECT t.name, COUNT(*), SUM(h.cost) FROM ctf_hint_unlocks h JOIN ctf_teams t ON t.id = h.team_id "+
+		"WHERE h.server = ? AND h.channel = ? AND h.cost > 0 AND h.taken <= ? GROUP BY t.name", server, channel, until)
+	if err != nil {
+		log.Printf("[CTFTeamScores] Error: %v\n", err)
+		return SortStandings(standings)
+	}
+	for rows.Next() {
+		var name string
+		var hints, cost int
+		if rows.Scan(&name, &hints, &cost) != nil {
+			break
+		}
+		if s, ok := standings[name]; ok {
+			s.Hints = hints
+			s.Points -= cost
+		}
+	}
+	rows.Close()
+	return SortStandings(standings)
+}
+
+/* The team scoreboard of a channel, frozen like the players' one. */
+func SendTeamScores(server, channel string) {
+	ctfconfig := ServerCTF(server)
+	if ctfconfig == nil {
+		return
+	}
+	frozen := ctfconfig.Event.FrozenAt(time.Now())
+	response := "CTF Team Scores for " + channel + ": "
+	if frozen > 0 {
+		response = "CTF Team Scores for " + channel + " (frozen): "
+	}
+	send_irc(server, channel, response+FormatStandings(CTFTeamScores(server, channel, ctfconfig, frozen), 10))
+}
+
+func teamCommand(ctx *CommandContext) {
+	ctfconfig := ServerCTF(ctx.Settings.Name)
+	if ctfconfig == nil {
+		ctx.Reply("There is no CTF running here.")
+		return
+	}
+	server := ctx.Settings.Name
+	subcommand := "info"
+	if len(ctx.Args) > 0 {
+		subcommand = strings.ToLower(ctx.Args[0])
+	}
+	switch subcommand {
+	case "create":
+		if len(ctx.Args) < 2 {
+			ctx.Reply("Usage: " + ctx.Command.Usage())
+			return
+		}
+		team, err := CreateTeam(server, ctx.User, ctx.Args[1])
+		if err != nil {
+			ctx.Reply("Unable to create the team: " + err.Error())
+			return
+		}
+		ctx.Reply(fmt.Sprintf("Created team %s. Others can join with: !team join %s", team.Name, team.InviteCode))
+	case "join":
+		if len(ctx.Args) < 2 {
+			ctx.Reply("Usage: " + ctx.Command.Usage())
+			return
+		}
+		team, err := JoinTeam(server, ctx.User, ctx.Args[1], ctfconfig.MaxTeamSize())
+		if err != nil {
+			ctx.Reply("Unable to join: " + err.Error())
+			return
+		}
+		ctx.Reply("You're now in team " + team.Name + ".")
+		for _, member := range TeamMembers(server, team) {
+			if !strings.EqualFold(member, ctx.User) {
+				send_irc(server, member, ctx.User+" joined your team "+team.Name+".")
+			}
+		}
+	case "leave":
+		team, err := LeaveTeam(server, ctx.User)
+		if err != nil {
+			ctx.Reply(err.Error())
+			return
+		}
+		ctx.Reply("You left team " + team.Name + ", its solves stay with it.")
+	case "info":
+		team, err := CTFUserTeam(server, ctx.User)
+		if err != nil {
+			ctx.Reply(err.Error() + ", create one with !team create <name> or join one with !team join <code>")
+			return
+		}
+		ctx.Reply(fmt.Sprintf("Team %s: %s. Invite code: %s (%d members at most)", team.Name,
+			strings.Join(TeamMembers(server, team), ", "), team.InviteCode, ctfconfig.MaxTeamSize()))
+	default:
+		ctx.Reply("Usage: " + ctx.Command.Usage())
+	}
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "team",
+		Syntax:      "[create <name>|join <code>|leave|info]",
+		Description: "Play the CTF as a team, invite codes are only given in private",
+		Category:    "CTF Challenge",
+		Private:     true,
+		Handler:     teamCommand,
+	})
+	RegisterCommand(&Command{
+		Name:        "team_scores",
+		Description: "Display the CTF team scores for the channel",
+		Category:    "CTF Challenge",
+		Channel:     true,
+		Cooldown:    10 * time.Second,
+		Handler: func(ctx *CommandContext) {
+			SendTeamScores(ctx.Settings.Name, ctx.Channel)
+		},
+	})
+}